@@ -0,0 +1,217 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mumoshu/diplomat/pkg"
+)
+
+const deadLettersUsage = `Usage: diplomatctl deadletters <command> [flags] [args]
+
+Commands:
+  list                         List the events that failed to be delivered to any procedure
+  describe <id>                Show the event, the route and the error of the dead letter
+  replay <id>                  Send the event again and print the output. The dead letter is deleted once delivered
+  delete <id>                  Delete the dead letter without replaying it
+`
+
+func runDeadLetters(args []string) error {
+	if len(args) < 1 {
+		fmt.Fprint(os.Stderr, deadLettersUsage)
+		return fmt.Errorf("missing command")
+	}
+	switch args[0] {
+	case "list":
+		return runDeadLettersList(args[1:])
+	case "describe":
+		return runDeadLettersDescribe(args[1:])
+	case "replay":
+		return runDeadLettersReplay(args[1:])
+	case "delete":
+		return runDeadLettersDelete(args[1:])
+	}
+	fmt.Fprint(os.Stderr, deadLettersUsage)
+	return fmt.Errorf("unknown command %q", args[0])
+}
+
+func runDeadLettersList(args []string) error {
+	fs := flag.NewFlagSet("deadletters list", flag.ContinueOnError)
+	var srvFlags serverFlags
+	srvFlags.register(fs)
+	output := fs.String("o", outputText, "Output format: text, json or yaml")
+	if _, err := parseArgs(fs, args); err != nil {
+		return err
+	}
+	p, err := newOutputPrinter(*output)
+	if err != nil {
+		return err
+	}
+
+	c, err := srvFlags.connect(fmt.Sprintf("diplomatctl-deadletters-%d", os.Getpid()))
+	if err != nil {
+		return fmt.Errorf("unable to connect to %s: %v", srvFlags.url, err)
+	}
+	defer c.Close()
+
+	dls, err := c.ListDeadLetters()
+	if err != nil {
+		return err
+	}
+	if p != nil {
+		values := []map[string]interface{}{}
+		for _, dl := range dls {
+			values = append(values, deadLetterValue(dl))
+		}
+		return p.printValue(values)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tFAILED AT\tCHANNEL\tROUTE\tATTEMPTS\tREASON")
+	for _, dl := range dls {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\n", dl.ID, dl.FailedAt.Format(time.RFC3339), dl.Channel, dl.Route, dl.Attempts, dl.Reason)
+	}
+	return w.Flush()
+}
+
+func runDeadLettersDescribe(args []string) error {
+	fs := flag.NewFlagSet("deadletters describe", flag.ContinueOnError)
+	var srvFlags serverFlags
+	srvFlags.register(fs)
+	output := fs.String("o", outputText, "Output format: text, json or yaml")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return fmt.Errorf("usage: diplomatctl deadletters describe <id>")
+	}
+	p, err := newOutputPrinter(*output)
+	if err != nil {
+		return err
+	}
+
+	c, err := srvFlags.connect(fmt.Sprintf("diplomatctl-deadletters-%d", os.Getpid()))
+	if err != nil {
+		return fmt.Errorf("unable to connect to %s: %v", srvFlags.url, err)
+	}
+	defer c.Close()
+
+	dl, err := c.DescribeDeadLetter(positional[0])
+	if err != nil {
+		return err
+	}
+	if p != nil {
+		return p.printValue(deadLetterValue(dl))
+	}
+	return printDeadLetterText(os.Stdout, dl)
+}
+
+func runDeadLettersReplay(args []string) error {
+	fs := flag.NewFlagSet("deadletters replay", flag.ContinueOnError)
+	var srvFlags serverFlags
+	srvFlags.register(fs)
+	output := fs.String("o", outputText, "Output format: text, json, yaml or raw")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return fmt.Errorf("usage: diplomatctl deadletters replay <id>")
+	}
+
+	var p *printer
+	if *output != outputText {
+		p, err = newPrinter(*output, os.Stdout)
+		if err != nil {
+			return err
+		}
+	}
+
+	c, err := srvFlags.connect(fmt.Sprintf("diplomatctl-deadletters-%d", os.Getpid()))
+	if err != nil {
+		return fmt.Errorf("unable to connect to %s: %v", srvFlags.url, err)
+	}
+	defer c.Close()
+
+	out, err := c.ReplayDeadLetter(positional[0])
+	if err != nil {
+		return err
+	}
+
+	if p == nil {
+		return printOutputText(os.Stdout, out)
+	}
+	if p.format == outputRaw {
+		return p.printBody(out.Body)
+	}
+	return p.printValue(outputValue(out))
+}
+
+func runDeadLettersDelete(args []string) error {
+	fs := flag.NewFlagSet("deadletters delete", flag.ContinueOnError)
+	var srvFlags serverFlags
+	srvFlags.register(fs)
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return fmt.Errorf("usage: diplomatctl deadletters delete <id>")
+	}
+
+	c, err := srvFlags.connect(fmt.Sprintf("diplomatctl-deadletters-%d", os.Getpid()))
+	if err != nil {
+		return fmt.Errorf("unable to connect to %s: %v", srvFlags.url, err)
+	}
+	defer c.Close()
+
+	return c.DeleteDeadLetter(positional[0])
+}
+
+func printDeadLetterText(out io.Writer, dl *diplomat.DeadLetter) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "ID:\t%s\n", dl.ID)
+	fmt.Fprintf(w, "Failed at:\t%s\n", dl.FailedAt.Format(time.RFC3339))
+	fmt.Fprintf(w, "Channel:\t%s\n", dl.Channel)
+	if dl.Method != "" {
+		fmt.Fprintf(w, "Method:\t%s\n", dl.Method)
+	}
+	if dl.RawQuery != "" {
+		fmt.Fprintf(w, "Query:\t%s\n", dl.RawQuery)
+	}
+	fmt.Fprintf(w, "Route:\t%s\n", dl.Route)
+	fmt.Fprintf(w, "Attempts:\t%d\n", dl.Attempts)
+	fmt.Fprintf(w, "Reason:\t%s\n", dl.Reason)
+	fmt.Fprintf(w, "Error:\t%s\n", dl.Error)
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(out, "\n%s\n", string(dl.Body))
+	return err
+}
+
+// deadLetterValue is the dead letter with the body decoded like outputValue, so that JSON bodies are not printed in base64
+func deadLetterValue(dl *diplomat.DeadLetter) map[string]interface{} {
+	var body interface{} = string(dl.Body)
+	if v, ok := decodeJSON(dl.Body); ok {
+		body = v
+	}
+	return map[string]interface{}{
+		"id":       dl.ID,
+		"failedAt": dl.FailedAt,
+		"channel":  dl.Channel,
+		"method":   dl.Method,
+		"query":    dl.RawQuery,
+		"header":   dl.Header,
+		"body":     body,
+		"route":    dl.Route,
+		"attempts": dl.Attempts,
+		"reason":   dl.Reason,
+		"error":    dl.Error,
+	}
+}
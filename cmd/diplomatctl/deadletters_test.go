@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mumoshu/diplomat/pkg"
+)
+
+func TestDeadLetters(t *testing.T) {
+	opened := diplomat.OnURL(testChannel).Where("action").EqString("opened")
+	failedAt := time.Date(2019, 4, 1, 12, 30, 0, 0, time.UTC)
+	newDeadLetter := func(id, body string) *diplomat.DeadLetter {
+		return &diplomat.DeadLetter{
+			ID:       id,
+			Event:    diplomat.Event{Channel: testChannel, Body: []byte(body), Header: map[string][]string{"Content-Type": {"application/json"}}},
+			Reason:   "diplomat.error.callee_failed",
+			Route:    opened.ID(),
+			Error:    "no callee",
+			Attempts: 2,
+			FailedAt: failedAt,
+		}
+	}
+
+	srv, flags, stop := startTestServer(t)
+	defer stop()
+	c, err := srv.Connect("callee")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.ServeRoute(diplomat.RouteConfig{RouteCondition: opened}, func(evt []byte) ([]byte, error) { return evt, nil }); err != nil {
+		t.Fatal(err)
+	}
+	// Saved out of order, and listed in the order of the IDs
+	for _, dl := range []*diplomat.DeadLetter{
+		newDeadLetter("dl2", `{"action":"closed"}`),
+		newDeadLetter("dl1", `{"action":"opened"}`),
+	} {
+		if err := srv.DeadLetterStore.Save(dl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	args := func(args ...string) []string {
+		return append(args, flags...)
+	}
+	run := func(t *testing.T, args ...string) string {
+		out, err := runCommand(runDeadLetters, args...)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return out
+	}
+	// lines returns the lines of the output with the columns separated by single spaces
+	lines := func(out string) []string {
+		ls := []string{}
+		for _, l := range strings.Split(strings.TrimSpace(out), "\n") {
+			ls = append(ls, strings.Join(strings.Fields(l), " "))
+		}
+		return ls
+	}
+
+	t.Run("list", func(t *testing.T) {
+		want := []string{
+			"ID FAILED AT CHANNEL ROUTE ATTEMPTS REASON",
+			"dl1 2019-04-01T12:30:00Z " + testChannel + " " + string(opened.ID()) + " 2 diplomat.error.callee_failed",
+			"dl2 2019-04-01T12:30:00Z " + testChannel + " " + string(opened.ID()) + " 2 diplomat.error.callee_failed",
+		}
+		if got := lines(run(t, args("list")...)); !reflect.DeepEqual(got, want) {
+			t.Errorf("unexpected output: want %q, got %q", want, got)
+		}
+	})
+
+	t.Run("describe", func(t *testing.T) {
+		out := lines(run(t, args("describe", "dl1")...))
+		for _, l := range []string{"Route: " + string(opened.ID()), "Error: no callee", `{"action":"opened"}`} {
+			if !strings.Contains(strings.Join(out, "\n"), l) {
+				t.Errorf("unexpected output: want the line %q, got %q", l, out)
+			}
+		}
+	})
+
+	t.Run("describe json", func(t *testing.T) {
+		got := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(run(t, args("describe", "dl1", "-ojson")...)), &got); err != nil {
+			t.Fatalf("unexpected output: %v", err)
+		}
+		// JSON bodies are printed as they are instead of in Base64
+		if want := map[string]interface{}{"action": "opened"}; !reflect.DeepEqual(got["body"], want) {
+			t.Errorf("unexpected body: want %v, got %v", want, got["body"])
+		}
+		if got["attempts"] != float64(2) || got["failedAt"] != "2019-04-01T12:30:00Z" {
+			t.Errorf("unexpected dead letter: got %v", got)
+		}
+	})
+
+	t.Run("replay undeliverable", func(t *testing.T) {
+		_, err := runCommand(runDeadLetters, args("replay", "dl2")...)
+		if diplomat.ErrorKind(err) != diplomat.ErrNoRoute {
+			t.Fatalf("unexpected error: want %v, got %v", diplomat.ErrNoRoute, err)
+		}
+		// Kept with the error of the replay
+		dl, err := srv.DeadLetterStore.Get("dl2")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if dl.Reason != "diplomat.error.no_route" || !dl.FailedAt.After(failedAt) {
+			t.Errorf("unexpected dead letter: want it failed again with diplomat.error.no_route, got %+v", dl)
+		}
+	})
+
+	t.Run("replay", func(t *testing.T) {
+		want := []string{"200 OK", `{"action":"opened"}`}
+		if got := lines(run(t, args("replay", "dl1")...)); got[0] != want[0] || got[len(got)-1] != want[1] {
+			t.Errorf("unexpected output: want %q, got %q", want, got)
+		}
+		if _, err := runCommand(runDeadLetters, args("describe", "dl1")...); err == nil {
+			t.Error("unexpected dead letter after the replay")
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		run(t, args("delete", "dl2")...)
+		if got := lines(run(t, args("list")...)); len(got) != 1 {
+			t.Errorf("unexpected output: want only the header, got %q", got)
+		}
+		// Deleting twice is not an error, like deleting from the store
+		run(t, args("delete", "dl2")...)
+	})
+
+	testcases := []struct {
+		name    string
+		args    []string
+		wantErr string
+	}{
+		{name: "replay missing", args: args("replay", "dl3"), wantErr: "dead letter not found: dl3"},
+		{name: "describe without id", args: args("describe"), wantErr: "usage: diplomatctl deadletters describe <id>"},
+		{name: "delete too many ids", args: args("delete", "dl1", "dl2"), wantErr: "usage: diplomatctl deadletters delete <id>"},
+		{name: "unsupported output", args: args("replay", "dl1", "-o", "xml"), wantErr: `unsupported output format "xml"`},
+		{name: "missing command", wantErr: "missing command"},
+		{name: "unknown command", args: []string{"purge"}, wantErr: `unknown command "purge"`},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := runCommand(runDeadLetters, tc.args...); err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("unexpected error: want %q, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
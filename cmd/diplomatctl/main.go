@@ -0,0 +1,121 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/mumoshu/diplomat/pkg"
+)
+
+const usage = `Usage: diplomatctl <command> [flags] [args]
+
+Commands:
+  tap <channel> [path=value ...]    Stream events passing through the channel to stdout
+  call <channel> [body]             Send an event to the channel and print the output of the procedure that handled it
+  publish <channel> [body]          Send an event to the channel without waiting for the output
+  routes list|describe|explain      Inspect the routes registered to the server
+  deadletters list|describe|replay|delete
+                                    Inspect and replay the events that failed to be delivered
+
+Run 'diplomatctl <command> -h' for the flags of each command.
+`
+
+type command struct {
+	name string
+	run  func(args []string) error
+}
+
+var commands = []command{
+	{name: "tap", run: runTap},
+	{name: "call", run: runCall},
+	{name: "publish", run: runPublish},
+	{name: "routes", run: runRoutes},
+	{name: "deadletters", run: runDeadLetters},
+}
+
+func main() {
+	log.SetOutput(os.Stderr)
+
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	name := os.Args[1]
+	for _, c := range commands {
+		if c.name == name {
+			if err := c.run(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "diplomatctl %s: %v\n", name, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "diplomatctl: unknown command %q\n\n%s", name, usage)
+	os.Exit(2)
+}
+
+// serverFlags are the flags shared by all the commands that connect to a diplomat server
+type serverFlags struct {
+	url   string
+	realm string
+	debug bool
+}
+
+func (f *serverFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.url, "server", envOrDefault("DIPLOMAT_SERVER", "ws://127.0.0.1:8000"), "WebSocket URL of the diplomat server")
+	fs.StringVar(&f.realm, "realm", envOrDefault("DIPLOMAT_REALM", "channel1"), "WAMP realm of the diplomat server")
+	fs.BoolVar(&f.debug, "debug", false, "Print WAMP client logs to stderr")
+}
+
+func (f *serverFlags) connect(name string) (*diplomat.Client, error) {
+	ref := &diplomat.RemoteServerRef{
+		Realm:  f.realm,
+		URL:    f.url,
+		Logger: log.New(os.Stderr, fmt.Sprintf("ws %s> ", name), log.LstdFlags),
+	}
+	if !f.debug {
+		ref.Logger.SetOutput(ioutil.Discard)
+		log.SetOutput(ioutil.Discard)
+	}
+	return ref.Connect(name)
+}
+
+func envOrDefault(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// parseArgs parses flags and positional arguments in any order, so that `tap <channel> -ojson` works like `tap -o json <channel>`.
+// Single-letter flags accept their value without a separator, as in `-ojson`.
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	normalized := []string{}
+	for _, a := range args {
+		if len(a) > 2 && a[0] == '-' && a[1] != '-' && a[2] != '=' && fs.Lookup(a[1:2]) != nil && fs.Lookup(strings.SplitN(a[1:], "=", 2)[0]) == nil {
+			a = a[:2] + "=" + a[2:]
+		}
+		normalized = append(normalized, a)
+	}
+
+	positional := []string{}
+	rest := normalized
+	for {
+		if err := fs.Parse(rest); err != nil {
+			return nil, err
+		}
+		rest = fs.Args()
+		if len(rest) == 0 {
+			break
+		}
+		positional = append(positional, rest[0])
+		rest = rest[1:]
+	}
+	return positional, nil
+}
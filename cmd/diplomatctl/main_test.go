@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gammazero/nexus/wamp"
+	"github.com/mumoshu/diplomat/pkg"
+)
+
+const testChannel = "http://example.com/webhook"
+
+// startTestServer starts the diplomat server on free local ports with the store in a temporary directory,
+// and returns the server flags of the commands to connect to it along with the func to stop it
+func startTestServer(t *testing.T) (*diplomat.Server, []string, func()) {
+	dir, err := ioutil.TempDir("", "diplomatctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := diplomat.NewServer(diplomat.Server{
+		Realm:     "test",
+		NetAddr:   "127.0.0.1",
+		WsPort:    freePort(t),
+		StorePath: filepath.Join(dir, "diplomat.db"),
+	})
+	srv.HttpPort = freePort(t)
+	closer, err := srv.ListenAndServe()
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	sessions, err := watchSessions(srv)
+	if err != nil {
+		closer.Close()
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	flags := []string{"-server", fmt.Sprintf("ws://127.0.0.1:%d/", srv.WsPort), "-realm", srv.Realm}
+	return srv, flags, func() {
+		sessions.wait(t)
+		closer.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// sessionWatcher counts the sessions that joined the router and have not left yet.
+// The router publishes the leave of a session to the subscribers after the session is gone, and panics when it is closed in the meantime,
+// so the server is stopped only after the sessions of the commands have left
+type sessionWatcher struct {
+	*diplomat.Client
+	mu   sync.Mutex
+	open int
+}
+
+func watchSessions(srv *diplomat.Server) (*sessionWatcher, error) {
+	c, err := srv.Connect("diplomatctl-test")
+	if err != nil {
+		return nil, err
+	}
+	w := &sessionWatcher{Client: c}
+	for topic, delta := range map[string]int{string(wamp.MetaEventSessionOnJoin): 1, string(wamp.MetaEventSessionOnLeave): -1} {
+		delta := delta
+		if err := c.Subscribe(topic, func(args wamp.List, kwargs, details wamp.Dict) {
+			w.mu.Lock()
+			w.open += delta
+			w.mu.Unlock()
+		}, nil); err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+func (w *sessionWatcher) wait(t *testing.T) {
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		w.mu.Lock()
+		open := w.open
+		w.mu.Unlock()
+		if open <= 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected sessions: want all of them left, got %d open", open)
+		}
+	}
+	// The acknowledged publication returns once the router published the leaves to all the other subscribers too
+	if err := w.Publish("diplomatctl.test.sync", wamp.Dict{wamp.OptAcknowledge: true}, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// runCommand runs the command with the args, and returns what it printed to stdout
+func runCommand(run func(args []string) error, args ...string) (string, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return "", err
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	out := make(chan string)
+	go func() {
+		buf := &bytes.Buffer{}
+		io.Copy(buf, r)
+		out <- buf.String()
+	}()
+	err = run(args)
+	w.Close()
+	return <-out, err
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	outputJSON = "json"
+	outputYAML = "yaml"
+	outputRaw  = "raw"
+)
+
+type printer struct {
+	format string
+	w      io.Writer
+}
+
+func newPrinter(format string, w io.Writer) (*printer, error) {
+	switch format {
+	case outputJSON, outputYAML, outputRaw:
+		return &printer{format: format, w: w}, nil
+	}
+	return nil, fmt.Errorf("unsupported output format %q: must be one of %s, %s, %s", format, outputJSON, outputYAML, outputRaw)
+}
+
+// printBody prints an event body. Bodies that are not valid JSON are printed as JSON or YAML strings.
+func (p *printer) printBody(body []byte) error {
+	if p.format == outputRaw {
+		if _, err := p.w.Write(body); err != nil {
+			return err
+		}
+		if len(body) == 0 || body[len(body)-1] != '\n' {
+			_, err := io.WriteString(p.w, "\n")
+			return err
+		}
+		return nil
+	}
+
+	if v, ok := decodeJSON(body); ok {
+		return p.printValue(v)
+	}
+	return p.printValue(string(body))
+}
+
+func decodeJSON(data []byte) (interface{}, bool) {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, false
+	}
+	return v, true
+}
+
+// printValue prints a value as a single line of JSON, or as a YAML document.
+// Values are converted to YAML via JSON, so that both formats use the same keys.
+func (p *printer) printValue(v interface{}) error {
+	switch p.format {
+	case outputYAML:
+		js, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		generic, _ := decodeJSON(js)
+		bs, err := yaml.Marshal(generic)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(p.w, "---\n%s", bs)
+		return err
+	default:
+		buf := &bytes.Buffer{}
+		enc := json.NewEncoder(buf)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+		_, err := p.w.Write(buf.Bytes())
+		return err
+	}
+}
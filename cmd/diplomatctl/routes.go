@@ -0,0 +1,220 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/gammazero/nexus/wamp"
+	"github.com/mumoshu/diplomat/pkg"
+)
+
+const routesUsage = `Usage: diplomatctl routes <command> [flags] [args]
+
+Commands:
+  list                         List every route with its topics and procedures
+  describe <id>                Show the condition of the route
+  explain <channel> [body]     Show which routes an event sent to the channel would match, with what score, and which one would be selected
+`
+
+func runRoutes(args []string) error {
+	if len(args) < 1 {
+		fmt.Fprint(os.Stderr, routesUsage)
+		return fmt.Errorf("missing command")
+	}
+	switch args[0] {
+	case "list":
+		return runRoutesList(args[1:])
+	case "describe":
+		return runRoutesDescribe(args[1:])
+	case "explain":
+		return runRoutesExplain(args[1:])
+	}
+	fmt.Fprint(os.Stderr, routesUsage)
+	return fmt.Errorf("unknown command %q", args[0])
+}
+
+// newOutputPrinter returns nil for the text output, which is printed by each command on its own
+func newOutputPrinter(format string) (*printer, error) {
+	if format == outputText {
+		return nil, nil
+	}
+	if format == outputRaw {
+		return nil, fmt.Errorf("unsupported output format %q: must be one of %s, %s, %s", format, outputText, outputJSON, outputYAML)
+	}
+	return newPrinter(format, os.Stdout)
+}
+
+func runRoutesList(args []string) error {
+	fs := flag.NewFlagSet("routes list", flag.ContinueOnError)
+	var srvFlags serverFlags
+	srvFlags.register(fs)
+	output := fs.String("o", outputText, "Output format: text, json or yaml")
+	if _, err := parseArgs(fs, args); err != nil {
+		return err
+	}
+	p, err := newOutputPrinter(*output)
+	if err != nil {
+		return err
+	}
+
+	c, err := srvFlags.connect(fmt.Sprintf("diplomatctl-routes-%d", os.Getpid()))
+	if err != nil {
+		return fmt.Errorf("unable to connect to %s: %v", srvFlags.url, err)
+	}
+	defer c.Close()
+
+	routes, err := c.ListRoutes()
+	if err != nil {
+		return err
+	}
+	if p != nil {
+		return p.printValue(routes)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTOPICS\tPROCEDURES\tSESSIONS")
+	for _, r := range routes {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", r.ID, joinComma(r.Topics), joinComma(r.Procedures), joinComma(sessionIDs(&r)))
+	}
+	return w.Flush()
+}
+
+func runRoutesDescribe(args []string) error {
+	fs := flag.NewFlagSet("routes describe", flag.ContinueOnError)
+	var srvFlags serverFlags
+	srvFlags.register(fs)
+	output := fs.String("o", outputText, "Output format: text, json or yaml")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return fmt.Errorf("usage: diplomatctl routes describe <id>")
+	}
+	p, err := newOutputPrinter(*output)
+	if err != nil {
+		return err
+	}
+
+	c, err := srvFlags.connect(fmt.Sprintf("diplomatctl-routes-%d", os.Getpid()))
+	if err != nil {
+		return fmt.Errorf("unable to connect to %s: %v", srvFlags.url, err)
+	}
+	defer c.Close()
+
+	route, err := c.DescribeRoute(diplomat.RouteConditionID(positional[0]))
+	if err != nil {
+		return err
+	}
+	if p != nil {
+		return p.printValue(route)
+	}
+	return printRouteText(os.Stdout, route)
+}
+
+func printRouteText(out io.Writer, r *diplomat.RouteInfo) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "ID:\t%s\n", r.ID)
+	fmt.Fprintf(w, "Channel:\t%s\n", r.Channel)
+	if r.FormParameterName != "" {
+		fmt.Fprintf(w, "Form parameter:\t%s\n", r.FormParameterName)
+	}
+	if r.BodyFormat != "" {
+		fmt.Fprintf(w, "Body format:\t%s\n", r.BodyFormat)
+	}
+	fmt.Fprintf(w, "Condition:\t%s\n", r.Condition)
+	fmt.Fprintf(w, "Expressions:\t%s\n", joinLines(r.Expressions))
+	fmt.Fprintf(w, "Topics:\t%s\n", joinLines(r.Topics))
+	fmt.Fprintf(w, "Procedures:\t%s\n", joinLines(r.Procedures))
+	if len(r.Procedures) > 0 {
+		fmt.Fprintf(w, "Dispatch:\t%s\n", r.Dispatch)
+		fmt.Fprintf(w, "Priority:\t%d\n", r.Priority)
+		fmt.Fprintf(w, "Retry:\t%s\n", r.Retry)
+		fmt.Fprintf(w, "Async:\t%t\n", r.Async)
+		fmt.Fprintf(w, "Rate limit:\t%s\n", r.RateLimit)
+	}
+	fmt.Fprintf(w, "Sessions:\t%s\n", joinLines(sessionIDs(r)))
+	return w.Flush()
+}
+
+// sessionIDs returns the distinct sessions that own the topics or procedures of the route
+func sessionIDs(r *diplomat.RouteInfo) []string {
+	ids := []string{}
+	seen := map[string]bool{}
+	for _, id := range append(append([]wamp.ID{}, r.TopicSessions...), r.ProcedureSessions...) {
+		s := fmt.Sprint(id)
+		if !seen[s] {
+			seen[s] = true
+			ids = append(ids, s)
+		}
+	}
+	return ids
+}
+
+func joinComma(items []string) string {
+	if len(items) == 0 {
+		return "-"
+	}
+	return strings.Join(items, ",")
+}
+
+func joinLines(items []string) string {
+	if len(items) == 0 {
+		return "-"
+	}
+	return strings.Join(items, "\n\t")
+}
+
+func runRoutesExplain(args []string) error {
+	fs := flag.NewFlagSet("routes explain", flag.ContinueOnError)
+	var evtFlags eventFlags
+	evtFlags.register(fs)
+	output := fs.String("o", outputText, "Output format: text, json or yaml")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	evt, err := evtFlags.event(positional)
+	if err != nil {
+		return fmt.Errorf("usage: diplomatctl routes explain <channel> [body]: %v", err)
+	}
+	p, err := newOutputPrinter(*output)
+	if err != nil {
+		return err
+	}
+
+	c, err := evtFlags.connect(fmt.Sprintf("diplomatctl-routes-%d", os.Getpid()))
+	if err != nil {
+		return fmt.Errorf("unable to connect to %s: %v", evtFlags.url, err)
+	}
+	defer c.Close()
+
+	matches, err := c.ExplainRoute(*evt)
+	if err != nil {
+		return err
+	}
+	if p != nil {
+		return p.printValue(matches)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tPRIORITY\tSCORE\tREQUIRED\tMATCHED\tSELECTED")
+	var reason string
+	for _, m := range matches {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%t\t%t\n", m.ID, m.Priority, m.Score, m.Required, m.Matched, m.Selected)
+		if m.Selected {
+			reason = m.Reason
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if reason != "" {
+		fmt.Printf("\nSelected: %s\n", reason)
+	}
+	return nil
+}
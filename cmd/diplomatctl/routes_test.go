@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/mumoshu/diplomat/pkg"
+)
+
+func TestRoutes(t *testing.T) {
+	on := diplomat.OnURL(testChannel)
+	opened := on.Where("action").EqString("opened")
+	openedByUser := diplomat.AllOf(opened, on.Where("sender", "type").EqString("User"))
+
+	srv, flags, stop := startTestServer(t)
+	defer stop()
+	for _, conf := range []diplomat.RouteConfig{
+		{RouteCondition: opened, Topic: true},
+		{RouteCondition: openedByUser, Proc: true, Priority: 1},
+	} {
+		if err := srv.StartRouting(conf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	args := func(args ...string) []string {
+		return append(args, flags...)
+	}
+
+	testcases := []struct {
+		name string
+		args []string
+		// want are the lines expected in the output, with the columns separated by any spaces
+		want    []string
+		wantErr string
+	}{
+		{
+			name: "list",
+			args: args("list"),
+			want: []string{
+				"ID TOPICS PROCEDURES SESSIONS",
+				string(opened.ID()) + " " + opened.ReceiverName() + " - -",
+				string(openedByUser.ID()) + " - " + openedByUser.ReceiverName() + " -",
+			},
+		},
+		{
+			name: "describe",
+			args: args("describe", string(openedByUser.ID())),
+			want: []string{
+				"ID: " + string(openedByUser.ID()),
+				`Condition: action == "opened" && sender.type == "User"`,
+				"Priority: 1",
+				"Sessions: -",
+			},
+		},
+		{
+			// Routes without procedures have no dispatch to show
+			name: "describe topics only",
+			args: args("describe", string(opened.ID()), "-oyaml"),
+			want: []string{"---", "Condition: action == \"opened\"", "Topics:", "- " + opened.ReceiverName()},
+		},
+		{name: "describe missing", args: args("describe", string(on.Where("action").EqString("closed").ID())), wantErr: "not found"},
+		{
+			name: "explain",
+			args: args("explain", testChannel, `{"action":"opened","sender":{"type":"Bot"}}`),
+			want: []string{
+				"ID PRIORITY SCORE REQUIRED MATCHED SELECTED",
+				string(openedByUser.ID()) + " 1 1 2 false false",
+			},
+		},
+		{name: "describe without id", args: args("describe"), wantErr: "usage: diplomatctl routes describe <id>"},
+		{name: "explain without channel", args: args("explain"), wantErr: "missing channel"},
+		{name: "raw output", args: args("list", "-o", "raw"), wantErr: `unsupported output format "raw"`},
+		{name: "missing command", wantErr: "missing command"},
+		{name: "unknown command", args: []string{"remove"}, wantErr: `unknown command "remove"`},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			out, err := runCommand(runRoutes, tc.args...)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("unexpected error: want %q, got %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			lines := map[string]bool{}
+			for _, l := range strings.Split(out, "\n") {
+				lines[strings.Join(strings.Fields(l), " ")] = true
+			}
+			for _, l := range tc.want {
+				if !lines[l] {
+					t.Errorf("unexpected output: want the line %q, got:\n%s", l, out)
+				}
+			}
+		})
+	}
+
+	t.Run("explain json", func(t *testing.T) {
+		out, err := runCommand(runRoutes, args("explain", testChannel, `{"action":"opened","sender":{"type":"User"}}`, "-ojson")...)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		matches := []diplomat.RouteMatch{}
+		if err := json.Unmarshal([]byte(out), &matches); err != nil {
+			t.Fatalf("unexpected output: %v: %s", err, out)
+		}
+		// The topic only route matches too, but is never selected
+		if len(matches) != 2 {
+			t.Fatalf("unexpected matches: want 2, got %+v", matches)
+		}
+		for _, m := range matches {
+			if m.Selected != (m.ID == openedByUser.ID()) || !m.Matched {
+				t.Errorf("unexpected match: want only %s selected, got %+v", openedByUser.ID(), m)
+			}
+		}
+	})
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/mumoshu/diplomat/pkg"
+	"github.com/mumoshu/diplomat/pkg/api"
+)
+
+const outputText = "text"
+
+// headerFlags is a repeatable `-H "Name: value"` flag
+type headerFlags map[string][]string
+
+func (h headerFlags) String() string {
+	pairs := []string{}
+	for k, vs := range h {
+		for _, v := range vs {
+			pairs = append(pairs, fmt.Sprintf("%s: %s", k, v))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ", ")
+}
+
+func (h headerFlags) Set(v string) error {
+	kv := strings.SplitN(v, ":", 2)
+	if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+		return fmt.Errorf("invalid header %q: expected \"Name: value\"", v)
+	}
+	http.Header(h).Add(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]))
+	return nil
+}
+
+// eventFlags are the flags shared by the commands that send events
+type eventFlags struct {
+	serverFlags
+	file   string
+	header headerFlags
+	method string
+}
+
+func (f *eventFlags) register(fs *flag.FlagSet) {
+	f.serverFlags.register(fs)
+	f.header = headerFlags{}
+	fs.StringVar(&f.file, "f", "", "Read the body from the file. Use - to read from stdin")
+	fs.Var(f.header, "H", "Header of the event in the \"Name: value\" form. Can be repeated")
+	fs.StringVar(&f.method, "X", "", "HTTP method of the event, like GET")
+}
+
+// event builds the event from the `<channel>[?query] [body]` arguments and the flags
+func (f *eventFlags) event(positional []string) (*diplomat.Event, error) {
+	if len(positional) < 1 {
+		return nil, fmt.Errorf("missing channel")
+	}
+	if len(positional) > 2 {
+		return nil, fmt.Errorf("too many arguments: %v", positional[2:])
+	}
+	chURL, rawQuery := positional[0], ""
+	if i := strings.Index(chURL, "?"); i >= 0 {
+		chURL, rawQuery = chURL[:i], chURL[i+1:]
+	}
+	ch, err := api.ParseChannelRef(chURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var body []byte
+	switch {
+	case len(positional) == 2 && f.file != "":
+		return nil, fmt.Errorf("the body can be given either inline or with -f, but not both")
+	case len(positional) == 2:
+		body = []byte(positional[1])
+	case f.file == "-":
+		body, err = ioutil.ReadAll(os.Stdin)
+	case f.file != "":
+		body, err = ioutil.ReadFile(f.file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read body: %v", err)
+	}
+
+	return &diplomat.Event{
+		Channel:  ch.SendChannelURL(),
+		Method:   strings.ToUpper(f.method),
+		RawQuery: rawQuery,
+		Body:     body,
+		Header:   map[string][]string(f.header),
+	}, nil
+}
+
+func runCall(args []string) error {
+	fs := flag.NewFlagSet("call", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: diplomatctl call <channel> [body] [flags]\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	var evtFlags eventFlags
+	evtFlags.register(fs)
+	output := fs.String("o", outputText, "Output format: text, json, yaml or raw")
+	timeout := fs.Duration("timeout", 0, "Cancel the call when no procedure responded in the duration, like 30s. Defaults to no timeout")
+
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	evt, err := evtFlags.event(positional)
+	if err != nil {
+		fs.Usage()
+		return err
+	}
+
+	var p *printer
+	if *output != outputText {
+		p, err = newPrinter(*output, os.Stdout)
+		if err != nil {
+			return err
+		}
+	}
+
+	c, err := evtFlags.connect(fmt.Sprintf("diplomatctl-call-%d", os.Getpid()))
+	if err != nil {
+		return fmt.Errorf("unable to connect to %s: %v", evtFlags.url, err)
+	}
+	defer c.Close()
+
+	ctx := context.Background()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	out, err := c.CallEventContext(ctx, *evt)
+	if err != nil {
+		return err
+	}
+
+	if p == nil {
+		return printOutputText(os.Stdout, out)
+	}
+	if p.format == outputRaw {
+		return p.printBody(out.Body)
+	}
+	return p.printValue(outputValue(out))
+}
+
+func runPublish(args []string) error {
+	fs := flag.NewFlagSet("publish", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: diplomatctl publish <channel> [body] [flags]\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	var evtFlags eventFlags
+	evtFlags.register(fs)
+
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	evt, err := evtFlags.event(positional)
+	if err != nil {
+		fs.Usage()
+		return err
+	}
+
+	c, err := evtFlags.connect(fmt.Sprintf("diplomatctl-publish-%d", os.Getpid()))
+	if err != nil {
+		return fmt.Errorf("unable to connect to %s: %v", evtFlags.url, err)
+	}
+	defer c.Close()
+
+	return c.PublishEvent(*evt)
+}
+
+// printOutputText prints the output like a HTTP response: the status code, headers, an empty line and then the body
+func printOutputText(w io.Writer, out *diplomat.Output) error {
+	status := out.StatusCode
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if _, err := fmt.Fprintf(w, "%d %s\n", status, http.StatusText(status)); err != nil {
+		return err
+	}
+	keys := []string{}
+	for k := range out.Header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range out.Header[k] {
+			if _, err := fmt.Fprintf(w, "%s: %s\n", k, v); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := fmt.Fprintln(w); err != nil {
+		return err
+	}
+	p := &printer{format: outputRaw, w: w}
+	return p.printBody(out.Body)
+}
+
+func outputValue(out *diplomat.Output) map[string]interface{} {
+	var body interface{} = string(out.Body)
+	if v, ok := decodeJSON(out.Body); ok {
+		body = v
+	}
+	return map[string]interface{}{
+		"statusCode": out.StatusCode,
+		"header":     out.Header,
+		"body":       body,
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/mumoshu/diplomat/pkg"
+	"github.com/mumoshu/diplomat/pkg/api"
+)
+
+func runTap(args []string) error {
+	fs := flag.NewFlagSet("tap", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: diplomatctl tap <channel> [condition ...] [flags]\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	var srvFlags serverFlags
+	srvFlags.register(fs)
+	output := fs.String("o", outputJSON, "Output format: json, yaml or raw")
+
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) < 1 {
+		fs.Usage()
+		return fmt.Errorf("missing channel")
+	}
+
+	p, err := newPrinter(*output, os.Stdout)
+	if err != nil {
+		return err
+	}
+
+	ch, err := api.ParseChannelRef(positional[0])
+	if err != nil {
+		return err
+	}
+	cond, err := conditionFromArgs(ch, positional[1:])
+	if err != nil {
+		return err
+	}
+
+	c, err := srvFlags.connect(fmt.Sprintf("diplomatctl-tap-%d", os.Getpid()))
+	if err != nil {
+		return fmt.Errorf("unable to connect to %s: %v", srvFlags.url, err)
+	}
+	defer c.Close()
+
+	// Event handlers are run sequentially by the WAMP client, so printing from within the handler keeps the output in order
+	errs := make(chan error, 1)
+	if err := c.SubscribeAny(cond, func(evt interface{}) {
+		body, err := diplomat.DecodeBody(evt)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "skipping undecodable event: %v\n", err)
+			return
+		}
+		if err := p.printBody(body); err != nil {
+			select {
+			case errs <- err:
+			default:
+			}
+		}
+	}); err != nil {
+		return err
+	}
+
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, os.Interrupt)
+	defer signal.Stop(shutdown)
+
+	select {
+	case err := <-errs:
+		if stopErr := c.StopSubscription(cond); stopErr != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", stopErr)
+		}
+		return err
+	case <-shutdown:
+		return c.StopSubscription(cond)
+	case <-c.Done():
+		return fmt.Errorf("connection to %s closed by the router", srvFlags.url)
+	}
+}
+
+// conditionFromArgs builds a route condition from arguments like `foo.bar=1` or `action == "opened" || action == "reopened"`.
+// The arguments are ANDed, and unquoted values that look like integers are compared as integers, and as strings otherwise.
+func conditionFromArgs(ch api.ChannelRef, args []string) (diplomat.RouteCondition, error) {
+	if len(args) == 0 {
+		return diplomat.On(ch).All(), nil
+	}
+	exprs := []string{}
+	for _, a := range args {
+		exprs = append(exprs, "("+a+")")
+	}
+	return diplomat.On(ch).Parse(strings.Join(exprs, " && "))
+}
@@ -1,10 +1,24 @@
 package api
 
-import "fmt"
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
 
 var ChannelStartRouting ChannelRef
 var ChannelStopRouting ChannelRef
 var ChannelEcho ChannelRef
+var ChannelCall ChannelRef
+var ChannelPublish ChannelRef
+var ChannelListRoutes ChannelRef
+var ChannelDescribeRoute ChannelRef
+var ChannelExplainRoute ChannelRef
+var ChannelDeadLetter ChannelRef
+var ChannelListDeadLetters ChannelRef
+var ChannelDescribeDeadLetter ChannelRef
+var ChannelReplayDeadLetter ChannelRef
+var ChannelDeleteDeadLetter ChannelRef
 
 type Scheme string
 
@@ -23,6 +37,29 @@ func (id ChannelRef) String() string {
 	return fmt.Sprintf("%s://%s", id.Scheme, id.ChannelName)
 }
 
+// ParseChannelRef parses a send channel URL like `http://example.com/webhook/github` or `diplomat://echo`.
+// The `/channels/<scheme>/<name>` form is accepted too, so that channels can be typed in shells without a scheme.
+func ParseChannelRef(s string) (ChannelRef, error) {
+	if strings.HasPrefix(s, "/channels/") {
+		parts := strings.SplitN(strings.TrimPrefix(s, "/channels/"), "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return ChannelRef{}, fmt.Errorf("invalid channel %q: expected /channels/<scheme>/<name>", s)
+		}
+		return ChannelRef{Scheme: Scheme(parts[0]), ChannelName: parts[1]}, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return ChannelRef{}, fmt.Errorf("invalid channel %q: %v", s, err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return ChannelRef{}, fmt.Errorf("invalid channel %q: expected <scheme>://<name>", s)
+	}
+	return ChannelRef{
+		Scheme:      Scheme(u.Scheme),
+		ChannelName: fmt.Sprintf("%s%s", u.Host, u.Path),
+	}, nil
+}
+
 func init() {
 	ChannelStartRouting = ChannelRef{
 		Scheme:      SchemeDiplomat,
@@ -36,4 +73,44 @@ func init() {
 		Scheme:      SchemeDiplomat,
 		ChannelName: "echo",
 	}
+	ChannelCall = ChannelRef{
+		Scheme:      SchemeDiplomat,
+		ChannelName: "call",
+	}
+	ChannelPublish = ChannelRef{
+		Scheme:      SchemeDiplomat,
+		ChannelName: "publish",
+	}
+	ChannelListRoutes = ChannelRef{
+		Scheme:      SchemeDiplomat,
+		ChannelName: "listRoutes",
+	}
+	ChannelDescribeRoute = ChannelRef{
+		Scheme:      SchemeDiplomat,
+		ChannelName: "describeRoute",
+	}
+	ChannelExplainRoute = ChannelRef{
+		Scheme:      SchemeDiplomat,
+		ChannelName: "explainRoute",
+	}
+	ChannelDeadLetter = ChannelRef{
+		Scheme:      SchemeDiplomat,
+		ChannelName: "deadletter",
+	}
+	ChannelListDeadLetters = ChannelRef{
+		Scheme:      SchemeDiplomat,
+		ChannelName: "listDeadLetters",
+	}
+	ChannelDescribeDeadLetter = ChannelRef{
+		Scheme:      SchemeDiplomat,
+		ChannelName: "describeDeadLetter",
+	}
+	ChannelReplayDeadLetter = ChannelRef{
+		Scheme:      SchemeDiplomat,
+		ChannelName: "replayDeadLetter",
+	}
+	ChannelDeleteDeadLetter = ChannelRef{
+		Scheme:      SchemeDiplomat,
+		ChannelName: "deleteDeadLetter",
+	}
 }
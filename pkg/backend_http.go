@@ -30,7 +30,12 @@ func (w *ResponseWriter) Header() http.Header {
 }
 
 func (w *ResponseWriter) Write(body []byte) (int, error) {
-	w.Response["body"] = body
+	if w.Response == nil {
+		w.Response = map[string]interface{}{}
+	}
+	// Writers must not retain the slice, which is reused by fmt.Fprintf and the like
+	existing, _ := w.Response["body"].([]byte)
+	w.Response["body"] = append(existing, body...)
 	return len(body), nil
 }
 
@@ -74,14 +79,25 @@ func wampMessageToHttpRequest(u *url.URL, args wamp.List, kwargs wamp.Dict, deta
 	if err != nil {
 		return nil, err
 	}
+	header, err := getHttpHeader(kwargs)
+	if err != nil {
+		return nil, err
+	}
 	bodyReader := ioutil.NopCloser(bytes.NewReader(body))
+	// Events that are not HTTP requests, or that are sent by older clients, have no method
+	method, _ := kwargs["method"].(string)
+	if method == "" {
+		method = http.MethodPost
+	}
+	reqURL := *u
+	reqURL.RawQuery, _ = kwargs["query"].(string)
 	r := &http.Request{
-		Method:     http.MethodPost,
-		URL:        u,
+		Method:     method,
+		URL:        &reqURL,
 		Proto:      "http",
 		ProtoMajor: 1,
 		ProtoMinor: 1,
-		Header:     getHttpHeader(kwargs),
+		Header:     header,
 		Body:       bodyReader,
 		GetBody: func() (io.ReadCloser, error) {
 			return bodyReader, nil
@@ -0,0 +1,70 @@
+package diplomat
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+func TestWampMessageToHttpRequest(t *testing.T) {
+	backend, err := url.Parse("http://127.0.0.1:8080/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testcases := []struct {
+		name       string
+		kwargs     wamp.Dict
+		wantMethod string
+		wantURL    string
+	}{
+		{
+			name:       "method and query of the event",
+			kwargs:     eventToKwargs(Event{Channel: "http://example.com/status", Method: http.MethodGet, RawQuery: "probe=1&name=a%20b", Body: []byte("{}")}),
+			wantMethod: http.MethodGet,
+			wantURL:    "http://127.0.0.1:8080/status?probe=1&name=a%20b",
+		},
+		{
+			name:       "event without a method",
+			kwargs:     eventToKwargs(Event{Channel: "http://example.com/status", Body: []byte("{}")}),
+			wantMethod: http.MethodPost,
+			wantURL:    "http://127.0.0.1:8080/status",
+		},
+		{
+			name:       "kwargs of older clients",
+			kwargs:     wamp.Dict{"channel": "http://example.com/status", "body": []byte("{}")},
+			wantMethod: http.MethodPost,
+			wantURL:    "http://127.0.0.1:8080/status",
+		},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := wampMessageToHttpRequest(backend, nil, tc.kwargs, nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if r.Method != tc.wantMethod {
+				t.Errorf("unexpected method: want %s, got %s", tc.wantMethod, r.Method)
+			}
+			if r.URL.String() != tc.wantURL {
+				t.Errorf("unexpected url: want %s, got %s", tc.wantURL, r.URL)
+			}
+			if q := r.URL.Query(); tc.wantMethod == http.MethodGet && q.Get("name") != "a b" {
+				t.Errorf("unexpected query: want name=a b, got %v", q)
+			}
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil || string(body) != "{}" {
+				t.Errorf("unexpected body: want {}, got %q, %v", body, err)
+			}
+		})
+	}
+
+	if backend.RawQuery != "" {
+		t.Errorf("unexpected change of the backend url: %s", backend)
+	}
+}
@@ -22,7 +22,7 @@ type Client struct {
 //
 
 func (c *Client) startRouting(reg RouteConfig) error {
-	fmt.Printf("client: registering %v\n", reg)
+	log.Printf("client: registering %v", reg)
 	_, err := Call(c.Client, api.ChannelStartRouting.SendChannelURL(), reg)
 	if err != nil {
 		return fmt.Errorf("registration failed: %v", err)
@@ -31,7 +31,7 @@ func (c *Client) startRouting(reg RouteConfig) error {
 }
 
 func (c *Client) stopRouting(reg RouteConfig) error {
-	fmt.Printf("client: stopping routing %v\n", reg)
+	log.Printf("client: stopping routing %v", reg)
 	_, err := Call(c.Client, api.ChannelStopRouting.SendChannelURL(), reg)
 	if err != nil {
 		return fmt.Errorf("stopping routing failed: %v", err)
@@ -39,11 +39,46 @@ func (c *Client) stopRouting(reg RouteConfig) error {
 	return nil
 }
 
+// CallEvent sends the event to its channel via the server and returns the output of the procedure that handled it.
+// Routing errors are returned as *RouteError as Server.Call does
+func (c *Client) CallEvent(evt Event) (*Output, error) {
+	return c.CallEventContext(context.Background(), evt)
+}
+
+// CallEventContext is like CallEvent, but cancels the call when the context is done.
+// The server stops calling the procedures for the event, and the callees see their invocations interrupted
+func (c *Client) CallEventContext(ctx context.Context, evt Event) (*Output, error) {
+	res, err := c.Call(ctx, api.ChannelCall.SendChannelURL(), nil, wamp.List{}, eventToKwargs(evt), "")
+	if err != nil {
+		return nil, rpcErrorToRouteError(evt.Channel, err)
+	}
+	return kwargsToOutput(res.ArgumentsKw)
+}
+
+// PublishEvent sends the event to its channel via the server without waiting for the output
+func (c *Client) PublishEvent(evt Event) error {
+	return c.PublishEventContext(context.Background(), evt)
+}
+
+// PublishEventContext is like PublishEvent, but cancels the call when the context is done
+func (c *Client) PublishEventContext(ctx context.Context, evt Event) error {
+	if _, err := c.Call(ctx, api.ChannelPublish.SendChannelURL(), nil, wamp.List{}, eventToKwargs(evt), ""); err != nil {
+		return rpcErrorToRouteError(evt.Channel, err)
+	}
+	return nil
+}
+
 func (c *Client) StopServing(cond RouteCondition) error {
 	proc := cond.ReceiverName()
 	if err := c.Unregister(proc); err != nil {
 		return fmt.Errorf("failed to unregister %s: %v", proc, err)
 	}
+	calleeProc := calleeProcedure(proc, c.ID())
+	if _, ok := c.RegistrationID(calleeProc); ok {
+		if err := c.Unregister(calleeProc); err != nil {
+			return fmt.Errorf("failed to unregister %s: %v", calleeProc, err)
+		}
+	}
 	return c.stopRouting(RouteConfig{RouteCondition: cond, Proc: true, Topic: false})
 }
 
@@ -56,13 +91,21 @@ func (c *Client) StopSubscription(cond RouteCondition) error {
 }
 
 func (c *Client) ServeAny(cond RouteCondition, f func(in interface{}) (interface{}, error)) error {
+	return c.ServeAnyContext(cond, func(ctx context.Context, in interface{}) (interface{}, error) {
+		return f(in)
+	})
+}
+
+// ServeAnyContext is like ServeAny, but the func is given the context of the invocation,
+// which is canceled when the caller cancels the call or the server gives up on it
+func (c *Client) ServeAnyContext(cond RouteCondition, f func(ctx context.Context, in interface{}) (interface{}, error)) error {
 	if err := c.startRouting(RouteConfig{RouteCondition: cond, Proc: true, Topic: false}); err != nil {
 		return fmt.Errorf("registration failed: %v", err)
 	}
 	return c.serve(cond, f)
 }
 
-func (c *Client) serve(cond RouteCondition, f func(in interface{}) (interface{}, error)) error {
+func (c *Client) serve(cond RouteCondition, f func(ctx context.Context, in interface{}) (interface{}, error)) error {
 	cli := c.Client
 	handler := c.anyFuncToProcHandler(f)
 	ch := cond.Channel
@@ -75,10 +118,27 @@ func (c *Client) serve(cond RouteCondition, f func(in interface{}) (interface{},
 	return nil
 }
 
-func (c *Client) anyFuncToProcHandler(f func(in interface{}) (interface{}, error)) func(context.Context, wamp.List, wamp.Dict, wamp.Dict) *client.InvokeResult {
+// serveWithCaller is like serve, but the func is also given the ID of the caller's session disclosed by the router
+func (c *Client) serveWithCaller(cond RouteCondition, f func(in interface{}, caller wamp.ID) (interface{}, error)) error {
+	proc := cond.ReceiverName()
+	handler := func(ctx context.Context, args wamp.List, kwargs wamp.Dict, details wamp.Dict) *client.InvokeResult {
+		caller, _ := wamp.AsID(details["caller"])
+		return c.anyFuncToProcHandler(func(ctx context.Context, in interface{}) (interface{}, error) {
+			return f(in, caller)
+		})(ctx, args, kwargs, details)
+	}
+	if err := c.Client.Register(proc, handler, wamp.Dict{wamp.OptDiscloseCaller: true}); err != nil {
+		return fmt.Errorf("Failed to register %q: %s", cond.Channel, err)
+	}
+
+	log.Printf("Registered procedure %s for channel %s with router", proc, cond.Channel)
+	return nil
+}
+
+func (c *Client) anyFuncToProcHandler(f func(ctx context.Context, in interface{}) (interface{}, error)) func(context.Context, wamp.List, wamp.Dict, wamp.Dict) *client.InvokeResult {
 	return func(ctx context.Context, args wamp.List, kwargs wamp.Dict, details wamp.Dict) *client.InvokeResult {
 		req := args[0]
-		res, err := f(req)
+		res, err := f(ctx, req)
 		if err != nil {
 			return &client.InvokeResult{Err: wamp.ErrInvalidArgument, Kwargs: wamp.Dict{"message": fmt.Sprintf("unexpected error: %v", err)}}
 		}
@@ -99,24 +159,104 @@ func (c *Client) ServeWithProgress(cond RouteCondition, f func(evt []byte) ([]by
 		log.Fatalf("registration failed 1: %v", err)
 	}
 
-	return c.listenAndServeWithProgress(cond, f)
+	return c.listenAndServeWithProgress(cond, DispatchSingle, f)
+}
+
+// ServeWithProgressDispatch is like ServeWithProgress, but shares the route with the other callees serving it with the same dispatch, like:
+//
+//   c.ServeWithProgressDispatch(On(ch).All(), DispatchFanOut, f)
+func (c *Client) ServeWithProgressDispatch(cond RouteCondition, dispatch Dispatch, f func(evt []byte) ([]byte, error)) (<-chan struct{}, error) {
+	return c.ServeRoute(RouteConfig{RouteCondition: cond, Dispatch: dispatch}, f)
+}
+
+// ServeRoute is like ServeWithProgress, but registers the procedure with the dispatch and the priority of the config, like:
+//
+//   c.ServeRoute(RouteConfig{RouteCondition: On(ch).All(), Priority: -1}, f)
+func (c *Client) ServeRoute(reg RouteConfig, f func(evt []byte) ([]byte, error)) (<-chan struct{}, error) {
+	reg.Proc = true
+	reg.Topic = false
+	if err := c.startRouting(reg); err != nil {
+		return nil, err
+	}
+
+	done, err := c.listenAndServeWithProgress(reg.RouteCondition, reg.Dispatch, f)
+	if err != nil {
+		c.abortRouting(reg)
+		return nil, err
+	}
+	return done, nil
+}
+
+// abortRouting stops the routing started for the receiver that failed to be registered, so that the route does not keep the receiver that never came
+func (c *Client) abortRouting(reg RouteConfig) {
+	if err := c.stopRouting(reg); err != nil {
+		log.Printf("unable to stop routing to %s: %v", reg.ReceiverName(), err)
+	}
 }
 
 func (c *Client) SubscribeAny(cond RouteCondition, f func(evt interface{})) error {
 	reg := RouteConfig{RouteCondition: cond, Proc: false, Topic: true,}
 	if err := c.startRouting(reg); err != nil {
-		log.Fatalf("subscription registration failed : %v", err)
+		return fmt.Errorf("subscription registration failed: %v", err)
+	}
+
+	if err := c.subscribeAny(cond, f); err != nil {
+		c.abortRouting(reg)
+		return err
+	}
+	return nil
+}
+
+// SubscribeAnyContext is like SubscribeAny, but stops the subscription when the context is done
+func (c *Client) SubscribeAnyContext(ctx context.Context, cond RouteCondition, f func(evt interface{})) error {
+	reg := RouteConfig{RouteCondition: cond, Proc: false, Topic: true}
+	if err := c.startRouting(reg); err != nil {
+		return fmt.Errorf("subscription registration failed: %v", err)
 	}
+	if err := c.subscribeAny(cond, f); err != nil {
+		c.abortRouting(reg)
+		return err
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			if err := c.StopSubscription(cond); err != nil {
+				log.Printf("unable to stop subscription to %s: %v", cond.ReceiverName(), err)
+			}
+		case <-c.Done():
+		}
+	}()
+	return nil
+}
 
-	return c.subscribeAny(cond, f)
+// SubscribeDeadLetters calls the func with every dead letter published to the topic, or to DefaultDeadLetterTopic when the topic is empty.
+// Dead letters are replayed by sending their events again, like:
+//
+//   c.SubscribeDeadLetters("", func(dl *DeadLetter) { c.CallEvent(dl.Event) })
+func (c *Client) SubscribeDeadLetters(topic string, f func(dl *DeadLetter)) error {
+	if topic == "" {
+		topic = DefaultDeadLetterTopic
+	}
+	err := c.Client.Subscribe(topic, func(args wamp.List, kwargs wamp.Dict, details wamp.Dict) {
+		dl, err := kwargsToDeadLetter(kwargs)
+		if err != nil {
+			log.Printf("skipping undecodable dead letter: %v", err)
+			return
+		}
+		f(dl)
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("subscribing %s failed: %v", topic, err)
+	}
+	return nil
 }
 
 func (c *Client) subscribeAny(cond RouteCondition, f func(evt interface{})) error {
 	err := c.Client.Subscribe(cond.ReceiverName(), c.anyFuncToSubscriptionHandler(f), nil)
 	if err != nil {
-		return fmt.Errorf("subscription failed:", err)
+		return fmt.Errorf("subscription failed: %v", err)
 	}
-	log.Printf("%s subscribed to %s", c.ID(), cond.ReceiverName())
+	log.Printf("%v subscribed to %s", c.ID(), cond.ReceiverName())
 	return nil
 }
 
@@ -174,13 +314,13 @@ func (c *Client) subscribeHttp(uu string, cond RouteCondition, f HttpHandler) er
 	}
 	err = c.Client.Subscribe(cond.ReceiverName(), handler, nil)
 	if err != nil {
-		return fmt.Errorf("subscription failed:", err)
+		return fmt.Errorf("subscription failed: %v", err)
 	}
-	log.Printf("%s subscribed to %s", c.ID(), cond.ReceiverName())
+	log.Printf("%v subscribed to %s", c.ID(), cond.ReceiverName())
 	return nil
 }
 
-func (c *Client) listenAndServeWithProgress(cond RouteCondition, f func(evt []byte) ([]byte, error)) (<-chan struct{}, error) {
+func (c *Client) listenAndServeWithProgress(cond RouteCondition, dispatch Dispatch, f func(evt []byte) ([]byte, error)) (<-chan struct{}, error) {
 	//proc1 := srv.AddConditionalRouteToProcedure(cond)
 
 	procName := cond.ReceiverName()
@@ -224,9 +364,16 @@ func (c *Client) listenAndServeWithProgress(cond RouteCondition, f func(evt []by
 		return &client.InvokeResult{Args: results}
 	}
 
-	if err := cli.Register(procName, localCalleeHandler, make(wamp.Dict)); err != nil {
+	if err := cli.Register(procName, localCalleeHandler, dispatch.registerOptions()); err != nil {
 		return nil, fmt.Errorf("Failed to register %q: %s", procName, err)
 	}
+	if dispatch.callsEachCallee() {
+		calleeProc := calleeProcedure(procName, cli.ID())
+		if err := cli.Register(calleeProc, localCalleeHandler, make(wamp.Dict)); err != nil {
+			cli.Unregister(procName)
+			return nil, fmt.Errorf("Failed to register %q: %s", calleeProc, err)
+		}
+	}
 
 	log.Printf("Registered procedure %q with router", procName)
 	return cli.Done(), nil
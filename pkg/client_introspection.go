@@ -0,0 +1,81 @@
+package diplomat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/gammazero/nexus/wamp"
+	"github.com/mumoshu/diplomat/pkg/api"
+)
+
+func (c *Client) ListRoutes() ([]RouteInfo, error) {
+	var routes []RouteInfo
+	if err := c.introspect(api.ChannelListRoutes, wamp.Dict{}, &routes); err != nil {
+		return nil, err
+	}
+	return routes, nil
+}
+
+func (c *Client) DescribeRoute(id RouteConditionID) (*RouteInfo, error) {
+	var route RouteInfo
+	if err := c.introspect(api.ChannelDescribeRoute, wamp.Dict{"id": string(id)}, &route); err != nil {
+		return nil, err
+	}
+	return &route, nil
+}
+
+// ExplainRoute returns the routes that the event would be matched against, without sending it to any receiver
+func (c *Client) ExplainRoute(evt Event) ([]RouteMatch, error) {
+	var matches []RouteMatch
+	if err := c.introspect(api.ChannelExplainRoute, eventToKwargs(evt), &matches); err != nil {
+		return nil, err
+	}
+	return matches, nil
+}
+
+func (c *Client) introspect(ch api.ChannelRef, kwargs wamp.Dict, result interface{}) error {
+	res, err := c.Call(context.Background(), ch.SendChannelURL(), nil, wamp.List{}, kwargs, "")
+	if err != nil {
+		return fmt.Errorf("%s failed: %v", ch, err)
+	}
+	body, err := getBodyBytes(res.ArgumentsKw)
+	if err != nil {
+		return fmt.Errorf("%s failed: %v", ch, err)
+	}
+	if err := json.Unmarshal(body, result); err != nil {
+		return fmt.Errorf("%s failed: unable to decode %s: %v", ch, string(body), err)
+	}
+	return nil
+}
+
+// ListDeadLetters returns the dead letters persisted by the server, the oldest first
+func (c *Client) ListDeadLetters() ([]*DeadLetter, error) {
+	var dls []*DeadLetter
+	if err := c.introspect(api.ChannelListDeadLetters, wamp.Dict{}, &dls); err != nil {
+		return nil, err
+	}
+	return dls, nil
+}
+
+func (c *Client) DescribeDeadLetter(id string) (*DeadLetter, error) {
+	var dl DeadLetter
+	if err := c.introspect(api.ChannelDescribeDeadLetter, wamp.Dict{"id": id}, &dl); err != nil {
+		return nil, err
+	}
+	return &dl, nil
+}
+
+func (c *Client) DeleteDeadLetter(id string) error {
+	var deleted string
+	return c.introspect(api.ChannelDeleteDeadLetter, wamp.Dict{"id": id}, &deleted)
+}
+
+// ReplayDeadLetter sends the event of the dead letter again via the server, and returns the output as CallEvent does
+func (c *Client) ReplayDeadLetter(id string) (*Output, error) {
+	res, err := c.Call(context.Background(), api.ChannelReplayDeadLetter.SendChannelURL(), nil, wamp.List{}, wamp.Dict{"id": id}, "")
+	if err != nil {
+		return nil, rpcErrorToRouteError(api.ChannelReplayDeadLetter.SendChannelURL(), err)
+	}
+	return kwargsToOutput(res.ArgumentsKw)
+}
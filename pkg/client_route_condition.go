@@ -3,13 +3,22 @@ package diplomat
 import (
 	"fmt"
 	"github.com/mumoshu/diplomat/pkg/api"
+	"net/http"
 	"net/url"
+	"regexp"
 )
 
 type CondBuilder struct {
 	Channel api.ChannelRef
+	Source  Source
 	Path    []string
 	ParameterName string
+	BodyFormat    BodyFormat
+
+	// Expressions are the expressions built so far, which the next expression is ANDed with
+	Expressions []Expr
+	// Bool is the boolean expression of the condition that And was called on
+	Bool *BoolExpr
 }
 
 func On(ch api.ChannelRef) CondBuilder {
@@ -36,43 +45,179 @@ func (b CondBuilder) Parameter(name string) CondBuilder {
 	return b
 }
 
+// Format makes the condition decode bodies in the format regardless of their Content-Type, like:
+//
+//   On(ch).Format(FormatXML).Where("alert", "@severity").EqString("critical")
+func (b CondBuilder) Format(format BodyFormat) CondBuilder {
+	b.BodyFormat = format
+	return b
+}
+
 func (b CondBuilder) All() RouteCondition {
 	c := RouteCondition{
 		Channel: b.Channel,
 		FormParameterName: b.ParameterName,
+		BodyFormat: b.BodyFormat,
+	}
+	if len(b.Expressions) > 0 || b.Bool != nil {
+		c.Expressions = append([]Expr{}, b.Expressions...)
+		c.Bool = b.Bool
+	} else {
+		c.Expressions = []Expr{{Path: b.Path, All: true}}
 	}
-	c.Expressions = []Expr{{Path: b.Path, All: true}}
 	return c
 }
 
+// Fallback is the condition of the channel's fallback route, which receives the events that matched no other route on the channel,
+// including the routes on form parameters and body formats. Its ID is the channel URL followed by `?fallback`.
+// The expressions, the parameter and the format built so far are ignored, so that the channel has only one fallback route.
+// Register it for the channel's default procedure or topic, like:
+//
+//   c.ServeWithProgress(On(ch).Fallback(), f)
+func (b CondBuilder) Fallback() RouteCondition {
+	return RouteCondition{
+		Channel:  b.Channel,
+		Fallback: true,
+	}
+}
+
+// Where starts building an expression on the value at the path of the body.
+// The path elements can be array indices like `[0]`, `[*]` for any element and `**` for any descendant, like:
+//
+//   On(ch).Where("pull_request", "labels", PathAnyElement, "name").EqString("bug")
 func (b CondBuilder) Where(path ...string) CondBuilder {
+	b.Source = SourceBody
 	b.Path = path
 	return b
 }
 
-func (b CondBuilder) EqInt(v int) RouteCondition {
-	c := RouteCondition{
-		Channel: b.Channel,
-		FormParameterName: b.ParameterName,
-	}
-	if b.Path != nil {
-		c.Expressions = []Expr{{Path: b.Path, Int: &v}}
-	} else {
-		c.Expressions = []Expr{}
+// WherePath is Where with the path written in one string, like `pull_request.labels[*].name`
+func (b CondBuilder) WherePath(path string) CondBuilder {
+	elems, err := ParsePath(path)
+	if err != nil {
+		panic(err)
 	}
-	return c
+	return b.Where(elems...)
+}
+
+// Header starts building an expression on the first value of the header, like:
+//
+//   On(ch).Header("X-GitHub-Event").EqString("push")
+func (b CondBuilder) Header(name string) CondBuilder {
+	b.Source = SourceHeader
+	b.Path = []string{http.CanonicalHeaderKey(name)}
+	return b
+}
+
+// Query starts building an expression on the first value of the query parameter, like:
+//
+//   On(ch).Query("probe").EqInt(1)
+func (b CondBuilder) Query(name string) CondBuilder {
+	b.Source = SourceQuery
+	b.Path = []string{name}
+	return b
+}
+
+// Method starts building an expression on the HTTP method, like:
+//
+//   On(ch).Method().EqString(http.MethodGet)
+func (b CondBuilder) Method() CondBuilder {
+	b.Source = SourceMethod
+	b.Path = []string{}
+	return b
+}
+
+func (b CondBuilder) EqInt(v int) RouteCondition {
+	return b.cond(Expr{Int: &v})
 }
 
 func (b CondBuilder) EqString(s string) RouteCondition {
+	return b.cond(Expr{String: &s})
+}
+
+func (b CondBuilder) NeInt(v int) RouteCondition {
+	return b.cond(Expr{Op: OpNe, Int: &v})
+}
+
+func (b CondBuilder) NeString(s string) RouteCondition {
+	return b.cond(Expr{Op: OpNe, String: &s})
+}
+
+func (b CondBuilder) Gt(v int) RouteCondition {
+	return b.cond(Expr{Op: OpGt, Int: &v})
+}
+
+func (b CondBuilder) Ge(v int) RouteCondition {
+	return b.cond(Expr{Op: OpGe, Int: &v})
+}
+
+func (b CondBuilder) Lt(v int) RouteCondition {
+	return b.cond(Expr{Op: OpLt, Int: &v})
+}
+
+func (b CondBuilder) Le(v int) RouteCondition {
+	return b.cond(Expr{Op: OpLe, Int: &v})
+}
+
+// InString matches when the value at the path is any of the strings
+func (b CondBuilder) InString(ss ...string) RouteCondition {
+	return b.cond(Expr{Op: OpIn, Strings: ss})
+}
+
+// InInt matches when the value at the path is any of the integers
+func (b CondBuilder) InInt(vs ...int) RouteCondition {
+	return b.cond(Expr{Op: OpIn, Ints: vs})
+}
+
+func (b CondBuilder) Prefix(prefix string) RouteCondition {
+	return b.cond(Expr{Op: OpPrefix, String: &prefix})
+}
+
+// Regex matches when the string at the path matches the regular expression.
+// It panics when the pattern is not a valid regular expression.
+func (b CondBuilder) Regex(pattern string) RouteCondition {
+	regexp.MustCompile(pattern)
+	return b.cond(Expr{Op: OpRegex, String: &pattern})
+}
+
+// Exists matches when the path exists in the body, regardless of its value
+func (b CondBuilder) Exists() RouteCondition {
+	return b.cond(Expr{Op: OpExists})
+}
+
+func (b CondBuilder) cond(e Expr) RouteCondition {
 	c := RouteCondition{
-		Channel: b.Channel,
+		Channel:           b.Channel,
 		FormParameterName: b.ParameterName,
+		BodyFormat:        b.BodyFormat,
 	}
+	c.Expressions = append([]Expr{}, b.Expressions...)
+	c.Bool = b.Bool
 	if b.Path != nil {
-		c.Expressions = []Expr{{Path: b.Path, String: &s}}
-	} else {
-		c.Expressions = []Expr{}
+		e.Source = b.Source
+		e.Path = b.Path
+		c.Expressions = append(c.Expressions, e)
 	}
 	return c
 }
 
+// And starts building another expression that is required to match in addition to the condition's expressions, like:
+//
+//   On(ch).Where("repository", "full_name").EqString("mumoshu/diplomat").And("action").EqString("opened")
+func (m RouteCondition) And(path ...string) CondBuilder {
+	exprs := []Expr{}
+	for _, e := range m.Expressions {
+		// Matching all the events AND something is the same as matching the something
+		if !e.All {
+			exprs = append(exprs, e)
+		}
+	}
+	return CondBuilder{
+		Channel:       m.Channel,
+		Path:          path,
+		ParameterName: m.FormParameterName,
+		BodyFormat:    m.BodyFormat,
+		Expressions:   exprs,
+		Bool:          m.Bool,
+	}
+}
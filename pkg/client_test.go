@@ -0,0 +1,42 @@
+package diplomat
+
+import (
+	"testing"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+func TestServeRouteStopsRoutingOnRegistrationFailure(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.nxr.Close()
+	if err := srv.startRegistrationServer(); err != nil {
+		t.Fatal(err)
+	}
+
+	cond := OnURL(testChannel).Where("action").EqString("opened")
+	serve := func(name string) (*Client, error) {
+		c, err := srv.Connect(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = c.ServeRoute(RouteConfig{RouteCondition: cond}, func(evt []byte) ([]byte, error) { return evt, nil })
+		return c, err
+	}
+
+	first, err := serve("first")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer first.Close()
+	// The procedure is already registered by the first callee without a shared dispatch, so the router rejects the second one
+	second, err := serve("second")
+	if err == nil {
+		t.Fatal("unexpected success of the second callee")
+	}
+	defer second.Close()
+
+	r := srv.GetRoute(cond.ID())
+	if r == nil || len(r.Procedures) != 1 || !sessionsEq(r.ProcedureSessions, []wamp.ID{first.ID()}) {
+		t.Errorf("unexpected route: want only the procedure of session %v, got %+v", first.ID(), r)
+	}
+}
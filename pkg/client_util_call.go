@@ -13,15 +13,20 @@ import (
 )
 
 func ProgressiveCall(caller *client.Client, procedureName string, evt Event, chunkSize int) (*Output, error) {
+	return ProgressiveCallContext(context.Background(), caller, procedureName, evt, chunkSize)
+}
+
+// ProgressiveCallContext is like ProgressiveCall, but cancels the call when the context is done
+func ProgressiveCallContext(ctx context.Context, caller *client.Client, procedureName string, evt Event, chunkSize int) (*Output, error) {
 	kwargs := eventToKwargs(evt)
-	res, err := progressiveCall(caller, procedureName, kwargs, chunkSize)
+	res, err := progressiveCall(ctx, caller, procedureName, kwargs, chunkSize)
 	if err != nil {
-		return nil, fmt.Errorf("progressive call failed: %v", err)
+		return nil, wrapError(err, "progressive call failed")
 	}
 	return kwargsToOutput(res.ArgumentsKw)
 }
 
-func progressiveCall(caller *client.Client, procedureName string, kwargs wamp.Dict, chunkSize int) (*wamp.Result, error) {
+func progressiveCall(ctx context.Context, caller *client.Client, procedureName string, kwargs wamp.Dict, chunkSize int) (*wamp.Result, error) {
 	// The progress handler accumulates the chunks of data as they arrive.  It
 	// also progressively calculates a sha256 hash of the data as it arrives.
 	var chunks []string
@@ -35,14 +40,12 @@ func progressiveCall(caller *client.Client, procedureName string, kwargs wamp.Di
 		h.Write([]byte(chunk))
 	}
 
-	ctx := context.Background()
-
 	// Call the example procedure, specifying the size of chunks to send as
 	// progressive results.
 	result, err := caller.CallProgress(
 		ctx, procedureName, nil, wamp.List{chunkSize}, kwargs, "", progHandler)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to call procedure:", err)
+		return nil, wrapError(err, "Failed to call procedure")
 	}
 
 	var res []byte
@@ -55,7 +58,7 @@ func progressiveCall(caller *client.Client, procedureName string, kwargs wamp.Di
 		log.Printf("Received hashB64: %s", hashB64)
 		calleeHash, err := base64.StdEncoding.DecodeString(hashB64)
 		if err != nil {
-			return nil, fmt.Errorf("decode error:", err)
+			return nil, fmt.Errorf("decode error: %v", err)
 		}
 		// Check if received hash matches the hash computed over the received data.
 		if !bytes.Equal(calleeHash, h.Sum(nil)) {
@@ -83,18 +86,21 @@ func progressiveCall(caller *client.Client, procedureName string, kwargs wamp.Di
 }
 
 func Call(caller *client.Client, procedure string, evt interface{}) (interface{}, error) {
-	return call(caller, procedure, evt)
+	return call(context.Background(), caller, procedure, evt)
 }
 
-func call(caller *client.Client, procedureName string, evt interface{}) (interface{}, error) {
-	ctx := context.Background()
+// CallContext is like Call, but cancels the call when the context is done
+func CallContext(ctx context.Context, caller *client.Client, procedure string, evt interface{}) (interface{}, error) {
+	return call(ctx, caller, procedure, evt)
+}
 
+func call(ctx context.Context, caller *client.Client, procedureName string, evt interface{}) (interface{}, error) {
 	// Call the example procedure, specifying the size of chunks to send as
 	// progressive results.
 	result, err := caller.Call(
 		ctx, procedureName, nil, wamp.List{evt}, wamp.Dict{}, "")
 	if err != nil {
-		return nil, fmt.Errorf("Failed to call procedure: %v", err)
+		return nil, wrapError(err, "Failed to call procedure")
 	}
 
 	return result.Arguments[0], nil
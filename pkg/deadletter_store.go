@@ -0,0 +1,86 @@
+package diplomat
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+)
+
+// DeadLetterStore persists the events that failed to be delivered to any procedure, so that they can be inspected and replayed later
+type DeadLetterStore interface {
+	// List returns all the dead letters, the oldest first
+	List() ([]*DeadLetter, error)
+	// Get returns the dead letter, or an error when it is missing
+	Get(id string) (*DeadLetter, error)
+	// Save persists the dead letter, replacing the one with the same ID
+	Save(dl *DeadLetter) error
+	// Delete removes the dead letter. Deleting a missing dead letter is not an error
+	Delete(id string) error
+}
+
+var deadLettersBucket = []byte("deadletters")
+
+// BoltDeadLetterStore is the DeadLetterStore sharing the BoltDB file of a BoltRouteStore, whose keys are dead letter IDs and values are dead letters in JSON
+type BoltDeadLetterStore struct {
+	db *bolt.DB
+}
+
+// DeadLetters returns the dead-letter store in the same file as the routes, which is closed along with the route store
+func (s *BoltRouteStore) DeadLetters() *BoltDeadLetterStore {
+	return &BoltDeadLetterStore{db: s.db}
+}
+
+func (s *BoltDeadLetterStore) List() ([]*DeadLetter, error) {
+	dls := []*DeadLetter{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		// IDs are sorted in the order they were generated
+		return tx.Bucket(deadLettersBucket).ForEach(func(k, v []byte) error {
+			dl := &DeadLetter{}
+			if err := json.Unmarshal(v, dl); err != nil {
+				return fmt.Errorf("unable to decode dead letter %s: %v", k, err)
+			}
+			dls = append(dls, dl)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dls, nil
+}
+
+func (s *BoltDeadLetterStore) Get(id string) (*DeadLetter, error) {
+	var dl *DeadLetter
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(deadLettersBucket).Get([]byte(id))
+		if v == nil {
+			return fmt.Errorf("dead letter not found: %s", id)
+		}
+		dl = &DeadLetter{}
+		if err := json.Unmarshal(v, dl); err != nil {
+			return fmt.Errorf("unable to decode dead letter %s: %v", id, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dl, nil
+}
+
+func (s *BoltDeadLetterStore) Save(dl *DeadLetter) error {
+	data, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(deadLettersBucket).Put([]byte(dl.ID), data)
+	})
+}
+
+func (s *BoltDeadLetterStore) Delete(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(deadLettersBucket).Delete([]byte(id))
+	})
+}
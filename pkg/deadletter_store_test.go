@@ -0,0 +1,111 @@
+package diplomat
+
+import (
+	"testing"
+)
+
+func TestBoltDeadLetterStore(t *testing.T) {
+	newDeadLetters := func(n int) []*DeadLetter {
+		dls := []*DeadLetter{}
+		for i := 0; i < n; i++ {
+			dls = append(dls, newDeadLetter(jsonEvent(`{"action":"opened"}`), &RouteError{Kind: ErrCalleeFailed, Route: "foo", Attempts: i + 1}))
+		}
+		return dls
+	}
+	ids := func(dls []*DeadLetter) []string {
+		ids := []string{}
+		for _, dl := range dls {
+			ids = append(ids, dl.ID)
+		}
+		return ids
+	}
+
+	t.Run("list the oldest first", func(t *testing.T) {
+		store, remove := newTestDeadLetterStore(t)
+		defer remove()
+		dls := newDeadLetters(3)
+		// Saved the newest first, but listed in the order the IDs were generated
+		for i := len(dls) - 1; i >= 0; i-- {
+			if err := store.Save(dls[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got, err := store.List()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if want := ids(dls); !stringsEq(ids(got), want) {
+			t.Errorf("unexpected dead letters: want %v, got %v", want, ids(got))
+		}
+	})
+
+	t.Run("list nothing", func(t *testing.T) {
+		store, remove := newTestDeadLetterStore(t)
+		defer remove()
+		got, err := store.List()
+		if err != nil || len(got) != 0 {
+			t.Errorf("unexpected result: want no dead letters, got %v and error %v", got, err)
+		}
+	})
+
+	t.Run("get missing", func(t *testing.T) {
+		store, remove := newTestDeadLetterStore(t)
+		defer remove()
+		if err := store.Save(newDeadLetters(1)[0]); err != nil {
+			t.Fatal(err)
+		}
+		if dl, err := store.Get("missing"); err == nil {
+			t.Errorf("unexpected success: got %+v", dl)
+		}
+	})
+
+	t.Run("save replacing", func(t *testing.T) {
+		store, remove := newTestDeadLetterStore(t)
+		defer remove()
+		dl := newDeadLetters(1)[0]
+		if err := store.Save(dl); err != nil {
+			t.Fatal(err)
+		}
+		dl.failed(&RouteError{Kind: ErrCanceled, Route: "bar", Attempts: 2})
+		if err := store.Save(dl); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		got, err := store.Get(dl.ID)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got.Reason != "diplomat.error.canceled" || got.Route != "bar" || got.Attempts != 3 || !got.FailedAt.Equal(dl.FailedAt) {
+			t.Errorf("unexpected dead letter: want %+v, got %+v", dl, got)
+		}
+		if all, err := store.List(); err != nil || len(all) != 1 {
+			t.Errorf("unexpected dead letters: want 1, got %v and error %v", all, err)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		store, remove := newTestDeadLetterStore(t)
+		defer remove()
+		dls := newDeadLetters(2)
+		for _, dl := range dls {
+			if err := store.Save(dl); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := store.Delete(dls[0].ID); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if dl, err := store.Get(dls[0].ID); err == nil {
+			t.Errorf("unexpected dead letter after the deletion: %+v", dl)
+		}
+		got, err := store.List()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if want := ids(dls[1:]); !stringsEq(ids(got), want) {
+			t.Errorf("unexpected dead letters: want %v, got %v", want, ids(got))
+		}
+		if err := store.Delete(dls[0].ID); err != nil {
+			t.Errorf("unexpected error deleting the missing dead letter: %v", err)
+		}
+	})
+}
@@ -0,0 +1,211 @@
+package diplomat
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gammazero/nexus/client"
+	"github.com/gammazero/nexus/wamp"
+)
+
+// The kinds of the errors returned by Server.Call and Server.Publish.
+// Use ErrorKind to tell which kind an error is, like:
+//
+//   if ErrorKind(err) == ErrNoRoute { ... }
+var (
+	// ErrInvalidEvent is returned when the event is unable to be read or its body is unable to be decoded for routing
+	ErrInvalidEvent = errors.New("invalid event")
+	// ErrNoRoute is returned when no route on the channel matched the event
+	ErrNoRoute = errors.New("no route matched")
+	// ErrPartialMatch is returned when no route matched the event, but some matched only some of their expressions
+	ErrPartialMatch = errors.New("routes matched only partially")
+	// ErrAmbiguousRoute is returned when the event matched a route with more than one procedure to call
+	ErrAmbiguousRoute = errors.New("ambiguous route")
+	// ErrCalleeFailed is returned when every procedure of the matched routes failed to handle the event
+	ErrCalleeFailed = errors.New("callee failed")
+	// ErrPublishFailed is returned when the event is unable to be published to the router
+	ErrPublishFailed = errors.New("publish failed")
+	// ErrCanceled is returned when the context of the call was done before any procedure handled the event
+	ErrCanceled = errors.New("call canceled")
+	// ErrQueueFull is returned when the event is unable to be queued for the procedures as the queue is full
+	ErrQueueFull = errors.New("queue full")
+	// ErrChannelBusy is returned when the queue is full and the channel of the event is at its own concurrency limit
+	ErrChannelBusy = errors.New("channel busy")
+	// ErrRateLimited is returned when the event exceeded the rate limit of its channel or route
+	ErrRateLimited = errors.New("rate limited")
+)
+
+var errorKinds = []error{ErrInvalidEvent, ErrNoRoute, ErrPartialMatch, ErrAmbiguousRoute, ErrCalleeFailed, ErrPublishFailed, ErrCanceled, ErrQueueFull, ErrChannelBusy, ErrRateLimited}
+
+// RouteError is the error of routing or delivering an event to a channel
+type RouteError struct {
+	// Kind is one of the ErrXXX variables
+	Kind    error
+	Channel string
+	// Route is the route being delivered to, which is empty when the error is not specific to a route
+	Route RouteConditionID
+	// Err is the cause of the error, if any
+	Err error
+	// Attempts is the number of the procedure calls made before the error, which is 0 when no procedure was called
+	Attempts int
+}
+
+func (e *RouteError) Error() string {
+	msg := fmt.Sprintf("%s: %v", e.Channel, e.Kind)
+	if e.Route != "" {
+		msg = fmt.Sprintf("%s: route %s", msg, e.Route)
+	}
+	if e.Err != nil {
+		msg = fmt.Sprintf("%s: %v", msg, e.Err)
+	}
+	return msg
+}
+
+func (e *RouteError) Unwrap() error {
+	return e.Kind
+}
+
+// ErrorKind returns the kind of the routing error, or nil when err is not a routing error
+func ErrorKind(err error) error {
+	if e, ok := err.(*RouteError); ok {
+		return e.Kind
+	}
+	return nil
+}
+
+// StatusCode returns the HTTP status code that the gateway responds with on the error
+func StatusCode(err error) int {
+	switch ErrorKind(err) {
+	case ErrInvalidEvent:
+		return http.StatusBadRequest
+	case ErrNoRoute:
+		return http.StatusNotFound
+	case ErrPartialMatch:
+		return http.StatusUnprocessableEntity
+	case ErrAmbiguousRoute:
+		return http.StatusConflict
+	case ErrCalleeFailed:
+		return http.StatusBadGateway
+	case ErrPublishFailed:
+		return http.StatusServiceUnavailable
+	case ErrCanceled:
+		return http.StatusGatewayTimeout
+	case ErrQueueFull:
+		return http.StatusServiceUnavailable
+	case ErrChannelBusy, ErrRateLimited:
+		return http.StatusTooManyRequests
+	}
+	return http.StatusInternalServerError
+}
+
+// errorURI returns the WAMP error URI that the event server returns on the error, like `diplomat.error.no_route`
+func errorURI(err error) wamp.URI {
+	switch ErrorKind(err) {
+	case ErrInvalidEvent:
+		// The same as the event server responds with on events sent with unexpected kwargs
+		return wamp.ErrInvalidArgument
+	case ErrNoRoute:
+		return "diplomat.error.no_route"
+	case ErrPartialMatch:
+		return "diplomat.error.partial_match"
+	case ErrAmbiguousRoute:
+		return "diplomat.error.ambiguous_route"
+	case ErrCalleeFailed:
+		return "diplomat.error.callee_failed"
+	case ErrPublishFailed:
+		return "diplomat.error.publish_failed"
+	case ErrCanceled:
+		return "diplomat.error.canceled"
+	case ErrQueueFull:
+		return "diplomat.error.queue_full"
+	case ErrChannelBusy:
+		return "diplomat.error.channel_busy"
+	case ErrRateLimited:
+		return "diplomat.error.rate_limited"
+	}
+	return wamp.ErrInvalidArgument
+}
+
+func errorToInvokeResult(err error) *client.InvokeResult {
+	kwargs := wamp.Dict{"message": err.Error()}
+	if e, ok := err.(*RouteError); ok {
+		kwargs["channel"] = e.Channel
+		kwargs["route"] = string(e.Route)
+		kwargs["attempts"] = e.Attempts
+		if e.Err != nil {
+			kwargs["cause"] = e.Err.Error()
+		}
+	}
+	return &client.InvokeResult{Err: errorURI(err), Kwargs: kwargs}
+}
+
+// wrappedError annotates an error with a message, keeping the error so that the WAMP error of a failed call can be told after it is wrapped
+type wrappedError struct {
+	msg string
+	err error
+}
+
+func wrapError(err error, format string, args ...interface{}) error {
+	return &wrappedError{msg: fmt.Sprintf(format, args...), err: err}
+}
+
+func (e *wrappedError) Error() string {
+	return fmt.Sprintf("%s: %v", e.msg, e.err)
+}
+
+func (e *wrappedError) Unwrap() error {
+	return e.err
+}
+
+// wampErrorURI returns the URI of the WAMP error that caused the error, or an empty URI when the router returned no error
+func wampErrorURI(err error) wamp.URI {
+	for err != nil {
+		if rpcErr, ok := err.(client.RPCError); ok && rpcErr.Err != nil {
+			return rpcErr.Err.Error
+		}
+		u, ok := err.(interface{ Unwrap() error })
+		if !ok {
+			return ""
+		}
+		err = u.Unwrap()
+	}
+	return ""
+}
+
+// rpcErrorToRouteError turns the error returned by the event server back into the routing error, so that
+// remote clients can tell the kind of the error as the server does. The channel is used when the error does not tell its channel.
+// Calls that the caller canceled before the server responded are ErrCanceled
+func rpcErrorToRouteError(channel string, err error) error {
+	rpcErr, ok := err.(client.RPCError)
+	if !ok || rpcErr.Err == nil {
+		return err
+	}
+	if rpcErr.Err.Error == wamp.ErrCanceled {
+		// The caller canceled the call before the server responded
+		return &RouteError{Kind: ErrCanceled, Channel: channel, Err: err}
+	}
+	if _, ok := rpcErr.Err.ArgumentsKw["channel"]; rpcErr.Err.Error == wamp.ErrInvalidArgument && !ok {
+		// Invalid arguments other than events, like a missing dead letter ID, are not routing errors
+		return err
+	}
+	for _, kind := range errorKinds {
+		if errorURI(&RouteError{Kind: kind}) == rpcErr.Err.Error {
+			e := &RouteError{Kind: kind, Channel: channel}
+			if ch, ok := wamp.AsString(rpcErr.Err.ArgumentsKw["channel"]); ok && ch != "" {
+				e.Channel = ch
+			}
+			if route, ok := wamp.AsString(rpcErr.Err.ArgumentsKw["route"]); ok {
+				e.Route = RouteConditionID(route)
+			}
+			if attempts, ok := wamp.AsInt64(rpcErr.Err.ArgumentsKw["attempts"]); ok {
+				e.Attempts = int(attempts)
+			}
+			if cause, ok := wamp.AsString(rpcErr.Err.ArgumentsKw["cause"]); ok {
+				e.Err = errors.New(cause)
+			}
+			return e
+		}
+	}
+	return err
+}
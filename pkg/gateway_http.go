@@ -2,7 +2,7 @@ package diplomat
 
 import (
 	"bytes"
-	"fmt"
+	"encoding/json"
 	"log"
 	"net/http"
 	"strings"
@@ -13,8 +13,8 @@ func (srv *Server) CreateHttpHandler() func(http.ResponseWriter, *http.Request)
 		bufbody := new(bytes.Buffer)
 		_, err := bufbody.ReadFrom(r.Body)
 		if err != nil {
-			log.Fatalf("unable to read body: %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
+			log.Printf("http handler failed: unable to read body: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
 		httpReqBody := bufbody.Bytes()
@@ -26,10 +26,32 @@ func (srv *Server) CreateHttpHandler() func(http.ResponseWriter, *http.Request)
 		header := map[string][]string(r.Header)
 		url := "http://" + r.Host + r.URL.Path
 		log.Printf("processing request to %s", url)
-		res, err := srv.Call(Event{Channel: url, Body: httpReqBody, Header: header})
+		evt := Event{Channel: url, Method: r.Method, RawQuery: r.URL.RawQuery, Body: httpReqBody, Header: header}
+		// Events of async routes are under the concurrency limits until they are delivered in the background
+		release, err := srv.limiter.acquire(r.Context(), evt.Channel)
 		if err != nil {
 			log.Printf("http handler failed: %v", err)
-			w.WriteHeader(http.StatusBadRequest)
+			writeError(w, err)
+			return
+		}
+		if route := srv.asyncRoute(evt); route != nil {
+			d, err := srv.enqueueDelivery(evt, route, release)
+			if err != nil {
+				release()
+				log.Printf("http handler failed: %v", err)
+				writeError(w, err)
+				return
+			}
+			log.Printf("acknowledged delivery %s to %s", d.ID, route.ID())
+			writeAccepted(w, d)
+			return
+		}
+		// The calls to the procedures are canceled when the client goes away
+		res, err := srv.CallContext(r.Context(), evt)
+		release()
+		if err != nil {
+			log.Printf("http handler failed: %v", err)
+			writeError(w, err)
 			return
 		}
 		log.Printf("call finished. response: header=%v body=%s", res.Header, string(res.Body))
@@ -42,10 +64,28 @@ func (srv *Server) CreateHttpHandler() func(http.ResponseWriter, *http.Request)
 		if res.StatusCode != 0 {
 			w.WriteHeader(res.StatusCode)
 		}
-		_, err = w.Write(res.Body)
-		if err != nil {
-			panic(fmt.Errorf("unable to write: %v", err))
+		if _, err := w.Write(res.Body); err != nil {
+			log.Printf("http handler failed: unable to write response: %v", err)
 		}
 	}
 }
 
+
+// writeError responds with the status code of the routing error and its message in JSON, like `{"message":"..."}`
+func writeError(w http.ResponseWriter, err error) {
+	writeJSON(w, StatusCode(err), map[string]string{"message": err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("http handler failed: unable to encode response: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err := w.Write(body); err != nil {
+		log.Printf("http handler failed: unable to write response: %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+package diplomat
+
+import (
+	"context"
+	"expvar"
+	"sync"
+)
+
+// DefaultMaxQueuedCalls is the number of the events waiting for the concurrency limits at most when Server.MaxQueuedCalls is negative
+const DefaultMaxQueuedCalls = 100
+
+var (
+	// gatewayQueueDepth is the number of the events waiting for the concurrency limits of the HTTP gateway
+	gatewayQueueDepth = new(expvar.Int)
+	// gatewayInFlight is the number of the events being delivered by the HTTP gateway under the concurrency limits
+	gatewayInFlight = new(expvar.Int)
+)
+
+func init() {
+	metrics.Set("gateway_queue_depth", gatewayQueueDepth)
+	metrics.Set("gateway_in_flight", gatewayInFlight)
+}
+
+// callLimiter bounds the events that the HTTP gateway delivers at once, globally and by channel.
+// Events exceeding the limits wait in a bounded queue, and are rejected once the queue is full.
+type callLimiter struct {
+	// global and channels are semaphores, which are nil when there is no limit
+	global   chan struct{}
+	channels map[string]chan struct{}
+
+	maxQueued int
+
+	mu     sync.Mutex
+	queued int
+}
+
+func newCallLimiter(global int, channels map[string]int, maxQueued int) *callLimiter {
+	l := &callLimiter{channels: map[string]chan struct{}{}, maxQueued: maxQueued}
+	if global > 0 {
+		l.global = make(chan struct{}, global)
+	}
+	for ch, n := range channels {
+		if n > 0 {
+			l.channels[ch] = make(chan struct{}, n)
+		}
+	}
+	return l
+}
+
+// acquire waits until the event of the channel is allowed to be delivered, and returns the func to call once it is delivered.
+// It fails with ErrChannelBusy when the queue is full and the channel is at its own limit, with ErrQueueFull when the queue is full otherwise,
+// and with ErrCanceled when the context is done while waiting.
+func (l *callLimiter) acquire(ctx context.Context, channel string) (func(), error) {
+	chSem := l.channels[channel]
+	if release, ok := l.tryAcquire(chSem); ok {
+		return release, nil
+	}
+
+	l.mu.Lock()
+	if l.queued >= l.maxQueued {
+		l.mu.Unlock()
+		metrics.Add("gateway_rejected", 1)
+		if chSem != nil && len(chSem) == cap(chSem) {
+			return nil, &RouteError{Kind: ErrChannelBusy, Channel: channel}
+		}
+		return nil, &RouteError{Kind: ErrQueueFull, Channel: channel}
+	}
+	l.queued++
+	gatewayQueueDepth.Add(1)
+	l.mu.Unlock()
+	defer func() {
+		l.mu.Lock()
+		l.queued--
+		gatewayQueueDepth.Add(-1)
+		l.mu.Unlock()
+	}()
+
+	if chSem != nil {
+		select {
+		case chSem <- struct{}{}:
+		case <-ctx.Done():
+			return nil, &RouteError{Kind: ErrCanceled, Channel: channel, Err: ctx.Err()}
+		}
+	}
+	if l.global != nil {
+		select {
+		case l.global <- struct{}{}:
+		case <-ctx.Done():
+			release(chSem)
+			return nil, &RouteError{Kind: ErrCanceled, Channel: channel, Err: ctx.Err()}
+		}
+	}
+	gatewayInFlight.Add(1)
+	return l.releaser(chSem), nil
+}
+
+// tryAcquire acquires both the channel and the global limits without waiting, so that events of idle channels never wait behind busy ones
+func (l *callLimiter) tryAcquire(chSem chan struct{}) (func(), bool) {
+	if chSem != nil {
+		select {
+		case chSem <- struct{}{}:
+		default:
+			return nil, false
+		}
+	}
+	if l.global != nil {
+		select {
+		case l.global <- struct{}{}:
+		default:
+			release(chSem)
+			return nil, false
+		}
+	}
+	gatewayInFlight.Add(1)
+	return l.releaser(chSem), true
+}
+
+func (l *callLimiter) releaser(chSem chan struct{}) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			gatewayInFlight.Add(-1)
+			release(l.global)
+			release(chSem)
+		})
+	}
+}
+
+func release(sem chan struct{}) {
+	if sem != nil {
+		<-sem
+	}
+}
@@ -0,0 +1,118 @@
+package diplomat
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCallLimiterRejectsOnceSaturated(t *testing.T) {
+	testcases := []struct {
+		name      string
+		maxQueued int
+	}{
+		{name: "no queue", maxQueued: 0},
+		{name: "full queue", maxQueued: 1},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			l := newCallLimiter(2, map[string]int{"busy": 1}, tc.maxQueued)
+			for _, ch := range []string{"busy", "idle"} {
+				release, err := l.acquire(context.Background(), ch)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				defer release()
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			for n := 0; n < tc.maxQueued; n++ {
+				go l.acquire(ctx, "queued")
+			}
+			waitQueued(t, l, tc.maxQueued)
+
+			if _, err := l.acquire(context.Background(), "busy"); StatusCode(err) != http.StatusTooManyRequests {
+				t.Errorf("unexpected error on the channel at its limit: want 429, got %d: %v", StatusCode(err), err)
+			}
+			if _, err := l.acquire(context.Background(), "idle"); StatusCode(err) != http.StatusServiceUnavailable {
+				t.Errorf("unexpected error on the channel under its limit: want 503, got %d: %v", StatusCode(err), err)
+			}
+		})
+	}
+}
+
+func TestHttpHandlerLimitsAsyncEvents(t *testing.T) {
+	testcases := []struct {
+		name     string
+		global   int
+		channels map[string]int
+		want     int
+	}{
+		{name: "channel at its limit", channels: map[string]int{testChannel: 1}, want: http.StatusTooManyRequests},
+		{name: "global limit", global: 1, want: http.StatusServiceUnavailable},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			srv := startAsyncTestServer(t, 2, newDeliveryQueue(10, 10, time.Hour, time.Second))
+			defer srv.nxr.Close()
+			srv.limiter = newCallLimiter(tc.global, tc.channels, 0)
+			// The callee holds the first event until it is released, with a worker left for the second one
+			hung := make(chan struct{})
+			serveAsync(t, srv, OnURL(testChannel).Where("action").EqString("opened"), func(evt []byte) ([]byte, error) {
+				<-hung
+				return evt, nil
+			})
+			handle := srv.CreateHttpHandler()
+			post := func() *httptest.ResponseRecorder {
+				req := httptest.NewRequest("POST", testChannel, strings.NewReader(`{"action":"opened"}`))
+				req.Header.Set("Content-Type", "application/json")
+				rec := httptest.NewRecorder()
+				handle(rec, req)
+				return rec
+			}
+
+			first := post()
+			if first.Code != http.StatusAccepted {
+				t.Fatalf("unexpected status: want %d, got %d: %s", http.StatusAccepted, first.Code, first.Body)
+			}
+			if rec := post(); rec.Code != tc.want {
+				t.Errorf("unexpected status over the limit: want %d, got %d: %s", tc.want, rec.Code, rec.Body)
+			}
+
+			// The limit is returned once the first event is delivered
+			close(hung)
+			waitDelivery(t, srv, strings.TrimPrefix(first.Header().Get("Location"), DeliveriesPath))
+			deadline := time.Now().Add(time.Second)
+			for rec := post(); rec.Code != http.StatusAccepted; rec = post() {
+				if time.Now().After(deadline) {
+					t.Fatalf("unexpected status after the delivery: want %d, got %d: %s", http.StatusAccepted, rec.Code, rec.Body)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
+
+func waitQueued(t *testing.T, l *callLimiter, n int) {
+	deadline := time.Now().Add(time.Second)
+	for {
+		l.mu.Lock()
+		queued := l.queued
+		l.mu.Unlock()
+		if queued == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected queued events: want %d, got %d", n, queued)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,22 @@
+package diplomat
+
+import (
+	"expvar"
+)
+
+// metrics are the counters of the server, served as JSON at /debug/vars of the metrics server under "diplomat" when Server.MetricsAddr is set, like:
+//
+//   {"diplomat": {"procedure_calls": 12, "procedure_retries": 3, "route_retries": {"<route ID>": 3}, ...}}
+var metrics = expvar.NewMap("diplomat")
+
+var (
+	// routeRetries counts the retries by route, as the same failure keeps being retried on a route when its callees are down
+	routeRetries = new(expvar.Map).Init()
+	// routeRetriesExhausted counts the events that failed on all the attempts by route
+	routeRetriesExhausted = new(expvar.Map).Init()
+)
+
+func init() {
+	metrics.Set("route_retries", routeRetries)
+	metrics.Set("route_retries_exhausted", routeRetriesExhausted)
+}
@@ -4,17 +4,21 @@ import (
 	"encoding/base64"
 	"fmt"
 	"github.com/gammazero/nexus/wamp"
-	"log"
 	"net/http"
 )
 
 func getBodyBytes(kwargs wamp.Dict) ([]byte, error) {
-	bs, ok := kwargs["body"].([]byte)
+	return DecodeBody(kwargs["body"])
+}
+
+// DecodeBody returns the raw bytes of an event body.
+// Bodies are received as-is over local connections, and as Base64 strings over WebSocket.
+func DecodeBody(body interface{}) ([]byte, error) {
+	bs, ok := body.([]byte)
 	if !ok {
-		log.Printf("Decoding base64: %v", kwargs["body"])
-		s, isStr := kwargs["body"].(string)
+		s, isStr := body.(string)
 		if !isStr {
-			return nil, fmt.Errorf("Unexpected body: %T: %v", kwargs["body"], kwargs["body"])
+			return nil, fmt.Errorf("Unexpected body: %T: %v", body, body)
 		}
 		var err error
 		bs, err = base64.StdEncoding.DecodeString(s)
@@ -26,9 +30,59 @@ func getBodyBytes(kwargs wamp.Dict) ([]byte, error) {
 }
 
 func eventToKwargs(evt Event) wamp.Dict {
+	body := evt.Body
+	if body == nil {
+		body = []byte{}
+	}
+	return wamp.Dict{
+		"channel": evt.Channel,
+		"method":  evt.Method,
+		"query":   evt.RawQuery,
+		"body":    body,
+		"header":  evt.Header,
+	}
+}
+
+// kwargsToEvent reads the event sent by a WAMP client, failing with ErrInvalidEvent when any of its fields has an unexpected type
+func kwargsToEvent(kwargs wamp.Dict) (*Event, error) {
+	ch, ok := kwargs["channel"].(string)
+	if !ok || ch == "" {
+		return nil, &RouteError{Kind: ErrInvalidEvent, Err: fmt.Errorf("missing channel in %v", kwargs)}
+	}
+	bytes, err := getBodyBytes(kwargs)
+	if err != nil {
+		return nil, &RouteError{Kind: ErrInvalidEvent, Channel: ch, Err: err}
+	}
+	header, err := getHeader(kwargs)
+	if err != nil {
+		return nil, &RouteError{Kind: ErrInvalidEvent, Channel: ch, Err: err}
+	}
+	method, err := getString(kwargs, "method")
+	if err != nil {
+		return nil, &RouteError{Kind: ErrInvalidEvent, Channel: ch, Err: err}
+	}
+	query, err := getString(kwargs, "query")
+	if err != nil {
+		return nil, &RouteError{Kind: ErrInvalidEvent, Channel: ch, Err: err}
+	}
+	return &Event{
+		Channel:  ch,
+		Method:   method,
+		RawQuery: query,
+		Body:     bytes,
+		Header:   header,
+	}, nil
+}
+
+func outputToKwargs(out *Output) wamp.Dict {
+	body := out.Body
+	if body == nil {
+		body = []byte{}
+	}
 	return wamp.Dict{
-		"body":   evt.Body,
-		"header": evt.Header,
+		"body":       body,
+		"header":     out.Header,
+		"statusCode": out.StatusCode,
 	}
 }
 
@@ -37,63 +91,80 @@ func kwargsToOutput(kwargs wamp.Dict) (*Output, error) {
 	if err != nil {
 		return nil, fmt.Errorf("kwargsToOutput failed: %v", err)
 	}
+	header, err := getHeader(kwargs)
+	if err != nil {
+		return nil, fmt.Errorf("kwargsToOutput failed: %v", err)
+	}
+	code, err := getStatusCode(kwargs)
+	if err != nil {
+		return nil, fmt.Errorf("kwargsToOutput failed: %v", err)
+	}
 	return &Output{
 		Body:       bytes,
-		Header:     getHeader(kwargs),
-		StatusCode: getStatusCode(kwargs),
+		Header:     header,
+		StatusCode: code,
 	}, nil
 }
 
-func getStatusCode(kwargs wamp.Dict) int {
-	if kwargs["statusCode"] != nil {
-		switch typed := kwargs["statusCode"].(type) {
-		case uint64:
-			return int(typed)
-		default:
-			panic(fmt.Errorf("unexpected type of status code in %v: type=%T code=%v", kwargs, typed, typed))
-		}
+func getStatusCode(kwargs wamp.Dict) (int, error) {
+	if kwargs["statusCode"] == nil {
+		return 0, nil
 	}
-	return 0
+	code, ok := wamp.AsInt64(kwargs["statusCode"])
+	if !ok {
+		return 0, fmt.Errorf("unexpected type of status code: type=%T code=%v", kwargs["statusCode"], kwargs["statusCode"])
+	}
+	return int(code), nil
 }
 
-func getHeader(kwargs wamp.Dict) map[string][]string {
-	if kwargs["header"] != nil {
-		switch typed := kwargs["header"].(type) {
-		case map[string]interface{}:
-			header := map[string][]string{}
-			for k, v := range typed {
-				sli := v.([]interface{})
-				vs := []string{}
-				for _, v := range sli {
-					vs = append(vs, v.(string))
-				}
-				header[k] = vs
-			}
-			return header
-		default:
-			panic(fmt.Sprintf("unexpected type of header %T: %v", typed, typed))
-		}
+// getString returns the string under the key, or "" when the key is missing
+func getString(kwargs wamp.Dict, key string) (string, error) {
+	if kwargs[key] == nil {
+		return "", nil
 	}
-	return map[string][]string{}
+	s, ok := kwargs[key].(string)
+	if !ok {
+		return "", fmt.Errorf("unexpected type of %s %T: %v", key, kwargs[key], kwargs[key])
+	}
+	return s, nil
 }
 
-func getHttpHeader(kwargs wamp.Dict) http.Header {
-	if kwargs["header"] != nil {
-		switch typed := kwargs["header"].(type) {
-		case map[string]interface{}:
-			header := http.Header{}
-			for k, v := range typed {
-				sli := v.([]interface{})
-				vs := []string{}
-				for _, v := range sli {
-					vs = append(vs, v.(string))
+func getHeader(kwargs wamp.Dict) (map[string][]string, error) {
+	if kwargs["header"] == nil {
+		return map[string][]string{}, nil
+	}
+	switch typed := kwargs["header"].(type) {
+	case map[string]interface{}:
+		header := map[string][]string{}
+		for k, v := range typed {
+			sli, ok := v.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("unexpected type of header %s %T: %v", k, v, v)
+			}
+			vs := []string{}
+			for _, v := range sli {
+				s, ok := v.(string)
+				if !ok {
+					return nil, fmt.Errorf("unexpected type of header %s value %T: %v", k, v, v)
 				}
-				header[k] = vs
+				vs = append(vs, s)
 			}
-			return header
-		default:
-			panic(fmt.Sprintf("unexpected type of header %T: %v", typed, typed))
+			header[k] = vs
 		}
+		return header, nil
+	case map[string][]string:
+		return typed, nil
+	case http.Header:
+		return typed, nil
+	default:
+		return nil, fmt.Errorf("unexpected type of header %T: %v", typed, typed)
+	}
+}
+
+func getHttpHeader(kwargs wamp.Dict) (http.Header, error) {
+	header, err := getHeader(kwargs)
+	if err != nil {
+		return nil, err
 	}
-	return http.Header{}
+	return http.Header(header), nil
 }
@@ -0,0 +1,65 @@
+package diplomat
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+func TestKwargsToEventRejectsUnexpectedTypes(t *testing.T) {
+	testcases := []struct {
+		name   string
+		kwargs wamp.Dict
+	}{
+		{name: "missing channel", kwargs: wamp.Dict{"body": []byte("{}")}},
+		{name: "non-string channel", kwargs: wamp.Dict{"channel": 1, "body": []byte("{}")}},
+		{name: "non-bytes body", kwargs: wamp.Dict{"channel": "http://example.com/webhook", "body": 1}},
+		{name: "non-map header", kwargs: wamp.Dict{"channel": "http://example.com/webhook", "body": []byte("{}"), "header": "X-Foo: bar"}},
+		{name: "non-list header values", kwargs: wamp.Dict{"channel": "http://example.com/webhook", "body": []byte("{}"), "header": map[string]interface{}{"X-Foo": "bar"}}},
+		{name: "non-string header value", kwargs: wamp.Dict{"channel": "http://example.com/webhook", "body": []byte("{}"), "header": map[string]interface{}{"X-Foo": []interface{}{1}}}},
+		{name: "non-string method", kwargs: wamp.Dict{"channel": "http://example.com/webhook", "body": []byte("{}"), "method": 1}},
+		{name: "non-string query", kwargs: wamp.Dict{"channel": "http://example.com/webhook", "body": []byte("{}"), "query": []string{"a=b"}}},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := kwargsToEvent(tc.kwargs)
+			if ErrorKind(err) != ErrInvalidEvent {
+				t.Fatalf("unexpected error: want %v, got %v", ErrInvalidEvent, err)
+			}
+			if res := errorToInvokeResult(err); res.Err != wamp.ErrInvalidArgument {
+				t.Errorf("unexpected error uri: want %s, got %s", wamp.ErrInvalidArgument, res.Err)
+			}
+		})
+	}
+}
+
+func TestKwargsToEvent(t *testing.T) {
+	evt, err := kwargsToEvent(wamp.Dict{
+		"channel": "http://example.com/webhook",
+		"method":  http.MethodPost,
+		"body":    "e30=",
+		"header":  map[string]interface{}{"X-Github-Event": []interface{}{"push"}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(evt.Body) != "{}" || http.Header(evt.Header).Get("X-GitHub-Event") != "push" || evt.Method != http.MethodPost {
+		t.Errorf("unexpected event: %+v", evt)
+	}
+}
+
+func TestKwargsToOutputRejectsUnexpectedTypes(t *testing.T) {
+	if _, err := kwargsToOutput(wamp.Dict{"body": []byte("{}"), "statusCode": "200"}); err == nil {
+		t.Error("expected error on non-integer status code")
+	}
+	out, err := kwargsToOutput(wamp.Dict{"body": []byte("{}"), "statusCode": uint64(201)})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.StatusCode != 201 {
+		t.Errorf("unexpected status code: want 201, got %d", out.StatusCode)
+	}
+}
@@ -3,11 +3,11 @@ package diplomat
 import (
 	"encoding/hex"
 	"fmt"
+	"github.com/gammazero/nexus/wamp"
 	"github.com/minio/highwayhash"
 	"github.com/mumoshu/diplomat/pkg/api"
-	"sort"
-	"strconv"
-	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 var key []byte
@@ -22,22 +22,50 @@ func init() {
 }
 
 type Expr struct {
-	Path   []string
-	String *string
-	Int *int
-	All bool
+	Source  Source
+	Path    []string
+	Op      Operator
+	String  *string
+	Int     *int
+	Strings []string
+	Ints    []int
+	All     bool
 }
 
 type RouteCondition struct {
 	Channel api.ChannelRef
 	Expressions []Expr
+	// Bool is the boolean expression tree built with Any, AllOf and Not, which is ANDed with the expressions
+	Bool *BoolExpr
 	FormParameterName string
+	// BodyFormat decodes bodies in the format regardless of their Content-Type. Ignored for routes with FormParameterName
+	BodyFormat BodyFormat
+	// Fallback makes the route receive the events of the channel that matched no other route, whatever their bodies are.
+	// Fallback conditions have no expressions. See CondBuilder.Fallback
+	Fallback bool
 }
 
+// Route is the topics and procedures receiving the events that match the condition.
+// Dispatch, Priority, Retry, Async and RateLimit apply to all the procedures, so every callee of the route has to register it with the same ones.
+// They are reset once the last procedure is removed.
 type Route struct {
 	RouteCondition
 	Topics     []string
 	Procedures []string
+	// Dispatch is how events are delivered to the procedures
+	Dispatch Dispatch `json:",omitempty"`
+	// Priority is the precedence of the procedures over the ones of the other routes matching the same event
+	Priority int `json:",omitempty"`
+	// Retry is how the procedures are called again when they fail
+	Retry *RetryPolicy `json:",omitempty"`
+	// Async makes the HTTP gateway acknowledge the events before delivering them
+	Async bool `json:",omitempty"`
+	// RateLimit limits the rate of the events delivered to the procedures
+	RateLimit *RateLimit `json:",omitempty"`
+	// TopicSessions and ProcedureSessions are the WAMP sessions that own the topics and procedures, whose receivers are removed when the sessions leave.
+	// Receivers beyond them are owned by nobody, like the ones added by the server itself or restored from the store.
+	TopicSessions     []wamp.ID `json:"-"`
+	ProcedureSessions []wamp.ID `json:"-"`
 }
 
 type RouteConditionID string
@@ -67,36 +95,61 @@ func (m RouteCondition) ReceiverName() string {
 	return string(m.ID())
 }
 
+// fallbackSuffix follows the channel URL in the IDs of the fallback routes.
+// No other route condition has it, as `fallback` alone is not a valid query, and the router accepts it in procedure and topic URIs
+const fallbackSuffix = "?fallback"
+
+// paramQualifier and formatQualifier follow the channel URL in the IDs of the routes on form parameters and body formats, like `?param=payload` and `?format=xml`,
+// so that the routes with the same expressions on different parameters and formats have different IDs.
+// Body paths starting with them are prefixed with `body.` in the IDs, as ParseCondition would take them for the qualifiers otherwise.
+const (
+	paramQualifier  = "param"
+	formatQualifier = "format"
+)
+
+func isQualifier(name string) bool {
+	return name == paramQualifier || name == formatQualifier
+}
+
 func (m RouteCondition) ID() RouteConditionID {
-	keys := []string{}
-	d := map[string]string{}
-	for _, c := range m.Expressions {
-		var v string
-		if c.String != nil {
-			v = *c.String
-		}
-		if c.Int != nil {
-			v = strconv.Itoa(*c.Int)
+	id := m.Channel.SendChannelURL()
+	if m.FormParameterName != "" {
+		id += fmt.Sprintf("?%s=%s", paramQualifier, escapeQueryValue(m.FormParameterName))
+	}
+	if m.BodyFormat != "" {
+		id += fmt.Sprintf("?%s=%s", formatQualifier, escapeQueryValue(string(m.BodyFormat)))
+	}
+	// Rendered from the canonical form so that equivalent conditions have the same ID
+	if b := m.boolExpr(); !b.isAll() {
+		if query := b.render(); query != "" {
+			id += "?" + query
 		}
-		if v != "" {
-			k := strings.Join(c.Path, ".")
-			d[k] = v
-			keys = append(keys, k)
+	}
+	if m.Fallback {
+		id += fallbackSuffix
+	}
+	return RouteConditionID(id)
+}
+
+// Validate returns an error when any expression of the condition can never be evaluated, like an invalid regular expression
+func (m RouteCondition) Validate() error {
+	if m.Fallback && (len(m.Expressions) > 0 || m.Bool != nil || m.FormParameterName != "" || m.BodyFormat != "") {
+		return fmt.Errorf("invalid route condition %s: fallback routes have no expressions, form parameter or body format", m.ID())
+	}
+	for _, e := range m.Expressions {
+		if err := e.Validate(); err != nil {
+			return fmt.Errorf("invalid route condition %s: %v", m.ID(), err)
 		}
 	}
-	sort.Strings(keys)
-	idparts := []string{}
-	for _, k := range keys {
-		idparts = append(idparts, fmt.Sprintf("%s=%s", k, d[k]))
+	if m.Bool != nil {
+		if err := m.Bool.Validate(); err != nil {
+			return fmt.Errorf("invalid route condition %s: %v", m.ID(), err)
+		}
 	}
-	query := strings.Join(idparts, "&")
-	var id string
-	if query != "" {
-		id = strings.Join([]string{m.Channel.SendChannelURL(), query}, "?")
-	} else {
-		id = m.Channel.SendChannelURL()
+	if m.BodyFormat != "" && !isKnownBodyFormat(m.BodyFormat) {
+		return fmt.Errorf("invalid route condition %s: unknown body format %q", m.ID(), m.BodyFormat)
 	}
-	return RouteConditionID(id)
+	return nil
 }
 
 func (m RouteCondition) HashValue() uint64 {
@@ -115,8 +168,24 @@ func (ms *RoutesPartition) Put(m *Route) {
 	ms.Routes[m.ID()] = m
 }
 
+// RouteTable is the routes by their conditions. Routes are read without locks, as the partitions are replaced instead of modified on updates
 type RouteTable struct {
-	RoutePartitions map[uint64]*RoutesPartition
+	// Store persists the routes on every update when set
+	Store RouteStore
+
+	// partitions is the latest map[uint64]*RoutesPartition, which is never modified once stored
+	partitions atomic.Value
+
+	// unclaimed is the number of the receivers of each route restored from the store, which have not registered again since the restart
+	unclaimed map[RouteConditionID]*receiverCounts
+
+	// mu serializes the updates of the partitions and guards unclaimed
+	mu sync.Mutex
+}
+
+type receiverCounts struct {
+	topics int
+	procs  int
 }
 
 type Router struct {
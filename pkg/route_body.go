@@ -0,0 +1,58 @@
+package diplomat
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+
+	"github.com/valyala/fastjson"
+)
+
+const (
+	mediaTypeForm      = "application/x-www-form-urlencoded"
+	mediaTypeMultipart = "multipart/form-data"
+
+	// maxFormMemory is the size of multipart bodies kept in memory. The rest is written to temporary files until the search finishes
+	maxFormMemory = 32 << 20
+)
+
+// bodyMediaType returns the media type and its parameters in the Content-Type header, or an empty string when there is none
+func bodyMediaType(header map[string][]string) (string, map[string]string) {
+	ct := http.Header(header).Get("Content-Type")
+	if ct == "" {
+		return "", nil
+	}
+	mediaType, params, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return "", nil
+	}
+	return mediaType, params
+}
+
+// parseJSONBody returns nil for empty bodies
+func parseJSONBody(parser *fastjson.Parser, data []byte) (*fastjson.Value, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	return parser.ParseBytes(data)
+}
+
+// parseForm returns the fields of the form-urlencoded or multipart body. Files in multipart bodies are ignored
+func parseForm(body []byte, mediaType string, params map[string]string) (url.Values, error) {
+	if mediaType != mediaTypeMultipart {
+		return url.ParseQuery(string(body))
+	}
+	boundary := params["boundary"]
+	if boundary == "" {
+		return nil, fmt.Errorf("missing boundary in the content type %s", mediaType)
+	}
+	form, err := multipart.NewReader(bytes.NewReader(body), boundary).ReadForm(maxFormMemory)
+	if err != nil {
+		return nil, err
+	}
+	defer form.RemoveAll()
+	return url.Values(form.Value), nil
+}
@@ -0,0 +1,249 @@
+package diplomat
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/valyala/fastjson"
+	"gopkg.in/yaml.v2"
+)
+
+// BodyFormat names the format of bodies, which decides the decoder that body expressions are evaluated against
+type BodyFormat string
+
+const (
+	FormatJSON BodyFormat = "json"
+	FormatXML  BodyFormat = "xml"
+	FormatYAML BodyFormat = "yaml"
+)
+
+// BodyDecoder decodes bodies into values made of maps, slices, strings, numbers, booleans and nils, like the ones of `json.Unmarshal`.
+// Map keys become the path elements of body expressions.
+type BodyDecoder interface {
+	Decode(body []byte) (interface{}, error)
+}
+
+type BodyDecoderFunc func(body []byte) (interface{}, error)
+
+func (f BodyDecoderFunc) Decode(body []byte) (interface{}, error) {
+	return f(body)
+}
+
+var bodyDecoders = map[BodyFormat]BodyDecoder{
+	FormatXML:  BodyDecoderFunc(decodeXML),
+	FormatYAML: BodyDecoderFunc(decodeYAML),
+}
+
+var mediaTypeFormats = map[string]BodyFormat{
+	"application/json":   FormatJSON,
+	"text/json":          FormatJSON,
+	"application/xml":    FormatXML,
+	"text/xml":           FormatXML,
+	"application/yaml":   FormatYAML,
+	"application/x-yaml": FormatYAML,
+	"text/yaml":          FormatYAML,
+	"text/x-yaml":        FormatYAML,
+}
+
+// RegisterBodyDecoder registers the decoder for the format, which is used for bodies of the media types and for routes with the format.
+// It is meant to be called on init, before any server starts. JSON bodies are always decoded by the built-in decoder.
+func RegisterBodyDecoder(format BodyFormat, decoder BodyDecoder, mediaTypes ...string) {
+	if format == FormatJSON {
+		panic(fmt.Errorf("the decoder for %s can not be replaced", format))
+	}
+	bodyDecoders[format] = decoder
+	for _, t := range mediaTypes {
+		mediaTypeFormats[t] = format
+	}
+}
+
+func isKnownBodyFormat(format BodyFormat) bool {
+	_, ok := bodyDecoders[format]
+	return ok || format == FormatJSON
+}
+
+// mediaTypeFormat returns the format of the media type, including the structured syntax suffixes like `application/soap+xml`.
+// Bodies of unknown media types are decoded as JSON, as they have always been.
+func mediaTypeFormat(mediaType string) BodyFormat {
+	if f, ok := mediaTypeFormats[mediaType]; ok {
+		return f
+	}
+	if i := strings.LastIndex(mediaType, "+"); i >= 0 {
+		if _, ok := bodyDecoders[BodyFormat(mediaType[i+1:])]; ok {
+			return BodyFormat(mediaType[i+1:])
+		}
+	}
+	return FormatJSON
+}
+
+// decodeBody decodes the body in the format into the value allocated from the arena, or the parser for JSON.
+// Values are valid until the arena or the parser is reused, and nil for empty bodies.
+func decodeBody(format BodyFormat, data []byte, a *fastjson.Arena, parser *fastjson.Parser) (*fastjson.Value, error) {
+	if format == FormatJSON || format == "" {
+		return parseJSONBody(parser, data)
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	decoder, ok := bodyDecoders[format]
+	if !ok {
+		return nil, fmt.Errorf("unknown body format %q", format)
+	}
+	v, err := decoder.Decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode %s body: %v", format, err)
+	}
+	return toFastJSON(a, v)
+}
+
+// hasStringValues reports whether all the values decoded in the format are strings, which are compared with integers when they look like integers
+func hasStringValues(format BodyFormat) bool {
+	return format == FormatXML
+}
+
+func toFastJSON(a *fastjson.Arena, v interface{}) (*fastjson.Value, error) {
+	switch typed := v.(type) {
+	case nil:
+		return a.NewNull(), nil
+	case *fastjson.Value:
+		return typed, nil
+	case string:
+		return a.NewString(typed), nil
+	case bool:
+		if typed {
+			return a.NewTrue(), nil
+		}
+		return a.NewFalse(), nil
+	case int:
+		return a.NewNumberInt(typed), nil
+	case int64:
+		return a.NewNumberInt(int(typed)), nil
+	case uint64:
+		return a.NewNumberFloat64(float64(typed)), nil
+	case float64:
+		return a.NewNumberFloat64(typed), nil
+	case []interface{}:
+		arr := a.NewArray()
+		for i, item := range typed {
+			iv, err := toFastJSON(a, item)
+			if err != nil {
+				return nil, err
+			}
+			arr.SetArrayItem(i, iv)
+		}
+		return arr, nil
+	case map[string]interface{}:
+		o := a.NewObject()
+		for k, item := range typed {
+			iv, err := toFastJSON(a, item)
+			if err != nil {
+				return nil, err
+			}
+			o.Set(k, iv)
+		}
+		return o, nil
+	case map[interface{}]interface{}:
+		o := a.NewObject()
+		for k, item := range typed {
+			iv, err := toFastJSON(a, item)
+			if err != nil {
+				return nil, err
+			}
+			o.Set(fmt.Sprint(k), iv)
+		}
+		return o, nil
+	}
+	return nil, fmt.Errorf("unsupported value %T: %v", v, v)
+}
+
+// decodeXML maps the root element to the only key of the object, like `{"alert": {...}}`.
+// Attributes are keyed by `@` and their names, and repeated elements become arrays.
+// Elements with only text become strings, and the text of the other elements is keyed by `$text`.
+// Namespaces are dropped from the names.
+func decodeXML(body []byte) (interface{}, error) {
+	d := xml.NewDecoder(bytes.NewReader(body))
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return nil, fmt.Errorf("missing root element")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if start, ok := tok.(xml.StartElement); ok {
+			v, err := decodeXMLElement(d, start)
+			if err != nil {
+				return nil, err
+			}
+			return map[string]interface{}{start.Name.Local: v}, nil
+		}
+	}
+}
+
+func decodeXMLElement(d *xml.Decoder, start xml.StartElement) (interface{}, error) {
+	obj := map[string]interface{}{}
+	for _, attr := range start.Attr {
+		obj["@"+attr.Name.Local] = attr.Value
+	}
+	var text strings.Builder
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			child, err := decodeXMLElement(d, t)
+			if err != nil {
+				return nil, err
+			}
+			name := t.Name.Local
+			existing, ok := obj[name]
+			switch items := existing.(type) {
+			case []interface{}:
+				obj[name] = append(items, child)
+			default:
+				if ok {
+					obj[name] = []interface{}{existing, child}
+				} else {
+					obj[name] = child
+				}
+			}
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			s := strings.TrimSpace(text.String())
+			if len(obj) == 0 {
+				return s, nil
+			}
+			if s != "" {
+				obj["$text"] = s
+			}
+			return obj, nil
+		}
+	}
+}
+
+// decodeYAML returns the only document in the body as-is, and all the documents as an array when there are many
+func decodeYAML(body []byte) (interface{}, error) {
+	d := yaml.NewDecoder(bytes.NewReader(body))
+	docs := []interface{}{}
+	for {
+		var doc interface{}
+		err := d.Decode(&doc)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc)
+	}
+	if len(docs) == 1 {
+		return docs[0], nil
+	}
+	return docs, nil
+}
@@ -0,0 +1,199 @@
+package diplomat
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/valyala/fastjson"
+)
+
+func TestDecodeYAMLRejectsExcessiveAliasing(t *testing.T) {
+	body := []byte(`
+a: &a ["lol","lol","lol","lol","lol","lol","lol","lol","lol"]
+b: &b [*a,*a,*a,*a,*a,*a,*a,*a,*a]
+c: &c [*b,*b,*b,*b,*b,*b,*b,*b,*b]
+d: &d [*c,*c,*c,*c,*c,*c,*c,*c,*c]
+e: &e [*d,*d,*d,*d,*d,*d,*d,*d,*d]
+f: &f [*e,*e,*e,*e,*e,*e,*e,*e,*e]
+g: &g [*f,*f,*f,*f,*f,*f,*f,*f,*f]
+h: &h [*g,*g,*g,*g,*g,*g,*g,*g,*g]
+i: &i [*h,*h,*h,*h,*h,*h,*h,*h,*h]
+`)
+	if _, err := decodeYAML(body); err == nil {
+		t.Fatal("unexpected success: want an error on the excessive aliasing")
+	}
+
+	doc, err := decodeYAML([]byte("base: &base {name: foo}\nother: *base\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	other, ok := doc.(map[interface{}]interface{})["other"].(map[interface{}]interface{})
+	if !ok || other["name"] != "foo" {
+		t.Errorf("unexpected document: %v", doc)
+	}
+}
+
+func TestDecodeXML(t *testing.T) {
+	testcases := []struct {
+		name    string
+		body    string
+		want    interface{}
+		wantErr bool
+	}{
+		{name: "attributes and text", body: `<alert severity="critical">disk full</alert>`, want: map[string]interface{}{"alert": map[string]interface{}{"@severity": "critical", "$text": "disk full"}}},
+		{name: "only text", body: `<alert>disk full</alert>`, want: map[string]interface{}{"alert": "disk full"}},
+		{name: "only attributes", body: `<alert severity="critical"/>`, want: map[string]interface{}{"alert": map[string]interface{}{"@severity": "critical"}}},
+		{name: "empty element", body: `<alert/>`, want: map[string]interface{}{"alert": ""}},
+		{name: "repeated elements", body: `<alerts><alert>a</alert><alert>b</alert><alert>c</alert></alerts>`, want: map[string]interface{}{"alerts": map[string]interface{}{"alert": []interface{}{"a", "b", "c"}}}},
+		{name: "single element", body: `<alerts><alert>a</alert></alerts>`, want: map[string]interface{}{"alerts": map[string]interface{}{"alert": "a"}}},
+		{name: "repeated elements with attributes", body: `<alerts><alert id="1"/><alert id="2">b</alert></alerts>`, want: map[string]interface{}{"alerts": map[string]interface{}{"alert": []interface{}{map[string]interface{}{"@id": "1"}, map[string]interface{}{"@id": "2", "$text": "b"}}}}},
+		{name: "text around children", body: "<alert>\n  disk <host>a</host> full\n</alert>", want: map[string]interface{}{"alert": map[string]interface{}{"host": "a", "$text": "disk  full"}}},
+		{name: "prefixed names", body: `<s:Envelope><s:Body>x</s:Body></s:Envelope>`, want: map[string]interface{}{"Envelope": map[string]interface{}{"Body": "x"}}},
+		{name: "prolog and comments", body: `<?xml version="1.0"?><!-- c --><alert>a</alert>`, want: map[string]interface{}{"alert": "a"}},
+		{name: "no root element", body: `<?xml version="1.0"?>`, wantErr: true},
+		{name: "unclosed element", body: `<alert><host>a</host>`, wantErr: true},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			v, err := decodeXML([]byte(tc.body))
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("unexpected success: got %v", v)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(v, tc.want) {
+				t.Errorf("unexpected value: want %v, got %v", tc.want, v)
+			}
+		})
+	}
+}
+
+func TestMediaTypeFormat(t *testing.T) {
+	testcases := []struct {
+		mediaType string
+		want      BodyFormat
+	}{
+		{mediaType: "application/json", want: FormatJSON},
+		{mediaType: "text/xml", want: FormatXML},
+		{mediaType: "application/soap+xml", want: FormatXML},
+		{mediaType: "application/x-yaml", want: FormatYAML},
+		{mediaType: "application/vnd.api+json", want: FormatJSON},
+		{mediaType: "application/vnd.foo+bar", want: FormatJSON},
+		{mediaType: "text/plain", want: FormatJSON},
+		{mediaType: "", want: FormatJSON},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+		t.Run(tc.mediaType, func(t *testing.T) {
+			if got := mediaTypeFormat(tc.mediaType); got != tc.want {
+				t.Errorf("unexpected format: want %s, got %s", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestDecodeBody(t *testing.T) {
+	testcases := []struct {
+		name    string
+		format  BodyFormat
+		body    string
+		want    string
+		wantErr bool
+	}{
+		{name: "json", format: FormatJSON, body: `{"a":1}`, want: `{"a":1}`},
+		{name: "no format", body: `{"a":1}`, want: `{"a":1}`},
+		{name: "yaml", format: FormatYAML, body: "a: 1\nb: [x]\n", want: `{"a":1,"b":["x"]}`},
+		{name: "json decoded as yaml", format: FormatYAML, body: `{"a":1}`, want: `{"a":1}`},
+		{name: "xml", format: FormatXML, body: `<a n="1">x</a>`, want: `{"a":{"@n":"1","$text":"x"}}`},
+		{name: "empty xml", format: FormatXML, want: "null"},
+		{name: "xml decoded as json", format: FormatJSON, body: `<a>x</a>`, wantErr: true},
+		{name: "unknown format", format: "toml", body: `a = 1`, wantErr: true},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			var a fastjson.Arena
+			var p fastjson.Parser
+			v, err := decodeBody(tc.format, []byte(tc.body), &a, &p)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("unexpected success: got %v", v)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got := "null"
+			if v != nil {
+				got = v.String()
+			}
+			// Compared after decoding, as the keys of the objects decoded from maps are in random order
+			var gotValue, wantValue interface{}
+			if err := json.Unmarshal([]byte(got), &gotValue); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal([]byte(tc.want), &wantValue); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(gotValue, wantValue) {
+				t.Errorf("unexpected value: want %s, got %s", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestRouteIndexSelectsDecoders(t *testing.T) {
+	const ch = "http://example.com/alerts"
+	// Without a format, bodies are decoded by their Content-Type
+	byContentType := OnURL(ch).Where("alert", "@severity").EqString("critical")
+	// yaml decodes the bodies as YAML whatever their Content-Type is
+	yaml := OnURL(ch).Format(FormatYAML).Where("alert", "severity").EqString("warning")
+
+	srv := NewServer(Server{})
+	for _, c := range []RouteCondition{byContentType, yaml} {
+		if err := srv.StartRouting(RouteConfig{RouteCondition: c, Topic: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testcases := []struct {
+		name        string
+		contentType string
+		body        string
+		want        RouteConditionID
+	}{
+		{name: "xml by content type", contentType: "application/xml", body: `<alert severity="critical"/>`, want: byContentType.ID()},
+		{name: "xml by structured syntax suffix", contentType: "application/soap+xml; charset=utf-8", body: `<alert severity="critical"/>`, want: byContentType.ID()},
+		{name: "json by content type", contentType: "application/json", body: `{"alert":{"@severity":"critical"}}`, want: byContentType.ID()},
+		{name: "yaml by format with a json content type", contentType: "application/json", body: `{"alert":{"severity":"warning"}}`, want: yaml.ID()},
+		{name: "yaml by format without content type", body: "alert:\n  severity: warning\n", want: yaml.ID()},
+		{name: "xml of the wrong content type", contentType: "application/json", body: `<alert severity="critical"/>`},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			header := map[string][]string{}
+			if tc.contentType != "" {
+				header["Content-Type"] = []string{tc.contentType}
+			}
+			matches, err := srv.SearchRouteMatchesEvent(Event{Channel: ch, Body: []byte(tc.body), Header: header})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if _, ok := matches[tc.want]; (tc.want != "" && !ok) || len(matches) > 1 || (tc.want == "" && len(matches) > 0) {
+				t.Errorf("unexpected matches: want %q, got %v", tc.want, matches)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package diplomat
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestParseForm(t *testing.T) {
+	var multi bytes.Buffer
+	w := multipart.NewWriter(&multi)
+	if err := w.WriteField("From", "+15555550100"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteField("Body", "a=b&c"); err != nil {
+		t.Fatal(err)
+	}
+	f, err := w.CreateFormFile("attachment", "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("ignored")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	testcases := []struct {
+		name      string
+		body      string
+		mediaType string
+		params    map[string]string
+		want      url.Values
+		wantErr   bool
+	}{
+		{name: "form", body: "From=%2B15555550100&Body=hello+world", mediaType: mediaTypeForm, want: url.Values{"From": {"+15555550100"}, "Body": {"hello world"}}},
+		{name: "form value without =", body: "flag&a=1", mediaType: mediaTypeForm, want: url.Values{"flag": {""}, "a": {"1"}}},
+		{name: "form with repeated keys", body: "a=1&a=2", mediaType: mediaTypeForm, want: url.Values{"a": {"1", "2"}}},
+		{name: "form with an invalid escape", body: "a=%zz", mediaType: mediaTypeForm, wantErr: true},
+		{name: "multipart without files", body: multi.String(), mediaType: mediaTypeMultipart, params: map[string]string{"boundary": w.Boundary()}, want: url.Values{"From": {"+15555550100"}, "Body": {"a=b&c"}}},
+		{name: "multipart without boundary", body: multi.String(), mediaType: mediaTypeMultipart, wantErr: true},
+		{name: "multipart with another boundary", body: multi.String(), mediaType: mediaTypeMultipart, params: map[string]string{"boundary": "other"}, wantErr: true},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			form, err := parseForm([]byte(tc.body), tc.mediaType, tc.params)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("unexpected success: got %v", form)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(form, tc.want) {
+				t.Errorf("unexpected form: want %v, got %v", tc.want, form)
+			}
+		})
+	}
+}
+
+func TestBodyMediaType(t *testing.T) {
+	testcases := []struct {
+		contentType string
+		want        string
+		wantParams  map[string]string
+	}{
+		{contentType: "application/x-www-form-urlencoded; charset=UTF-8", want: mediaTypeForm, wantParams: map[string]string{"charset": "UTF-8"}},
+		{contentType: "Multipart/Form-Data; boundary=xyz", want: mediaTypeMultipart, wantParams: map[string]string{"boundary": "xyz"}},
+		{contentType: "", want: ""},
+		{contentType: "multipart/form-data; boundary", want: ""},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+		t.Run(tc.contentType, func(t *testing.T) {
+			got, params := bodyMediaType(map[string][]string{"Content-Type": {tc.contentType}})
+			if got != tc.want {
+				t.Errorf("unexpected media type: want %q, got %q", tc.want, got)
+			}
+			if len(tc.wantParams) > 0 && !reflect.DeepEqual(params, tc.wantParams) {
+				t.Errorf("unexpected params: want %v, got %v", tc.wantParams, params)
+			}
+		})
+	}
+}
+
+func TestRouteIndexFormFields(t *testing.T) {
+	const ch = "http://example.com/sms"
+	from := OnURL(ch).Where("From").EqString("+15555550100")
+	count := OnURL(ch).Where("NumMedia").Gt(0)
+	// payload is on the JSON in the form parameter, like Slack interactions
+	payload := OnURL(ch).Parameter("payload").Where("type").EqString("block_actions")
+
+	srv := NewServer(Server{})
+	for _, c := range []RouteCondition{from, count, payload} {
+		if err := srv.StartRouting(RouteConfig{RouteCondition: c, Topic: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var multi bytes.Buffer
+	w := multipart.NewWriter(&multi)
+	if err := w.WriteField("From", "+15555550100"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	testcases := []struct {
+		name        string
+		contentType string
+		body        string
+		want        []RouteConditionID
+		wantErr     bool
+	}{
+		{name: "form field", contentType: mediaTypeForm, body: "From=%2B15555550100", want: []RouteConditionID{from.ID()}},
+		{name: "form field compared as int", contentType: mediaTypeForm, body: "NumMedia=2", want: []RouteConditionID{count.ID()}},
+		{name: "multipart field", contentType: w.FormDataContentType(), body: multi.String(), want: []RouteConditionID{from.ID()}},
+		{name: "form field and json parameter", contentType: mediaTypeForm, body: url.Values{"NumMedia": {"1"}, "payload": {`{"type":"block_actions"}`}}.Encode(), want: []RouteConditionID{count.ID(), payload.ID()}},
+		{name: "json parameter that is not json", contentType: mediaTypeForm, body: "payload=block_actions"},
+		{name: "form parsed as json without content type", body: "From=%2B15555550100", wantErr: true},
+		{name: "invalid form", contentType: mediaTypeForm, body: "From=%zz", wantErr: true},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			header := map[string][]string{}
+			if tc.contentType != "" {
+				header["Content-Type"] = []string{tc.contentType}
+			}
+			matches, err := srv.SearchRouteMatchesEvent(Event{Channel: ch, Body: []byte(tc.body), Header: header})
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("unexpected success: got %v", matches)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(matches) != len(tc.want) {
+				t.Errorf("unexpected matches: want %v, got %v", tc.want, matches)
+			}
+			for _, id := range tc.want {
+				if _, ok := matches[id]; !ok {
+					t.Errorf("unexpected matches: want %s, got %v", id, matches)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,582 @@
+package diplomat
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/mumoshu/diplomat/pkg/api"
+)
+
+// ConditionSyntaxError is the error returned by ParseCondition, with the 1-based position of the character that could not be parsed
+type ConditionSyntaxError struct {
+	Input   string
+	Pos     int
+	Message string
+}
+
+func (e *ConditionSyntaxError) Error() string {
+	return fmt.Sprintf("invalid condition %q: %s at position %d", e.Input, e.Message, e.Pos)
+}
+
+// ParseCondition parses a route condition in either of the two forms.
+//
+// The query form is the one of RouteConditionID, so that any route ID can be parsed back into its condition:
+//
+//	http://example.com/webhook/github?action=opened&pull_request.base.ref=main
+//	http://example.com/webhook/github?(action=opened|action=synchronize)&!sender.type=Bot&pull_request.number[gt]=100
+//
+// The expression form is the one of the Format methods:
+//
+//	http://example.com/webhook/github body.foo.bar == 1 && (action == "opened" || action in ["reopened", "synchronize"])
+//
+// Paths starting with `header.` and `query.` are evaluated against the header and the query parameter named by the rest of the path,
+// `method` is evaluated against the HTTP method, and the leading `body.` of the other paths is optional.
+// Unquoted values are compared as integers when they look like integers, and as strings otherwise,
+// and `=` is accepted as `==` so that `action=opened` is valid in both forms.
+//
+// The channel URL can be followed by `?param=payload` and `?format=xml` in this order, which set FormParameterName and BodyFormat as in the route IDs.
+// The channel URL can be omitted, in which case the channel of the returned condition is empty. See CondBuilder.Parse for that case.
+// A channel URL alone matches all the events sent to the channel.
+func ParseCondition(s string) (RouteCondition, error) {
+	p := &condParser{input: s}
+	c := RouteCondition{}
+
+	p.skipSpaces()
+	if end := p.channelEnd(); end > p.pos {
+		ch, err := api.ParseChannelRef(s[p.pos:end])
+		if err != nil {
+			return RouteCondition{}, p.errorf("%v", err)
+		}
+		c.Channel = ch
+		p.pos = end
+		if err := p.parseQualifiers(&c); err != nil {
+			return RouteCondition{}, err
+		}
+		if p.rest() == fallbackSuffix {
+			c.Fallback = true
+			return c, nil
+		}
+	}
+
+	var b BoolExpr
+	var err error
+	if p.consume("?") {
+		b, err = p.parseQuery()
+	} else {
+		p.skipSpaces()
+		if p.eof() {
+			b = BoolExpr{Expr: &Expr{All: true}}
+		} else {
+			b, err = p.parseExpression()
+		}
+	}
+	if err != nil {
+		return RouteCondition{}, err
+	}
+	if !p.eof() {
+		return RouteCondition{}, p.errorf("unexpected %q", p.rest())
+	}
+
+	b = b.normalize()
+	switch {
+	case b.Op == "":
+		c.Expressions = []Expr{*b.Expr}
+	case b.Op == BoolAnd && allLeaves(b.Args):
+		for _, a := range b.Args {
+			c.Expressions = append(c.Expressions, *a.Expr)
+		}
+	default:
+		c.Bool = &b
+	}
+	return c, nil
+}
+
+// allLeaves tells whether the args are all expressions, which are then able to be the expressions of the condition
+func allLeaves(args []BoolExpr) bool {
+	for _, a := range args {
+		if a.Op != "" || a.Expr == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Parse parses the condition without the channel URL, and ANDs it with the expressions built so far, like:
+//
+//	On(ch).Parse(`action == "opened" && !(sender.type == "Bot")`)
+func (b CondBuilder) Parse(s string) (RouteCondition, error) {
+	c, err := ParseCondition(s)
+	if err != nil {
+		return RouteCondition{}, err
+	}
+	if c.Channel == (api.ChannelRef{}) {
+		c.Channel = b.Channel
+		c.FormParameterName = b.ParameterName
+		c.BodyFormat = b.BodyFormat
+	} else if c.Channel != b.Channel {
+		return RouteCondition{}, fmt.Errorf("invalid condition %q: channel %s does not match %s", s, c.Channel, b.Channel)
+	}
+	if len(b.Expressions) > 0 || b.Bool != nil {
+		return AllOf(b.All(), c), nil
+	}
+	return c, nil
+}
+
+type condParser struct {
+	input string
+	pos   int
+}
+
+func (p *condParser) errorf(format string, args ...interface{}) error {
+	return &ConditionSyntaxError{Input: p.input, Pos: p.pos + 1, Message: fmt.Sprintf(format, args...)}
+}
+
+func (p *condParser) eof() bool {
+	return p.pos >= len(p.input)
+}
+
+func (p *condParser) rest() string {
+	return p.input[p.pos:]
+}
+
+func (p *condParser) skipSpaces() {
+	for !p.eof() && unicode.IsSpace(rune(p.input[p.pos])) {
+		p.pos++
+	}
+}
+
+func (p *condParser) consume(s string) bool {
+	if strings.HasPrefix(p.rest(), s) {
+		p.pos += len(s)
+		return true
+	}
+	return false
+}
+
+// channelEnd returns the end of the channel URL at the current position, or the current position when there is none
+func (p *condParser) channelEnd() int {
+	rest := p.rest()
+	end := strings.IndexFunc(rest, func(r rune) bool { return r == '?' || unicode.IsSpace(r) })
+	if end < 0 {
+		end = len(rest)
+	}
+	if strings.HasPrefix(rest, "/channels/") || strings.Contains(rest[:end], "://") {
+		return p.pos + end
+	}
+	return p.pos
+}
+
+// parseQualifiers parses the qualifiers following the channel URL in route IDs, like `?param=payload` and `?format=xml`.
+// A qualifier followed by anything other than `?`, a space or the end is parsed as the query instead, like `?format=xml&action=opened` on the body field.
+func (p *condParser) parseQualifiers(c *RouteCondition) error {
+	for _, q := range []string{paramQualifier, formatQualifier} {
+		prefix := fmt.Sprintf("?%s=", q)
+		if !strings.HasPrefix(p.rest(), prefix) {
+			continue
+		}
+		rest := p.rest()[len(prefix):]
+		end := strings.IndexFunc(rest, func(r rune) bool { return strings.ContainsRune("?&|()!", r) || unicode.IsSpace(r) })
+		if end < 0 {
+			end = len(rest)
+		}
+		if end < len(rest) && rest[end] != '?' && !unicode.IsSpace(rune(rest[end])) {
+			return nil
+		}
+		p.pos += len(prefix)
+		v, err := url.QueryUnescape(rest[:end])
+		if err != nil {
+			return p.errorf("%v", err)
+		}
+		if v == "" {
+			return p.errorf("expected %s", q)
+		}
+		p.pos += end
+		if q == paramQualifier {
+			c.FormParameterName = v
+		} else {
+			c.BodyFormat = BodyFormat(v)
+		}
+	}
+	return nil
+}
+
+// parseQuery parses the query form, in which `&` binds tighter than `|`
+func (p *condParser) parseQuery() (BoolExpr, error) {
+	return p.parseBinary(BoolOr, "|", func() (BoolExpr, error) {
+		return p.parseBinary(BoolAnd, "&", p.parseQueryUnary)
+	})
+}
+
+func (p *condParser) parseQueryUnary() (BoolExpr, error) {
+	if p.consume("!") {
+		arg, err := p.parseQueryUnary()
+		if err != nil {
+			return BoolExpr{}, err
+		}
+		return BoolExpr{Op: BoolNot, Args: []BoolExpr{arg}}, nil
+	}
+	if p.consume("(") {
+		b, err := p.parseQuery()
+		if err != nil {
+			return BoolExpr{}, err
+		}
+		if !p.consume(")") {
+			return BoolExpr{}, p.errorf("expected \")\"")
+		}
+		return b, nil
+	}
+	return p.parseQueryTerm()
+}
+
+// parseQueryTerm parses a term like `foo.bar=1`, `pull_request.number[gt]=100`, `action[in]=opened,reopened` or `label[exists]`
+func (p *condParser) parseQueryTerm() (BoolExpr, error) {
+	start := p.pos
+	if p.consumeAll() {
+		return BoolExpr{Expr: &Expr{All: true}}, nil
+	}
+	key := p.scanPath(func(c byte) bool { return !strings.ContainsRune("[=&|()!", rune(c)) })
+	source, path, err := p.parsePath(key, start)
+	if err != nil {
+		return BoolExpr{}, err
+	}
+	e := Expr{Source: source, Path: path}
+	if p.consume("[") {
+		opPos := p.pos
+		op := Operator(p.scan(func(c byte) bool { return c != ']' }))
+		if !p.consume("]") {
+			return BoolExpr{}, p.errorf("expected \"]\"")
+		}
+		if _, ok := operatorSymbols[op]; (!ok && op != OpExists) || op == OpEq {
+			p.pos = opPos
+			return BoolExpr{}, p.errorf("unknown operator %q", op)
+		}
+		e.Op = op
+	}
+	if e.Op != OpExists {
+		if !p.consume("=") {
+			return BoolExpr{}, p.errorf("expected \"=\"")
+		}
+		raw := p.scan(func(c byte) bool { return !strings.ContainsRune("&|)", rune(c)) })
+		values := []string{raw}
+		if e.Op == OpIn {
+			values = strings.Split(raw, ",")
+		}
+		for _, v := range values {
+			unescaped, err := url.QueryUnescape(v)
+			if err != nil {
+				return BoolExpr{}, p.errorf("invalid value %q: %v", v, err)
+			}
+			if err := setValue(&e, unescaped); err != nil {
+				return BoolExpr{}, p.errorf("%v", err)
+			}
+		}
+	}
+	return p.leaf(e, start)
+}
+
+// setValue sets the value of the expression. Quoted values are always strings
+func setValue(e *Expr, v string) error {
+	if strings.HasPrefix(v, `"`) {
+		s, err := strconv.Unquote(v)
+		if err != nil {
+			return fmt.Errorf("invalid string %s: %v", v, err)
+		}
+		setString(e, s)
+		return nil
+	}
+	if i, err := strconv.Atoi(v); err == nil {
+		setInt(e, i)
+		return nil
+	}
+	setString(e, v)
+	return nil
+}
+
+func setString(e *Expr, s string) {
+	if e.Op == OpIn {
+		e.Strings = append(e.Strings, s)
+	} else {
+		e.String = &s
+	}
+}
+
+func setInt(e *Expr, i int) {
+	if e.Op == OpIn {
+		e.Ints = append(e.Ints, i)
+	} else {
+		e.Int = &i
+	}
+}
+
+// parseExpression parses the expression form, in which `&&` binds tighter than `||`
+func (p *condParser) parseExpression() (BoolExpr, error) {
+	return p.parseBinary(BoolOr, "||", func() (BoolExpr, error) {
+		return p.parseBinary(BoolAnd, "&&", p.parseUnary)
+	})
+}
+
+func (p *condParser) parseBinary(op BoolOp, sep string, parseArg func() (BoolExpr, error)) (BoolExpr, error) {
+	first, err := parseArg()
+	if err != nil {
+		return BoolExpr{}, err
+	}
+	args := []BoolExpr{first}
+	for {
+		p.skipSpaces()
+		if !p.consume(sep) {
+			break
+		}
+		a, err := parseArg()
+		if err != nil {
+			return BoolExpr{}, err
+		}
+		args = append(args, a)
+	}
+	if len(args) == 1 {
+		return first, nil
+	}
+	return BoolExpr{Op: op, Args: args}, nil
+}
+
+func (p *condParser) parseUnary() (BoolExpr, error) {
+	p.skipSpaces()
+	if p.eof() {
+		return BoolExpr{}, p.errorf("unexpected end of condition")
+	}
+	if strings.HasPrefix(p.rest(), "!") && !strings.HasPrefix(p.rest(), "!=") {
+		p.pos++
+		arg, err := p.parseUnary()
+		if err != nil {
+			return BoolExpr{}, err
+		}
+		return BoolExpr{Op: BoolNot, Args: []BoolExpr{arg}}, nil
+	}
+	if p.consume("(") {
+		b, err := p.parseExpression()
+		if err != nil {
+			return BoolExpr{}, err
+		}
+		p.skipSpaces()
+		if !p.consume(")") {
+			return BoolExpr{}, p.errorf("expected \")\"")
+		}
+		return b, nil
+	}
+	return p.parseComparison()
+}
+
+// expressionOperators are the operators of the expression form, longest first so that `>=` is not parsed as `>`
+var expressionOperators = []struct {
+	symbol string
+	op     Operator
+}{
+	{"==", OpEq},
+	{"!=", OpNe},
+	{">=", OpGe},
+	{"<=", OpLe},
+	{"^=", OpPrefix},
+	{"=~", OpRegex},
+	{"=", OpEq},
+	{">", OpGt},
+	{"<", OpLt},
+}
+
+// parseComparison parses an expression like `foo.bar == 1`, `action in ["opened", "reopened"]`, `exists(label)` or `*`
+func (p *condParser) parseComparison() (BoolExpr, error) {
+	start := p.pos
+	if p.consumeAll() {
+		return BoolExpr{Expr: &Expr{All: true}}, nil
+	}
+	word := p.scanPath(isWordChar)
+	if word == "" {
+		return BoolExpr{}, p.errorf("expected path")
+	}
+	p.skipSpaces()
+	if word == "exists" && p.consume("(") {
+		p.skipSpaces()
+		pathPos := p.pos
+		source, path, err := p.parsePath(p.scanPath(isWordChar), pathPos)
+		if err != nil {
+			return BoolExpr{}, err
+		}
+		p.skipSpaces()
+		if !p.consume(")") {
+			return BoolExpr{}, p.errorf("expected \")\"")
+		}
+		return p.leaf(Expr{Source: source, Path: path, Op: OpExists}, start)
+	}
+	source, path, err := p.parsePath(word, start)
+	if err != nil {
+		return BoolExpr{}, err
+	}
+	e := Expr{Source: source, Path: path}
+
+	if p.consume("in") {
+		e.Op = OpIn
+		p.skipSpaces()
+		if !p.consume("[") {
+			return BoolExpr{}, p.errorf("expected \"[\"")
+		}
+		for {
+			if err := p.parseValue(&e); err != nil {
+				return BoolExpr{}, err
+			}
+			p.skipSpaces()
+			if p.consume("]") {
+				break
+			}
+			if !p.consume(",") {
+				return BoolExpr{}, p.errorf("expected \",\" or \"]\"")
+			}
+		}
+		return p.leaf(e, start)
+	}
+
+	found := false
+	for _, o := range expressionOperators {
+		if p.consume(o.symbol) {
+			e.Op = o.op
+			found = true
+			break
+		}
+	}
+	if !found {
+		return BoolExpr{}, p.errorf("expected operator")
+	}
+	p.skipSpaces()
+	if e.Op == OpEq && p.consume("*") {
+		e.All = true
+		return BoolExpr{Expr: &e}, nil
+	}
+	if err := p.parseValue(&e); err != nil {
+		return BoolExpr{}, err
+	}
+	return p.leaf(e, start)
+}
+
+// parsePath splits the path into its source and elements, like `header.X-GitHub-Event` or `body.foo.bar`.
+// Paths without sources are body paths, and header names are canonicalized.
+func (p *condParser) parsePath(word string, pos int) (Source, []string, error) {
+	if word == "" {
+		return SourceBody, nil, p.errorf("expected path")
+	}
+	source := SourceBody
+	path, err := ParsePath(word)
+	if err != nil {
+		p.pos = pos
+		return source, nil, p.errorf("%v", err)
+	}
+	switch path[0] {
+	case "body":
+		path = path[1:]
+	case string(SourceHeader), string(SourceQuery):
+		source = Source(path[0])
+		path = path[1:]
+		if len(path) != 1 || path[0] == "" {
+			p.pos = pos
+			return source, nil, p.errorf("expected %s name in %q", source, word)
+		}
+		if source == SourceHeader {
+			path[0] = http.CanonicalHeaderKey(path[0])
+		}
+	case string(SourceMethod):
+		if len(path) != 1 {
+			p.pos = pos
+			return SourceMethod, nil, p.errorf("invalid path %q: method has no path", word)
+		}
+		return SourceMethod, []string{}, nil
+	}
+	for _, elem := range path {
+		if elem == "" {
+			p.pos = pos
+			return source, nil, p.errorf("invalid path %q", word)
+		}
+	}
+	if len(path) == 0 {
+		p.pos = pos
+		return source, nil, p.errorf("missing path after %q", word)
+	}
+	return source, path, nil
+}
+
+// parseValue parses a quoted string, or an unquoted word that is an integer when it looks like one
+func (p *condParser) parseValue(e *Expr) error {
+	p.skipSpaces()
+	start := p.pos
+	if strings.HasPrefix(p.rest(), `"`) {
+		end := p.pos + 1
+		for end < len(p.input) && p.input[end] != '"' {
+			if p.input[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(p.input) {
+			return p.errorf("unterminated string")
+		}
+		p.pos = end + 1
+		s, err := strconv.Unquote(p.input[start:p.pos])
+		if err != nil {
+			p.pos = start
+			return p.errorf("invalid string %s: %v", p.input[start:end+1], err)
+		}
+		setString(e, s)
+		return nil
+	}
+	word := p.scanWord()
+	if word == "" {
+		return p.errorf("expected value")
+	}
+	return setValue(e, word)
+}
+
+func (p *condParser) leaf(e Expr, pos int) (BoolExpr, error) {
+	if err := e.Validate(); err != nil {
+		p.pos = pos
+		return BoolExpr{}, p.errorf("%v", err)
+	}
+	return BoolExpr{Expr: &e}, nil
+}
+
+func (p *condParser) scanWord() string {
+	return p.scan(isWordChar)
+}
+
+func isWordChar(c byte) bool {
+	return !unicode.IsSpace(rune(c)) && !strings.ContainsRune(`()[],&|!=<>^~"`, rune(c))
+}
+
+// scanPath scans the path made of the word chars and array indices like `commits[*].modified` or `labels[0]`
+func (p *condParser) scanPath(f func(c byte) bool) string {
+	start := p.pos
+	for {
+		p.scan(f)
+		rest := p.rest()
+		end := strings.Index(rest, "]")
+		if !strings.HasPrefix(rest, "[") || end < 0 || !isIndexElement(rest[:end+1]) {
+			break
+		}
+		p.pos += end + 1
+	}
+	return p.input[start:p.pos]
+}
+
+// consumeAll consumes `*` that matches all the events, which is not the start of the path beginning with `**`
+func (p *condParser) consumeAll() bool {
+	if strings.HasPrefix(p.rest(), PathDescendants) {
+		return false
+	}
+	return p.consume("*")
+}
+
+func (p *condParser) scan(f func(c byte) bool) string {
+	start := p.pos
+	for !p.eof() && f(p.input[p.pos]) {
+		p.pos++
+	}
+	return p.input[start:p.pos]
+}
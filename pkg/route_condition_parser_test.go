@@ -0,0 +1,167 @@
+package diplomat
+
+import (
+	"testing"
+
+	"github.com/mumoshu/diplomat/pkg/api"
+)
+
+func TestParseCondition(t *testing.T) {
+	testcases := []struct {
+		input string
+		id    RouteConditionID
+		exprs int
+		bool  bool
+	}{
+		{
+			input: `http://example.com/webhook`,
+			id:    `http://example.com/webhook`,
+			exprs: 1,
+		},
+		{
+			input: `http://example.com/webhook?action=opened&pull_request.base.ref=main`,
+			id:    `http://example.com/webhook?action=opened&pull_request.base.ref=main`,
+			exprs: 2,
+		},
+		{
+			input: `http://example.com/webhook header.X-GitHub-Event == "push" && body.foo.bar == 1`,
+			id:    `http://example.com/webhook?foo.bar=1&header.X-Github-Event=push`,
+			exprs: 2,
+		},
+		{
+			input: `http://example.com/webhook action in ["opened", "reopened"] && ref ^= "refs/tags/"`,
+			id:    `http://example.com/webhook?action[in]=opened,reopened&ref[prefix]=refs%2Ftags%2F`,
+			exprs: 2,
+		},
+		{
+			input: `http://example.com/webhook commits[*].modified == "README.md"`,
+			id:    `http://example.com/webhook?commits[*].modified=README%2Emd`,
+			exprs: 1,
+		},
+		{
+			input: `http://example.com/webhook action == "opened" && !(sender.type == "Bot")`,
+			id:    `http://example.com/webhook?!sender.type=Bot&action=opened`,
+			bool:  true,
+		},
+		{
+			input: `http://example.com/webhook exists(label) && !exists(draft)`,
+			id:    `http://example.com/webhook?!draft[exists]&label[exists]`,
+			bool:  true,
+		},
+		{
+			input: `http://example.com/webhook action == "opened" && (sender.login == "a" || sender.login == "b")`,
+			id:    `http://example.com/webhook?action=opened&(sender.login=a|sender.login=b)`,
+			bool:  true,
+		},
+		{
+			input: `http://example.com/webhook !(action == "opened" && number > 1) && exists(label)`,
+			id:    `http://example.com/webhook?!(action=opened&number[gt]=1)&label[exists]`,
+			bool:  true,
+		},
+		{
+			input: `http://example.com/webhook?!(!action=opened)&label[exists]`,
+			id:    `http://example.com/webhook?action=opened&label[exists]`,
+			exprs: 2,
+		},
+		{
+			input: `http://example.com/webhook?fallback`,
+			id:    `http://example.com/webhook?fallback`,
+		},
+		{
+			input: `http://example.com/webhook?param=payload?type=block_actions`,
+			id:    `http://example.com/webhook?param=payload?type=block_actions`,
+			exprs: 1,
+		},
+		{
+			input: `http://example.com/webhook?param=payload type == "block_actions"`,
+			id:    `http://example.com/webhook?param=payload?type=block_actions`,
+			exprs: 1,
+		},
+		{
+			input: `http://example.com/webhook?format=xml`,
+			id:    `http://example.com/webhook?format=xml`,
+			exprs: 1,
+		},
+		{
+			input: `http://example.com/webhook?format=xml&action=opened`,
+			id:    `http://example.com/webhook?action=opened&body.format=xml`,
+			exprs: 2,
+		},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+		t.Run(tc.input, func(t *testing.T) {
+			c, err := ParseCondition(tc.input)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if c.ID() != tc.id {
+				t.Errorf("unexpected id: want %s, got %s", tc.id, c.ID())
+			}
+			if len(c.Expressions) != tc.exprs || (c.Bool != nil) != tc.bool {
+				t.Errorf("unexpected condition: want %d expressions and bool %v, got %d and %v", tc.exprs, tc.bool, len(c.Expressions), c.Bool != nil)
+			}
+
+			parsed, err := ParseCondition(string(c.ID()))
+			if err != nil {
+				t.Fatalf("unable to parse id %s: %v", c.ID(), err)
+			}
+			if parsed.ID() != c.ID() {
+				t.Errorf("id did not round-trip: want %s, got %s", c.ID(), parsed.ID())
+			}
+		})
+	}
+}
+
+func TestParseConditionErrors(t *testing.T) {
+	testcases := []struct {
+		input string
+		pos   int
+	}{
+		{input: `http://example.com/webhook action == `, pos: 38},
+		{input: `http://example.com/webhook (action == "opened"`, pos: 47},
+		{input: `http://example.com/webhook action == "opened" && !label`, pos: 56},
+		{input: `http://example.com/webhook?a[foo]=1`, pos: 30},
+		{input: `http://example.com/webhook?fallback&a=1`, pos: 36},
+		{input: `http://example.com/webhook?format=%zz`, pos: 35},
+		{input: `http://example.com/webhook?param=?a=1`, pos: 34},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+		t.Run(tc.input, func(t *testing.T) {
+			_, err := ParseCondition(tc.input)
+			syntaxErr, ok := err.(*ConditionSyntaxError)
+			if !ok {
+				t.Fatalf("unexpected error: want a syntax error, got %v", err)
+			}
+			if syntaxErr.Pos != tc.pos {
+				t.Errorf("unexpected position: want %d, got %d: %v", tc.pos, syntaxErr.Pos, err)
+			}
+		})
+	}
+}
+
+func TestCondBuilderParse(t *testing.T) {
+	ch, err := api.ParseChannelRef("http://example.com/webhook")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := On(ch).Parse(`action == "opened" && !(sender.type == "Bot")`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := RouteConditionID(`http://example.com/webhook?!sender.type=Bot&action=opened`); c.ID() != want {
+		t.Errorf("unexpected id: want %s, got %s", want, c.ID())
+	}
+
+	c, err = On(ch).Where("repository", "full_name").EqString("foo/bar").And().Parse(`action == "opened" || action == "reopened"`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := RouteConditionID(`http://example.com/webhook?(action=opened|action=reopened)&repository.full_name=foo%2Fbar`); c.ID() != want {
+		t.Errorf("unexpected id: want %s, got %s", want, c.ID())
+	}
+}
@@ -0,0 +1,293 @@
+package diplomat
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type BoolOp string
+
+const (
+	BoolAnd BoolOp = "and"
+	BoolOr  BoolOp = "or"
+	BoolNot BoolOp = "not"
+)
+
+// BoolExpr is a boolean expression tree over route expressions.
+// A leaf has the Expr and no Op. `and` and `or` have two or more Args, and `not` has exactly one.
+type BoolExpr struct {
+	Op   BoolOp
+	Expr *Expr
+	Args []BoolExpr
+}
+
+// Any matches when any of the conditions match, like:
+//
+//   Any(On(ch).Where("action").EqString("opened"), On(ch).Where("action").EqString("synchronize"))
+//
+// All the conditions must be on the same channel.
+func Any(conds ...RouteCondition) RouteCondition {
+	return combine(BoolOr, conds)
+}
+
+// AllOf matches when all the conditions match.
+// It is named so because `All` is already taken by CondBuilder for the condition that matches all the events.
+func AllOf(conds ...RouteCondition) RouteCondition {
+	return combine(BoolAnd, conds)
+}
+
+// Not matches when the condition does not match, including when the paths of its expressions are missing in the event
+func Not(cond RouteCondition) RouteCondition {
+	return combine(BoolNot, []RouteCondition{cond})
+}
+
+func combine(op BoolOp, conds []RouteCondition) RouteCondition {
+	if len(conds) == 0 {
+		panic(fmt.Errorf("%s: at least one condition is required", op))
+	}
+	c := RouteCondition{
+		Channel:           conds[0].Channel,
+		FormParameterName: conds[0].FormParameterName,
+		BodyFormat:        conds[0].BodyFormat,
+	}
+	args := []BoolExpr{}
+	for _, cond := range conds {
+		if cond.Channel != c.Channel || cond.FormParameterName != c.FormParameterName || cond.BodyFormat != c.BodyFormat {
+			panic(fmt.Errorf("%s: conditions on different channels can not be combined: %s and %s", op, c.ID(), cond.ID()))
+		}
+		args = append(args, cond.boolExpr())
+	}
+	b := BoolExpr{Op: op, Args: args}.normalize()
+	c.Bool = &b
+	return c
+}
+
+// boolExpr returns the canonical form of the whole condition, which is the conjunction of the expressions and the boolean expression
+func (m RouteCondition) boolExpr() BoolExpr {
+	args := []BoolExpr{}
+	for i := range m.Expressions {
+		e := m.Expressions[i]
+		args = append(args, BoolExpr{Expr: &e})
+	}
+	if m.Bool != nil {
+		args = append(args, *m.Bool)
+	}
+	return BoolExpr{Op: BoolAnd, Args: args}.normalize()
+}
+
+// normalize returns the canonical form of the expression, so that equivalent trees are rendered to the same route condition ID.
+// Nested `and`s and `or`s are flattened, duplicated args are removed and args are sorted by their rendered forms.
+// Double negations are removed, and `and`s and `or`s of one arg are replaced with the arg.
+func (b BoolExpr) normalize() BoolExpr {
+	switch b.Op {
+	case BoolNot:
+		if len(b.Args) != 1 {
+			return b
+		}
+		arg := b.Args[0].normalize()
+		if arg.Op == BoolNot && len(arg.Args) == 1 {
+			return arg.Args[0]
+		}
+		return BoolExpr{Op: BoolNot, Args: []BoolExpr{arg}}
+	case BoolAnd, BoolOr:
+		flattened := []BoolExpr{}
+		for _, a := range b.Args {
+			a = a.normalize()
+			if a.Op == b.Op {
+				flattened = append(flattened, a.Args...)
+			} else if !(a.Op == BoolAnd && len(a.Args) == 0) {
+				flattened = append(flattened, a)
+			}
+		}
+		// Matching all the events AND something is the same as matching the something
+		if b.Op == BoolAnd && len(flattened) > 1 {
+			withoutAll := []BoolExpr{}
+			for _, a := range flattened {
+				if !a.isAll() {
+					withoutAll = append(withoutAll, a)
+				}
+			}
+			if len(withoutAll) > 0 {
+				flattened = withoutAll
+			}
+		}
+		seen := map[string]bool{}
+		args := []BoolExpr{}
+		for _, a := range flattened {
+			r := a.render()
+			if !seen[r] {
+				seen[r] = true
+				args = append(args, a)
+			}
+		}
+		sort.SliceStable(args, func(i, j int) bool {
+			return args[i].render() < args[j].render()
+		})
+		if len(args) == 1 {
+			return args[0]
+		}
+		return BoolExpr{Op: b.Op, Args: args}
+	}
+	return b
+}
+
+func (b BoolExpr) isAll() bool {
+	return b.Op == "" && b.Expr != nil && b.Expr.All
+}
+
+// render returns the expression in the URL query form used in route condition IDs, like `(action=opened|action=synchronize)&!(sender.type=Bot)`
+func (b BoolExpr) render() string {
+	switch b.Op {
+	case "":
+		if b.Expr == nil {
+			return ""
+		}
+		if b.Expr.All {
+			return "*"
+		}
+		return b.Expr.term()
+	case BoolNot:
+		if len(b.Args) != 1 {
+			return ""
+		}
+		return "!" + b.Args[0].renderArg()
+	}
+	sep := "&"
+	if b.Op == BoolOr {
+		sep = "|"
+	}
+	parts := []string{}
+	for _, a := range b.Args {
+		parts = append(parts, a.renderArg())
+	}
+	return strings.Join(parts, sep)
+}
+
+func (b BoolExpr) renderArg() string {
+	if b.Op == "" || b.Op == BoolNot {
+		return b.render()
+	}
+	return "(" + b.render() + ")"
+}
+
+// Format returns the human-readable form of the expression, like `(action == "opened" || action == "synchronize") && !(sender.type == "Bot")`
+func (b BoolExpr) Format() string {
+	switch b.Op {
+	case "":
+		if b.Expr == nil {
+			return ""
+		}
+		return b.Expr.Format()
+	case BoolNot:
+		if len(b.Args) != 1 {
+			return ""
+		}
+		return "!(" + b.Args[0].Format() + ")"
+	}
+	sep := " && "
+	if b.Op == BoolOr {
+		sep = " || "
+	}
+	parts := []string{}
+	for _, a := range b.Args {
+		if a.Op == BoolAnd || a.Op == BoolOr {
+			parts = append(parts, "("+a.Format()+")")
+		} else {
+			parts = append(parts, a.Format())
+		}
+	}
+	return strings.Join(parts, sep)
+}
+
+func (b BoolExpr) Validate() error {
+	switch b.Op {
+	case "":
+		if b.Expr == nil {
+			return fmt.Errorf("missing expression")
+		}
+		return b.Expr.Validate()
+	case BoolNot:
+		if len(b.Args) != 1 {
+			return fmt.Errorf("%s requires exactly one arg, but got %d", b.Op, len(b.Args))
+		}
+	case BoolAnd, BoolOr:
+	default:
+		return fmt.Errorf("unknown boolean operator %q", b.Op)
+	}
+	for _, a := range b.Args {
+		if err := a.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// leaves returns the distinct expressions of the tree in the order of their first appearance
+func (b BoolExpr) leaves() []Expr {
+	leaves := []Expr{}
+	seen := map[string]bool{}
+	b.walk(func(e Expr) {
+		r := BoolExpr{Expr: &e}.render()
+		if !seen[r] {
+			seen[r] = true
+			leaves = append(leaves, e)
+		}
+	})
+	return leaves
+}
+
+func (b BoolExpr) walk(f func(Expr)) {
+	if b.Op == "" {
+		if b.Expr != nil {
+			f(*b.Expr)
+		}
+		return
+	}
+	for _, a := range b.Args {
+		a.walk(f)
+	}
+}
+
+// compiledCondition is a boolean expression whose leaves are replaced with the indices of the route's distinct expressions
+type compiledCondition struct {
+	op   BoolOp
+	leaf int
+	args []*compiledCondition
+}
+
+func compileCondition(b BoolExpr, leafIndices map[string]int) *compiledCondition {
+	if b.Op == "" {
+		return &compiledCondition{leaf: leafIndices[b.render()]}
+	}
+	c := &compiledCondition{op: b.Op}
+	for _, a := range b.Args {
+		c.args = append(c.args, compileCondition(a, leafIndices))
+	}
+	return c
+}
+
+// eval reports whether the condition is satisfied given the indices of the matched expressions.
+// An `and` without args, which is the condition without any expression, is never satisfied.
+func (c *compiledCondition) eval(matched map[int]bool) bool {
+	switch c.op {
+	case "":
+		return matched[c.leaf]
+	case BoolNot:
+		return !c.args[0].eval(matched)
+	case BoolAnd:
+		for _, a := range c.args {
+			if !a.eval(matched) {
+				return false
+			}
+		}
+		return len(c.args) > 0
+	case BoolOr:
+		for _, a := range c.args {
+			if a.eval(matched) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,115 @@
+package diplomat
+
+import (
+	"testing"
+)
+
+func TestCompiledConditionEval(t *testing.T) {
+	on := OnURL(testChannel)
+	a := on.Where("a").EqInt(1)
+	b := on.Where("b").EqInt(1)
+	c := on.Where("c").EqInt(1)
+
+	testcases := []struct {
+		name string
+		cond RouteCondition
+		// matched are the expressions that matched the event, like `a == 1`
+		matched []string
+		want    bool
+	}{
+		{name: "or of none", cond: Any(a, b)},
+		{name: "or of all", cond: Any(a, b), matched: []string{"a == 1", "b == 1"}, want: true},
+		{name: "not of none", cond: Not(a), want: true},
+		{name: "not of an and partially matched", cond: Not(AllOf(a, b)), matched: []string{"a == 1"}, want: true},
+		{name: "not of an or partially matched", cond: Not(Any(a, b)), matched: []string{"b == 1"}},
+		{name: "or of nots of all", cond: Any(Not(a), Not(b)), matched: []string{"a == 1", "b == 1"}},
+		{name: "and of an or and a not", cond: AllOf(Any(a, b), Not(c)), matched: []string{"b == 1"}, want: true},
+		{name: "and of an or and a not of the match", cond: AllOf(Any(a, b), Not(c)), matched: []string{"b == 1", "c == 1"}},
+		// a is shared by both ors, so it is one leaf that satisfies both of them
+		{name: "shared leaf", cond: AllOf(Any(a, b), Any(a, c)), matched: []string{"a == 1"}, want: true},
+		{name: "shared leaf negated", cond: AllOf(Any(a, b), Not(a)), matched: []string{"a == 1"}},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			e := newRouteEntry(&Route{RouteCondition: tc.cond})
+			matched := map[int]bool{}
+			for _, m := range tc.matched {
+				found := false
+				for leaf, l := range e.leaves {
+					if l.Format() == m {
+						matched[leaf] = true
+						found = true
+					}
+				}
+				if !found {
+					t.Fatalf("unexpected leaves of %s: want %s, got %v", tc.cond.ID(), m, e.leaves)
+				}
+			}
+			if got := e.cond.eval(matched); got != tc.want {
+				t.Errorf("unexpected result of %s: want %v, got %v", tc.cond.ID(), tc.want, got)
+			}
+		})
+	}
+
+	if e := newRouteEntry(&Route{RouteCondition: RouteCondition{Channel: a.Channel}}); e.cond.eval(map[int]bool{}) {
+		t.Errorf("unexpected match of the condition without expressions")
+	}
+}
+
+// TestBoolExprMatchesMissingPaths checks that the negations match the events without any of the route's paths,
+// which the index finds no matcher for
+func TestBoolExprMatchesMissingPaths(t *testing.T) {
+	on := OnURL(testChannel)
+	opened := on.Where("action").EqString("opened")
+	bot := on.Where("sender", "type").EqString("Bot")
+
+	testcases := []struct {
+		name string
+		cond RouteCondition
+		want bool
+	}{
+		{name: "not", cond: Not(opened), want: true},
+		{name: "or of nots", cond: Any(Not(opened), Not(bot)), want: true},
+		{name: "and of nots", cond: AllOf(Not(opened), Not(bot)), want: true},
+		{name: "and of a not and a match", cond: AllOf(Not(opened), bot)},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			if got := routeMatches(t, tc.cond, jsonEvent(`{"number":1}`)); got != tc.want {
+				t.Errorf("unexpected match of %s: want %v, got %v", tc.cond.ID(), tc.want, got)
+			}
+		})
+	}
+}
+
+func TestBoolExprNormalize(t *testing.T) {
+	on := OnURL(testChannel)
+	opened := on.Where("action").EqString("opened")
+	synchronized := on.Where("action").EqString("synchronize")
+	bot := on.Where("sender", "type").EqString("Bot")
+
+	testcases := []struct {
+		name string
+		cond RouteCondition
+		same RouteCondition
+	}{
+		{name: "double negation", cond: Not(Not(opened)), same: opened},
+		{name: "order of the args", cond: Any(opened, synchronized), same: Any(synchronized, opened)},
+		{name: "nested ors", cond: Any(opened, Any(synchronized, bot)), same: Any(Any(opened, synchronized), bot)},
+		{name: "duplicated args", cond: Any(opened, opened, synchronized), same: Any(opened, synchronized)},
+		{name: "one arg", cond: AllOf(opened), same: opened},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.cond.ID() != tc.same.ID() {
+				t.Errorf("unexpected id: want %s, got %s", tc.same.ID(), tc.cond.ID())
+			}
+		})
+	}
+}
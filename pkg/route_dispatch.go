@@ -0,0 +1,62 @@
+package diplomat
+
+import (
+	"fmt"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+// Dispatch is how an event is delivered to the procedures of a route when more than one callee is registered to it.
+// The callees of a route share the registration of its receiver name, using the invocation policy of the dispatch.
+type Dispatch string
+
+const (
+	// DispatchSingle allows only one callee. Events matching a route with more than one callee fail with ErrAmbiguousRoute
+	DispatchSingle Dispatch = ""
+	// DispatchFailover calls the callees one by one in the order they registered, until any of them succeeds
+	DispatchFailover Dispatch = "failover"
+	// DispatchRoundRobin calls one of the callees in turn
+	DispatchRoundRobin Dispatch = "roundrobin"
+	// DispatchRandom calls one of the callees chosen randomly
+	DispatchRandom Dispatch = "random"
+	// DispatchFanOut calls all the callees and responds with the JSON array of the bodies of their responses
+	DispatchFanOut Dispatch = "fanout"
+)
+
+// invokePolicy returns the WAMP invocation policy that the callees register the procedure with.
+// Failover and fan-out share the procedure in turn, as the server calls their callee procedures instead.
+func (d Dispatch) invokePolicy() string {
+	switch d {
+	case DispatchRandom:
+		return wamp.InvokeRandom
+	case DispatchRoundRobin, DispatchFailover, DispatchFanOut:
+		return wamp.InvokeRoundRobin
+	}
+	return wamp.InvokeSingle
+}
+
+// callsEachCallee reports whether the server calls the callees explicitly by the procedures they register each for themselves
+func (d Dispatch) callsEachCallee() bool {
+	return d == DispatchFailover || d == DispatchFanOut
+}
+
+// registerOptions returns the options that the callees register the procedure of the route with
+func (d Dispatch) registerOptions() wamp.Dict {
+	return wamp.Dict{wamp.OptInvoke: d.invokePolicy()}
+}
+
+// Validate returns an error when the dispatch is unknown
+func (d Dispatch) Validate() error {
+	switch d {
+	case DispatchSingle, DispatchFailover, DispatchRoundRobin, DispatchRandom, DispatchFanOut:
+		return nil
+	}
+	return fmt.Errorf("unknown dispatch %q", d)
+}
+
+func (d Dispatch) String() string {
+	if d == DispatchSingle {
+		return "single"
+	}
+	return string(d)
+}
@@ -0,0 +1,207 @@
+package diplomat
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Source is the part of the event that an expression is evaluated against.
+// The zero value is the body.
+type Source string
+
+const (
+	SourceBody Source = ""
+	// SourceHeader evaluates the expression against the first value of the header named by the only element of the path
+	SourceHeader Source = "header"
+	// SourceQuery evaluates the expression against the first value of the query parameter named by the only element of the path
+	SourceQuery Source = "query"
+	// SourceMethod evaluates the expression against the HTTP method. The path is empty
+	SourceMethod Source = "method"
+)
+
+func isSource(name string) bool {
+	switch Source(name) {
+	case SourceHeader, SourceQuery, SourceMethod:
+		return true
+	}
+	return false
+}
+
+// Operator is the comparison that an expression applies to the value at its path.
+// The zero value compares for equality.
+type Operator string
+
+const (
+	OpEq     Operator = ""
+	OpNe     Operator = "ne"
+	OpGt     Operator = "gt"
+	OpGe     Operator = "ge"
+	OpLt     Operator = "lt"
+	OpLe     Operator = "le"
+	OpIn     Operator = "in"
+	OpPrefix Operator = "prefix"
+	OpRegex  Operator = "regex"
+	OpExists Operator = "exists"
+)
+
+var operatorSymbols = map[Operator]string{
+	OpEq:     "==",
+	OpNe:     "!=",
+	OpGt:     ">",
+	OpGe:     ">=",
+	OpLt:     "<",
+	OpLe:     "<=",
+	OpIn:     "in",
+	OpPrefix: "^=",
+	OpRegex:  "=~",
+}
+
+func (e Expr) Validate() error {
+	if e.All {
+		return nil
+	}
+	path := e.path()
+	switch e.Source {
+	case SourceBody:
+		if err := validatePath(e.Path); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	case SourceHeader, SourceQuery:
+		if len(e.Path) != 1 {
+			return fmt.Errorf("%s: %s expressions require exactly one name", path, e.Source)
+		}
+	case SourceMethod:
+		if len(e.Path) != 0 {
+			return fmt.Errorf("%s: method expressions can not have paths", path)
+		}
+	default:
+		return fmt.Errorf("%s: unknown source %q", path, e.Source)
+	}
+	switch e.Op {
+	case OpEq, OpNe:
+		if e.String == nil && e.Int == nil {
+			return fmt.Errorf("%s: missing value to compare with", path)
+		}
+	case OpGt, OpGe, OpLt, OpLe:
+		if e.Int == nil {
+			return fmt.Errorf("%s: operator %q requires an integer", path, e.Op)
+		}
+	case OpIn:
+		if len(e.Strings) == 0 && len(e.Ints) == 0 {
+			return fmt.Errorf("%s: operator %q requires at least one value", path, e.Op)
+		}
+	case OpPrefix:
+		if e.String == nil {
+			return fmt.Errorf("%s: operator %q requires a string", path, e.Op)
+		}
+	case OpRegex:
+		if e.String == nil {
+			return fmt.Errorf("%s: operator %q requires a string", path, e.Op)
+		}
+		if _, err := regexp.Compile(*e.String); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	case OpExists:
+	default:
+		return fmt.Errorf("%s: unknown operator %q", path, e.Op)
+	}
+	return nil
+}
+
+// term returns the expression in the URL query form used in route condition IDs, like `foo.bar=1` or `pull_request.number[gt]=100`.
+// Values are query-escaped and the values of `in` are sorted, so that equivalent expressions always produce the same term.
+// Strings are quoted when they look like integers, so that ParseCondition parses the term back into the same expression.
+func (e Expr) term() string {
+	if e.All {
+		return ""
+	}
+	key := e.path()
+	if e.Op != OpEq {
+		key = fmt.Sprintf("%s[%s]", key, e.Op)
+	}
+	switch e.Op {
+	case OpExists:
+		return key
+	case OpIn:
+		vs := []string{}
+		for _, s := range e.Strings {
+			vs = append(vs, queryString(s))
+		}
+		for _, i := range e.Ints {
+			vs = append(vs, strconv.Itoa(i))
+		}
+		sort.Strings(vs)
+		return fmt.Sprintf("%s=%s", key, strings.Join(vs, ","))
+	}
+	var v string
+	if e.String != nil {
+		v = queryString(*e.String)
+	}
+	if e.Int != nil {
+		v = strconv.Itoa(*e.Int)
+	}
+	return fmt.Sprintf("%s=%s", key, v)
+}
+
+func queryString(s string) string {
+	if _, err := strconv.Atoi(s); err == nil || strings.HasPrefix(s, `"`) {
+		s = strconv.Quote(s)
+	}
+	return escapeQueryValue(s)
+}
+
+// escapeQueryValue query-escapes the value and its dots, as the router rejects the receiver names with empty components like `v1.` or `a..b`
+func escapeQueryValue(s string) string {
+	return strings.Replace(url.QueryEscape(s), ".", "%2E", -1)
+}
+
+// path returns the path prefixed with the source, like `header.X-Github-Event` or `commits[*].modified`.
+// Body paths are prefixed only when they start with the name of a source or an ID qualifier, as ParseCondition would take it for the source or the qualifier otherwise.
+func (e Expr) path() string {
+	path := formatPath(e.Path)
+	switch {
+	case e.Source == SourceMethod:
+		return string(e.Source)
+	case e.Source != SourceBody:
+		return fmt.Sprintf("%s.%s", e.Source, path)
+	case len(e.Path) > 0 && (e.Path[0] == "body" || isSource(e.Path[0]) || isQualifier(e.Path[0])):
+		return "body." + path
+	}
+	return path
+}
+
+// Format returns the human-readable form of the expression, like `foo.bar == 1` or `action in ["opened", "reopened"]`
+func (e Expr) Format() string {
+	path := e.path()
+	if e.All {
+		if len(e.Path) == 0 {
+			return "*"
+		}
+		return fmt.Sprintf("%s == *", path)
+	}
+	switch e.Op {
+	case OpExists:
+		return fmt.Sprintf("exists(%s)", path)
+	case OpIn:
+		vs := []string{}
+		for _, s := range e.Strings {
+			vs = append(vs, strconv.Quote(s))
+		}
+		for _, i := range e.Ints {
+			vs = append(vs, strconv.Itoa(i))
+		}
+		return fmt.Sprintf("%s in [%s]", path, strings.Join(vs, ", "))
+	}
+	var v string
+	if e.String != nil {
+		v = strconv.Quote(*e.String)
+	}
+	if e.Int != nil {
+		v = strconv.Itoa(*e.Int)
+	}
+	return fmt.Sprintf("%s %s %s", path, operatorSymbols[e.Op], v)
+}
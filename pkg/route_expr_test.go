@@ -0,0 +1,127 @@
+package diplomat
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/valyala/fastjson"
+)
+
+const testChannel = "http://example.com/webhook"
+
+func jsonEvent(body string) Event {
+	return Event{Channel: testChannel, Body: []byte(body), Header: map[string][]string{"Content-Type": {"application/json"}}}
+}
+
+// routeMatches reports whether the event matches the only route of the server, which has the condition
+func routeMatches(t *testing.T, c RouteCondition, evt Event) bool {
+	t.Helper()
+	srv := NewServer(Server{})
+	if err := srv.StartRouting(RouteConfig{RouteCondition: c, Topic: true}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	matches, err := srv.SearchRouteMatchesEvent(evt)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, ok := matches[c.ID()]
+	return ok
+}
+
+func TestMatcherMatch(t *testing.T) {
+	on := OnURL(testChannel)
+	expr := func(c RouteCondition) Expr {
+		return c.boolExpr().leaves()[0]
+	}
+
+	testcases := []struct {
+		name string
+		expr Expr
+		// value is the JSON value at the path of the expression
+		value string
+		// stringValues is true for the values decoded from forms and XML, which are always strings
+		stringValues bool
+		want         bool
+	}{
+		{name: "eq int against the same float", expr: expr(on.Where("n").EqInt(1)), value: `1.0`},
+		{name: "eq int against a numeric string", expr: expr(on.Where("n").EqInt(1)), value: `"1"`},
+		{name: "eq int against a numeric string of a form", expr: expr(on.Where("n").EqInt(1)), value: `"1"`, stringValues: true, want: true},
+		{name: "eq int against a numeric header", expr: expr(on.Header("X-Count").EqInt(1)), value: `"1"`, want: true},
+		{name: "eq string is case sensitive", expr: expr(on.Where("s").EqString("a")), value: `"A"`},
+		{name: "eq empty string", expr: expr(on.Where("s").EqString("")), value: `""`, want: true},
+		{name: "eq empty string against null", expr: expr(on.Where("s").EqString("")), value: `null`},
+		{name: "ne string against null", expr: expr(on.Where("s").NeString("a")), value: `null`, want: true},
+		{name: "ne int against a numeric string", expr: expr(on.Where("n").NeInt(1)), value: `"1"`, want: true},
+		{name: "ne int against a numeric string of a form", expr: expr(on.Where("n").NeInt(1)), value: `"1"`, stringValues: true},
+		{name: "gt against a fraction", expr: expr(on.Where("n").Gt(1)), value: `1.0001`, want: true},
+		{name: "gt against an exponent", expr: expr(on.Where("n").Gt(100)), value: `1e3`, want: true},
+		{name: "ge against a negative", expr: expr(on.Where("n").Ge(-1)), value: `-1`, want: true},
+		{name: "lt against a non-numeric string of a form", expr: expr(on.Where("n").Lt(1)), value: `"zero"`, stringValues: true},
+		{name: "le against a bool", expr: expr(on.Where("n").Le(1)), value: `true`},
+		{name: "in strings against an int", expr: expr(on.Where("s").InString("1", "2")), value: `1`},
+		{name: "in ints against a numeric string of a form", expr: expr(on.Where("n").InInt(1, 2)), value: `"2"`, stringValues: true, want: true},
+		{name: "in ints against an object", expr: expr(on.Where("n").InInt(1, 2)), value: `{"n":1}`},
+		{name: "empty prefix", expr: expr(on.Where("s").Prefix("")), value: `""`, want: true},
+		{name: "prefix against a number", expr: expr(on.Where("s").Prefix("1")), value: `12`},
+		{name: "regex is unanchored", expr: expr(on.Where("s").Regex(`b`)), value: `"abc"`, want: true},
+		{name: "regex against an array", expr: expr(on.Where("s").Regex(`.*`)), value: `["a"]`},
+		{name: "exists against null", expr: expr(on.Where("s").Exists()), value: `null`, want: true},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			m, err := newMatcher(tc.expr, "", 0)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			v, err := fastjson.Parse(tc.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := m.match(v, tc.stringValues); got != tc.want {
+				t.Errorf("unexpected match of %s against %s: want %v, got %v", tc.expr.Format(), tc.value, tc.want, got)
+			}
+		})
+	}
+}
+
+func TestExprTermEscapesDots(t *testing.T) {
+	// looseURI is the rule of the router for the topics and procedures, which are named after the route IDs
+	looseURI := regexp.MustCompile(`^([^\s\.#]+\.)*([^\s\.#]+)$`)
+	on := OnURL(testChannel)
+
+	testcases := []struct {
+		name string
+		cond RouteCondition
+		body string
+	}{
+		{name: "trailing dot", cond: on.Where("ref").Prefix("refs/tags/v1."), body: `{"ref":"refs/tags/v1.2"}`},
+		{name: "repeated dots", cond: on.Where("s").Regex("a..b"), body: `{"s":"a..b"}`},
+		{name: "leading dot", cond: on.Where("file").EqString(".gitignore"), body: `{"file":".gitignore"}`},
+		{name: "dot only", cond: on.Where("s").NeString("."), body: `{"s":".."}`},
+		{name: "dots of in", cond: on.Where("version").InString("1.", "2..0"), body: `{"version":"2..0"}`},
+		{name: "dots of a quoted integer", cond: on.Where("s").EqString(`"1."`), body: `{"s":"\"1.\""}`},
+		{name: "dots, spaces and hashes", cond: on.Where("title").EqString("fix #1. see . "), body: `{"title":"fix #1. see . "}`},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			id := tc.cond.ID()
+			if !looseURI.MatchString(tc.cond.ReceiverName()) {
+				t.Fatalf("unexpected receiver name rejected by the router: %s", tc.cond.ReceiverName())
+			}
+			parsed, err := ParseCondition(string(id))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if parsed.ID() != id {
+				t.Fatalf("unexpected id: want %s, got %s", id, parsed.ID())
+			}
+			if !routeMatches(t, parsed, jsonEvent(tc.body)) {
+				t.Errorf("unexpected mismatch of %s: want the unescaped values to match %s", id, tc.body)
+			}
+		})
+	}
+}
@@ -1,44 +1,234 @@
 package diplomat
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/valyala/fastjson"
 	"log"
-	"net/url"
-	"os"
+	"net/http"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 type Matcher struct {
+	Source           Source
+	Op               Operator
 	String           *string
 	Int              *int
+	Strings          []string
+	Ints             []int
 	All              bool
 	RouteConditionID RouteConditionID
+	// Leaf is the index of the expression within the route's condition
+	Leaf int
+
+	regexp *regexp.Regexp
+}
+
+func newMatcher(e Expr, id RouteConditionID, leaf int) (*Matcher, error) {
+	m := &Matcher{
+		Source:           e.Source,
+		Op:               e.Op,
+		String:           e.String,
+		Int:              e.Int,
+		Strings:          e.Strings,
+		Ints:             e.Ints,
+		All:              e.All,
+		RouteConditionID: id,
+		Leaf:             leaf,
+	}
+	if m.Op == OpRegex && m.String != nil {
+		re, err := regexp.Compile(*m.String)
+		if err != nil {
+			return nil, err
+		}
+		m.regexp = re
+	}
+	return m, nil
 }
 
 func (m *Matcher) Eq(other *Matcher) bool {
 	return ((m.String != nil && other.String != nil && *m.String == *other.String) || m.String == other.String) &&
 		((m.Int != nil && other.Int != nil && *m.Int == *other.Int) || m.Int == other.Int) &&
+		m.Source == other.Source &&
+		m.Op == other.Op &&
+		stringsEq(m.Strings, other.Strings) &&
+		intsEq(m.Ints, other.Ints) &&
 		m.RouteConditionID == other.RouteConditionID &&
+		m.Leaf == other.Leaf &&
 		m.All == other.All
 }
 
+func stringsEq(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func intsEq(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// match reports whether the existing value at the matcher's path satisfies the matcher.
+// `ne` matches any value that is not equal, including values of other types.
+// Values of headers, query parameters, methods, form fields and XML are always strings, so they are compared with integers when they look like integers.
+func (m *Matcher) match(v *fastjson.Value, stringValues bool) bool {
+	numericStrings := stringValues || m.Source != SourceBody
+	switch m.Op {
+	case OpExists:
+		return true
+	case OpEq, OpNe:
+		eq := false
+		if m.String != nil {
+			s, ok := stringValue(v)
+			eq = ok && s == *m.String
+		}
+		if m.Int != nil {
+			i, ok := intValue(v, numericStrings)
+			eq = ok && i == *m.Int
+		}
+		return eq == (m.Op == OpEq)
+	case OpGt, OpGe, OpLt, OpLe:
+		if m.Int == nil {
+			return false
+		}
+		f, ok := float64Value(v, numericStrings)
+		if !ok {
+			return false
+		}
+		operand := float64(*m.Int)
+		switch m.Op {
+		case OpGt:
+			return f > operand
+		case OpGe:
+			return f >= operand
+		case OpLt:
+			return f < operand
+		default:
+			return f <= operand
+		}
+	case OpIn:
+		if s, ok := stringValue(v); ok {
+			for _, candidate := range m.Strings {
+				if s == candidate {
+					return true
+				}
+			}
+		}
+		if i, ok := intValue(v, numericStrings); ok {
+			for _, candidate := range m.Ints {
+				if i == candidate {
+					return true
+				}
+			}
+		}
+		return false
+	case OpPrefix:
+		s, ok := stringValue(v)
+		return ok && m.String != nil && strings.HasPrefix(s, *m.String)
+	case OpRegex:
+		s, ok := stringValue(v)
+		return ok && m.regexp != nil && m.regexp.MatchString(s)
+	}
+	return false
+}
+
+func stringValue(v *fastjson.Value) (string, bool) {
+	bs, err := v.StringBytes()
+	if err != nil {
+		return "", false
+	}
+	return string(bs), true
+}
+
+func intValue(v *fastjson.Value, numericStrings bool) (int, bool) {
+	if numericStrings && v.Type() == fastjson.TypeString {
+		i, err := strconv.Atoi(string(v.GetStringBytes()))
+		return i, err == nil
+	}
+	i, err := v.Int()
+	if err != nil {
+		return 0, false
+	}
+	return i, true
+}
+
+func float64Value(v *fastjson.Value, numericStrings bool) (float64, bool) {
+	if numericStrings && v.Type() == fastjson.TypeString {
+		f, err := strconv.ParseFloat(string(v.GetStringBytes()), 64)
+		return f, err == nil
+	}
+	if v.Type() != fastjson.TypeNumber {
+		return 0, false
+	}
+	f, err := v.Float64()
+	return f, err == nil
+}
+
 type Node struct {
 	Matchers []*Matcher
 
 	Children map[string]*Node
 }
 
+// ContentBasedRouteIndex is the matchers of the routes on a channel, organized by the paths that they match.
+// Indexing and deleting routes copy the nodes on the paths instead of modifying them, so that an index being searched is never modified
+// as long as it is copied before it is updated, like RouteIndex does.
 type ContentBasedRouteIndex struct {
 	parserPool fastjson.ParserPool
+	arenaPool  fastjson.ArenaPool
 
 	Root *Node
+	// Header is the root of the matchers on headers, whose children are keyed by the canonical header names
+	Header *Node
+	// Query is the root of the matchers on query parameters, whose children are keyed by the parameter names
+	Query *Node
+	// Method holds the matchers on the HTTP method. It has no children
+	Method *Node
+
+	// conditions is the compiled condition of each route, evaluated against the expressions matched while searching
+	conditions map[RouteConditionID]*compiledCondition
+	// negated is the routes whose conditions are satisfied even when none of their expressions matched, like `Not(...)`.
+	// They are the only routes evaluated without any matched expression.
+	negated map[RouteConditionID]bool
+	// fallbacks is the fallback routes, which RouteIndex adds to the results when no route of the channel matched
+	fallbacks map[RouteConditionID]bool
 }
 
+// RouteIndex is the indices of the routes by channel. Searches read the indices without locks,
+// as updates replace the indices of the channel with updated copies instead of modifying them.
 type RouteIndex struct {
+	parserPool fastjson.ParserPool
+	arenaPool  fastjson.ArenaPool
+
+	// channels is the latest *channelIndices, which is never modified once stored
+	channels atomic.Value
+	// mu serializes the updates of the channels
+	mu sync.Mutex
+}
+
+type channelIndices struct {
 	SendChannelToJsonHandlerIndex          map[string]*ContentBasedRouteIndex
 	SendChannelToFormParameterHandlerIndex map[string]map[string]*ContentBasedRouteIndex
+	// SendChannelToBodyFormatIndex is the indices of the routes that decode bodies in their formats regardless of Content-Type
+	SendChannelToBodyFormatIndex map[string]map[BodyFormat]*ContentBasedRouteIndex
 }
 
 func newNode() *Node {
@@ -48,46 +238,168 @@ func newNode() *Node {
 	}
 }
 
-func (idx *ContentBasedRouteIndex) getNode(path []string) *Node {
-	node := idx.Root
+// copy returns the index sharing the nodes with this one, whose routes are able to be updated without affecting this one
+func (idx *ContentBasedRouteIndex) copy() *ContentBasedRouteIndex {
+	c := &ContentBasedRouteIndex{
+		Root:       idx.Root,
+		Header:     idx.Header,
+		Query:      idx.Query,
+		Method:     idx.Method,
+		conditions: map[RouteConditionID]*compiledCondition{},
+		negated:    map[RouteConditionID]bool{},
+		fallbacks:  map[RouteConditionID]bool{},
+	}
+	for id, cond := range idx.conditions {
+		c.conditions[id] = cond
+	}
+	for id := range idx.negated {
+		c.negated[id] = true
+	}
+	for id := range idx.fallbacks {
+		c.fallbacks[id] = true
+	}
+	return c
+}
+
+func (node *Node) copy() *Node {
+	c := &Node{
+		Matchers: append([]*Matcher{}, node.Matchers...),
+		Children: make(map[string]*Node, len(node.Children)),
+	}
+	for k, child := range node.Children {
+		c.Children[k] = child
+	}
+	return c
+}
+
+// writableNode returns the node at the path, after replacing it and its ancestors with their copies so that the node is able to be modified.
+// Missing nodes are created when create is true. Otherwise nil is returned and nothing is replaced.
+func (idx *ContentBasedRouteIndex) writableNode(source Source, path []string, create bool) *Node {
+	var root **Node
+	switch source {
+	case SourceHeader:
+		root = &idx.Header
+	case SourceQuery:
+		root = &idx.Query
+	case SourceMethod:
+		root = &idx.Method
+	default:
+		root = &idx.Root
+	}
+	if !create {
+		node := *root
+		for _, k := range path {
+			if node == nil {
+				break
+			}
+			node = node.Children[k]
+		}
+		if node == nil {
+			return nil
+		}
+	}
+	if *root == nil {
+		*root = newNode()
+	} else {
+		*root = (*root).copy()
+	}
+	node := *root
 	for _, k := range path {
-		if node.Children[k] == nil {
-			node.Children[k] = newNode()
+		child := node.Children[k]
+		if child == nil {
+			child = newNode()
+		} else {
+			child = child.copy()
 		}
-		node = node.Children[k]
+		node.Children[k] = child
+		node = child
 	}
 	return node
 }
 
+// routeEntry is what a route adds to a content-based index, which is prepared before the index is locked
+type routeEntry struct {
+	id RouteConditionID
+	// fallback is true for the fallback routes, which have no leaves
+	fallback bool
+	leaves   []Expr
+	// matchers are the matchers of the leaves, which are nil for the invalid ones
+	matchers []*Matcher
+	cond     *compiledCondition
+}
+
+func newRouteEntry(r *Route) *routeEntry {
+	e := &routeEntry{id: r.ID(), fallback: r.Fallback}
+	if e.fallback {
+		return e
+	}
+	b := r.boolExpr()
+	e.leaves = b.leaves()
+	leafIndices := map[string]int{}
+	for i, cond := range e.leaves {
+		leafIndices[BoolExpr{Expr: &cond}.render()] = i
+		m, err := newMatcher(cond, e.id, i)
+		if err != nil {
+			log.Printf("skipping invalid expression %s of %s: %v", cond.Format(), e.id, err)
+		}
+		e.matchers = append(e.matchers, m)
+	}
+	e.cond = compileCondition(b, leafIndices)
+	return e
+}
+
+// Index adds the matchers for the route's expressions. Indexing the same route twice is a no-op.
 func (idx *ContentBasedRouteIndex) Index(r *Route) {
-	for _, cond := range r.RouteCondition.Expressions {
-		id := r.ID()
-		m := &Matcher{
-			String:           cond.String,
-			Int:              cond.Int,
-			All:              cond.All,
-			RouteConditionID: id,
+	idx.index(newRouteEntry(r))
+}
+
+func (idx *ContentBasedRouteIndex) index(e *routeEntry) {
+	if idx.conditions == nil {
+		idx.conditions = map[RouteConditionID]*compiledCondition{}
+		idx.negated = map[RouteConditionID]bool{}
+		idx.fallbacks = map[RouteConditionID]bool{}
+	}
+	if e.fallback {
+		idx.fallbacks[e.id] = true
+		return
+	}
+	for i, cond := range e.leaves {
+		m := e.matchers[i]
+		if m == nil {
+			continue
+		}
+		node := idx.writableNode(cond.Source, cond.Path, true)
+		if !node.hasMatcher(m) {
+			node.Matchers = append(node.Matchers, m)
 		}
-		node := idx.getNode(cond.Path)
-		node.Matchers = append(node.Matchers, m)
 	}
-	dump, err := json.Marshal(*idx.Root)
-	if err != nil {
-		log.Fatalf("failed to dump index: %v", err)
+	idx.conditions[e.id] = e.cond
+	if e.cond.eval(map[int]bool{}) {
+		idx.negated[e.id] = true
 	}
-	log.Printf("Index updated: %s", string(dump))
 }
 
 func (idx *ContentBasedRouteIndex) Delete(r *Route) {
-	for _, cond := range r.RouteCondition.Expressions {
-		id := r.ID()
+	idx.delete(newRouteEntry(r))
+}
+
+func (idx *ContentBasedRouteIndex) delete(e *routeEntry) {
+	for i, cond := range e.leaves {
 		del := &Matcher{
+			Source:           cond.Source,
+			Op:               cond.Op,
 			String:           cond.String,
 			Int:              cond.Int,
+			Strings:          cond.Strings,
+			Ints:             cond.Ints,
 			All:              cond.All,
-			RouteConditionID: id,
+			RouteConditionID: e.id,
+			Leaf:             i,
+		}
+		node := idx.writableNode(cond.Source, cond.Path, false)
+		if node == nil {
+			continue
 		}
-		node := idx.getNode(cond.Path)
 		matchers := node.Matchers
 		newMatchers := []*Matcher{}
 		for _, m := range matchers {
@@ -97,190 +409,491 @@ func (idx *ContentBasedRouteIndex) Delete(r *Route) {
 		}
 		node.Matchers = newMatchers
 	}
-	dump, err := json.Marshal(*idx.Root)
-	if err != nil {
-		log.Fatalf("failed to dump index: %v", err)
-	}
-	log.Printf("Index updated (delete): %s", string(dump))
+	delete(idx.conditions, e.id)
+	delete(idx.negated, e.id)
+	delete(idx.fallbacks, e.id)
 }
 
+// SearchRouteMatchesJSON returns the routes whose conditions are satisfied by the JSON, along with the number of matched expressions
 func (idx *ContentBasedRouteIndex) SearchRouteMatchesJSON(data []byte) (map[RouteConditionID]int, error) {
-	if len(data) == 0 {
-		return nil, fmt.Errorf("search failed: empty body")
-	}
 	parser := idx.parserPool.Get()
 	defer idx.parserPool.Put(parser)
-	jsonValue, err := parser.ParseBytes(data)
+	body, err := parseJSONBody(parser, data)
 	if err != nil {
 		return nil, err
 	}
-	return idx.Root.search(&SearchContext{map[RouteConditionID]int{}}, jsonValue)
+	return idx.search(body, false, Event{}, false)
 }
 
-func (idx *RouteIndex) Index(r *Route) {
-	ch := r.Channel.SendChannelURL()
-	if idx.SendChannelToJsonHandlerIndex == nil {
-		idx.SendChannelToJsonHandlerIndex = map[string]*ContentBasedRouteIndex{}
+// search evaluates the body expressions against the body, and the other expressions against the header, query and method of the event.
+// The body is nil for requests without bodies, which can still be routed by the others.
+// stringValues is true when the values of the body are all strings, like form fields, which are compared with integers when they look like integers.
+func (idx *ContentBasedRouteIndex) search(body *fastjson.Value, stringValues bool, evt Event, partial bool) (map[RouteConditionID]int, error) {
+	matched, scores, err := idx.match(body, stringValues, evt)
+	if err != nil {
+		return nil, err
 	}
-	if idx.SendChannelToFormParameterHandlerIndex == nil {
-		idx.SendChannelToFormParameterHandlerIndex = map[string]map[string]*ContentBasedRouteIndex{}
+	if partial {
+		return withScores(scores, matched), nil
 	}
-	if r.FormParameterName == "" {
-		_, ok := idx.SendChannelToJsonHandlerIndex[ch]
-		if !ok {
-			idx.SendChannelToJsonHandlerIndex[ch] = &ContentBasedRouteIndex{
-				Root: &Node{
-					Matchers: []*Matcher{},
-					Children: map[string]*Node{},
-				},
-			}
+	return matched, nil
+}
+
+// withScores returns the scores of the routes that matched only some of their expressions, along with the routes that matched
+func withScores(scores, matched map[RouteConditionID]int) map[RouteConditionID]int {
+	for id, score := range matched {
+		scores[id] = score
+	}
+	return scores
+}
+
+// match returns the routes whose conditions are satisfied, and the number of the matched expressions of all the routes with any of them matched
+func (idx *ContentBasedRouteIndex) match(body *fastjson.Value, stringValues bool, evt Event) (map[RouteConditionID]int, map[RouteConditionID]int, error) {
+	ctx := newSearchContext()
+	ctx.stringValues = stringValues
+	a := idx.arenaPool.Get()
+	defer idx.arenaPool.Put(a)
+	if body == nil {
+		body = a.NewObject()
+	}
+	if _, err := idx.Root.search(ctx, body); err != nil {
+		return nil, nil, err
+	}
+	if idx.Header != nil && len(evt.Header) > 0 {
+		if _, err := idx.Header.search(ctx, firstValues(a, evt.Header, http.CanonicalHeaderKey)); err != nil {
+			return nil, nil, err
 		}
-		idx.SendChannelToJsonHandlerIndex[ch].Index(r)
-	} else {
-		_, ok := idx.SendChannelToFormParameterHandlerIndex[ch]
-		if !ok {
-			idx.SendChannelToFormParameterHandlerIndex[ch] = map[string]*ContentBasedRouteIndex{
-			}
+	}
+	if idx.Query != nil && evt.RawQuery != "" {
+		if _, err := idx.Query.search(ctx, firstValues(a, evt.Query(), nil)); err != nil {
+			return nil, nil, err
 		}
-		_, ok2 := idx.SendChannelToFormParameterHandlerIndex[ch][r.FormParameterName]
-		if !ok2 {
-			idx2 := &ContentBasedRouteIndex{
-				Root: &Node{
-					Matchers: []*Matcher{},
-					Children: map[string]*Node{},
-				},
-			}
-			idx.SendChannelToFormParameterHandlerIndex[ch][r.FormParameterName] = idx2
+	}
+	if idx.Method != nil && evt.Method != "" {
+		if _, err := idx.Method.search(ctx, a.NewString(evt.Method)); err != nil {
+			return nil, nil, err
 		}
-		idx.SendChannelToFormParameterHandlerIndex[ch][r.FormParameterName].Index(r)
 	}
+	matched := idx.evaluate(ctx)
+	// Routes to all the events are matched only when no other route matched
+	if len(matched) == 0 && len(ctx.all) > 0 {
+		for _, m := range ctx.all {
+			ctx.match(m)
+		}
+		matched = idx.evaluate(ctx)
+	}
+	return matched, ctx.Scores, nil
+}
+
+// firstValues returns the object from the names, canonicalized with the optional func, to their first values
+func firstValues(a *fastjson.Arena, values map[string][]string, canonicalize func(string) string) *fastjson.Value {
+	o := a.NewObject()
+	for k, vs := range values {
+		if len(vs) == 0 {
+			continue
+		}
+		if canonicalize != nil {
+			k = canonicalize(k)
+		}
+		o.Set(k, a.NewString(vs[0]))
+	}
+	return o
+}
+
+// evaluate returns the routes whose conditions are satisfied by the matched expressions.
+// Only the routes with any matched expression and the negated routes are evaluated.
+func (idx *ContentBasedRouteIndex) evaluate(ctx *SearchContext) map[RouteConditionID]int {
+	matched := map[RouteConditionID]int{}
+	for id, leaves := range ctx.leaves {
+		if c, ok := idx.conditions[id]; ok && c.eval(leaves) {
+			matched[id] = ctx.Scores[id]
+		}
+	}
+	for id := range idx.negated {
+		if _, ok := ctx.leaves[id]; ok {
+			continue
+		}
+		if idx.conditions[id].eval(map[int]bool{}) {
+			matched[id] = 0
+		}
+	}
+	return matched
+}
+
+func (idx *RouteIndex) Index(r *Route) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.update(r, true, func(cidx *ContentBasedRouteIndex) { cidx.Index(r) })
 }
 
 func (idx *RouteIndex) Delete(r *Route) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.update(r, false, func(cidx *ContentBasedRouteIndex) { cidx.Delete(r) })
+}
+
+// Sync indexes the route of the condition when it has any receiver in the table, and deletes it from the index otherwise.
+// Concurrent syncs are serialized and each of them applies the latest route, so that the index ends up consistent with the table
+// regardless of the order in which concurrent registrations and deregistrations update them.
+// The route is prepared for the index before locking it, and prepared again when it was replaced in the meantime.
+func (idx *RouteIndex) Sync(table *RouteTable, c RouteCondition) {
+	id := c.ID()
+	for {
+		r := table.GetRoute(id)
+		if r == nil {
+			return
+		}
+		e := newRouteEntry(r)
+		idx.mu.Lock()
+		if table.GetRoute(id) != r {
+			idx.mu.Unlock()
+			continue
+		}
+		if len(r.Topics) > 0 || len(r.Procedures) > 0 {
+			idx.update(r, true, func(cidx *ContentBasedRouteIndex) { cidx.index(e) })
+		} else {
+			idx.update(r, false, func(cidx *ContentBasedRouteIndex) { cidx.delete(e) })
+		}
+		idx.mu.Unlock()
+		return
+	}
+}
+
+func (idx *RouteIndex) loadChannels() *channelIndices {
+	if c, ok := idx.channels.Load().(*channelIndices); ok {
+		return c
+	}
+	return &channelIndices{}
+}
+
+// update replaces the index that the route belongs to with its copy updated by the func.
+// A missing index is created when create is true, and nothing is updated otherwise.
+// The maps of the channels are copied as well, so that searches in progress keep reading the indices as they were.
+func (idx *RouteIndex) update(r *Route, create bool, f func(cidx *ContentBasedRouteIndex)) {
+	old := idx.loadChannels()
 	ch := r.Channel.SendChannelURL()
-	if idx.SendChannelToJsonHandlerIndex == nil {
-		idx.SendChannelToJsonHandlerIndex = map[string]*ContentBasedRouteIndex{}
+	if !create {
+		var existing *ContentBasedRouteIndex
+		switch {
+		case r.FormParameterName == "" && r.BodyFormat != "":
+			existing = old.SendChannelToBodyFormatIndex[ch][r.BodyFormat]
+		case r.FormParameterName == "":
+			existing = old.SendChannelToJsonHandlerIndex[ch]
+		default:
+			existing = old.SendChannelToFormParameterHandlerIndex[ch][r.FormParameterName]
+		}
+		if existing == nil {
+			return
+		}
+	}
+
+	next := &channelIndices{
+		SendChannelToJsonHandlerIndex:          map[string]*ContentBasedRouteIndex{},
+		SendChannelToFormParameterHandlerIndex: map[string]map[string]*ContentBasedRouteIndex{},
+		SendChannelToBodyFormatIndex:           map[string]map[BodyFormat]*ContentBasedRouteIndex{},
 	}
-	if idx.SendChannelToFormParameterHandlerIndex == nil {
-		idx.SendChannelToFormParameterHandlerIndex = map[string]map[string]*ContentBasedRouteIndex{}
+	for ch, cidx := range old.SendChannelToJsonHandlerIndex {
+		next.SendChannelToJsonHandlerIndex[ch] = cidx
 	}
-	if r.FormParameterName == "" {
-		_, ok := idx.SendChannelToJsonHandlerIndex[ch]
-		if !ok {
-			idx.SendChannelToJsonHandlerIndex[ch] = &ContentBasedRouteIndex{
-				Root: &Node{
-					Matchers: []*Matcher{},
-					Children: map[string]*Node{},
-				},
-			}
+	for ch, params := range old.SendChannelToFormParameterHandlerIndex {
+		next.SendChannelToFormParameterHandlerIndex[ch] = params
+	}
+	for ch, formats := range old.SendChannelToBodyFormatIndex {
+		next.SendChannelToBodyFormatIndex[ch] = formats
+	}
+
+	updated := func(cidx *ContentBasedRouteIndex) *ContentBasedRouteIndex {
+		if cidx == nil {
+			cidx = &ContentBasedRouteIndex{Root: newNode()}
+		} else {
+			cidx = cidx.copy()
 		}
-		idx.SendChannelToJsonHandlerIndex[ch].Delete(r)
-	} else {
-		_, ok := idx.SendChannelToFormParameterHandlerIndex[ch]
-		if !ok {
-			idx.SendChannelToFormParameterHandlerIndex[ch] = map[string]*ContentBasedRouteIndex{
-			}
+		f(cidx)
+		return cidx
+	}
+	if r.FormParameterName == "" && r.BodyFormat != "" {
+		formats := map[BodyFormat]*ContentBasedRouteIndex{}
+		for format, fidx := range old.SendChannelToBodyFormatIndex[ch] {
+			formats[format] = fidx
 		}
-		_, ok2 := idx.SendChannelToFormParameterHandlerIndex[ch][r.FormParameterName]
-		if !ok2 {
-			idx2 := &ContentBasedRouteIndex{
-				Root: &Node{
-					Matchers: []*Matcher{},
-					Children: map[string]*Node{},
-				},
-			}
-			idx.SendChannelToFormParameterHandlerIndex[ch][r.FormParameterName] = idx2
+		formats[r.BodyFormat] = updated(formats[r.BodyFormat])
+		next.SendChannelToBodyFormatIndex[ch] = formats
+	} else if r.FormParameterName == "" {
+		next.SendChannelToJsonHandlerIndex[ch] = updated(old.SendChannelToJsonHandlerIndex[ch])
+	} else {
+		params := map[string]*ContentBasedRouteIndex{}
+		for name, pidx := range old.SendChannelToFormParameterHandlerIndex[ch] {
+			params[name] = pidx
 		}
-		idx.SendChannelToFormParameterHandlerIndex[ch][r.FormParameterName].Delete(r)
+		params[r.FormParameterName] = updated(params[r.FormParameterName])
+		next.SendChannelToFormParameterHandlerIndex[ch] = params
 	}
+	idx.channels.Store(next)
+}
+
+// channelIndices returns the indices of the channel, which are never modified and can be searched without locks
+func (idx *RouteIndex) channelIndices(ch string) (*ContentBasedRouteIndex, map[string]*ContentBasedRouteIndex, map[BodyFormat]*ContentBasedRouteIndex) {
+	c := idx.loadChannels()
+	return c.SendChannelToJsonHandlerIndex[ch], c.SendChannelToFormParameterHandlerIndex[ch], c.SendChannelToBodyFormatIndex[ch]
 }
 
+// SearchRouteMatchesChannelAndJSON returns the routes on the channel whose conditions are satisfied by the body
 func (idx *RouteIndex) SearchRouteMatchesChannelAndJSON(ch string, data []byte) (map[RouteConditionID]int, error) {
-	cidx, ok := idx.SendChannelToJsonHandlerIndex[ch]
-	if !ok {
-		_, ok2 := idx.SendChannelToFormParameterHandlerIndex[ch]
-		if !ok2 {
-			return nil, fmt.Errorf("unknown channel: no route registered for this channel. please run a server that responds to this channel")
-		}
-		// parse request body
-		str := string(data)
-		kvslice := strings.Split(str, "&")
-		kvs := map[string]string{}
-		for _, kv := range kvslice {
-			split := strings.Split(kv, "=")
-			k := split[0]
-			v := split[1]
-			kvs[k] = v
-		}
-		for param, idx2 := range idx.SendChannelToFormParameterHandlerIndex[ch] {
-			v, ok3 := kvs[param]
-			if !ok3 {
+	return idx.SearchRouteMatchesEvent(Event{Channel: ch, Body: data})
+}
+
+// ScoreRoutesChannelAndJSON is like SearchRouteMatchesChannelAndJSON, but also returns the routes that matched only some of their expressions
+func (idx *RouteIndex) ScoreRoutesChannelAndJSON(ch string, data []byte) (map[RouteConditionID]int, error) {
+	return idx.ScoreRoutesEvent(Event{Channel: ch, Body: data})
+}
+
+// SearchRouteMatchesEvent returns the routes on the event's channel whose conditions are satisfied by the event's body and header
+func (idx *RouteIndex) SearchRouteMatchesEvent(evt Event) (map[RouteConditionID]int, error) {
+	return idx.search(evt, false)
+}
+
+// ScoreRoutesEvent is like SearchRouteMatchesEvent, but also returns the routes that matched only some of their expressions
+func (idx *RouteIndex) ScoreRoutesEvent(evt Event) (map[RouteConditionID]int, error) {
+	return idx.search(evt, true)
+}
+
+var errUnknownChannel = errors.New("unknown channel: no route registered for this channel. please run a server that responds to this channel")
+
+func (idx *RouteIndex) search(evt Event, partial bool) (map[RouteConditionID]int, error) {
+	cidx, params, formats := idx.channelIndices(evt.Channel)
+	if cidx == nil && len(params) == 0 && len(formats) == 0 {
+		return nil, errUnknownChannel
+	}
+	matched, scores, err := idx.match(evt, cidx, params, formats)
+	if err != nil {
+		return nil, err
+	}
+	// Fallback routes are matched once the results of all the indices of the channel are merged,
+	// so that they receive only the events that matched no route in any of them
+	if len(matched) == 0 {
+		indices := []*ContentBasedRouteIndex{cidx}
+		for _, pidx := range params {
+			indices = append(indices, pidx)
+		}
+		for _, fidx := range formats {
+			indices = append(indices, fidx)
+		}
+		for _, i := range indices {
+			if i == nil {
 				continue
 			}
-			vAsJson, err := url.QueryUnescape(v)
-			fmt.Printf("unescaped: %s\n", vAsJson)
-			score, err := idx2.SearchRouteMatchesJSON([]byte(vAsJson))
-			if len(score) > 0 {
-				return score, err
-			}
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "ignoring err: %v", err)
+			for id := range i.fallbacks {
+				matched[id] = 0
 			}
 		}
-		return nil, fmt.Errorf("no match for data: %s", string(data))
 	}
-	return cidx.SearchRouteMatchesJSON(data)
+	if partial {
+		return withScores(scores, matched), nil
+	}
+	return matched, nil
+}
+
+// match returns the routes of the channel that matched the event, and the number of the matched expressions of the routes as ContentBasedRouteIndex.match does
+func (idx *RouteIndex) match(evt Event, cidx *ContentBasedRouteIndex, params map[string]*ContentBasedRouteIndex, formats map[BodyFormat]*ContentBasedRouteIndex) (map[RouteConditionID]int, map[RouteConditionID]int, error) {
+	parser := idx.parserPool.Get()
+	defer idx.parserPool.Put(parser)
+	a := idx.arenaPool.Get()
+	defer idx.arenaPool.Put(a)
+
+	results, scores := map[RouteConditionID]int{}, map[RouteConditionID]int{}
+	merge := func(matched, partialScores map[RouteConditionID]int, err error) error {
+		if err != nil {
+			return err
+		}
+		for id, score := range matched {
+			results[id] = score
+		}
+		for id, score := range partialScores {
+			scores[id] = score
+		}
+		return nil
+	}
+
+	for format, fidx := range formats {
+		body, err := decodeBody(format, evt.Body, a, parser)
+		if err != nil {
+			log.Printf("ignoring routes with the body format %s: %v", format, err)
+			continue
+		}
+		if err := merge(fidx.match(body, hasStringValues(format), evt)); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	mediaType, mediaParams := bodyMediaType(evt.Header)
+	// Channels only with routes on form parameters, like Slack interactions, are sent forms even without Content-Type
+	if mediaType == "" && cidx == nil && len(params) > 0 {
+		mediaType = mediaTypeForm
+	}
+	if mediaType != mediaTypeForm && mediaType != mediaTypeMultipart {
+		if cidx == nil {
+			return results, scores, nil
+		}
+		format := mediaTypeFormat(mediaType)
+		body, err := decodeBody(format, evt.Body, a, parser)
+		if err != nil && len(formats) > 0 {
+			// The body is likely meant for the routes with body formats
+			log.Printf("ignoring routes without body formats: %v", err)
+			return results, scores, nil
+		} else if err != nil {
+			return nil, nil, err
+		}
+		if err := merge(cidx.match(body, hasStringValues(format), evt)); err != nil {
+			return nil, nil, err
+		}
+		return results, scores, nil
+	}
+
+	form, err := parseForm(evt.Body, mediaType, mediaParams)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to parse form: %v", err)
+	}
+	if cidx != nil {
+		if err := merge(cidx.match(firstValues(a, form, nil), true, evt)); err != nil {
+			return nil, nil, err
+		}
+	}
+	for param, pidx := range params {
+		v := form.Get(param)
+		if v == "" {
+			continue
+		}
+		body, err := parser.Parse(v)
+		if err != nil {
+			log.Printf("ignoring form parameter %s that is not JSON: %v", param, err)
+			continue
+		}
+		if err := merge(pidx.match(body, false, evt)); err != nil {
+			return nil, nil, err
+		}
+	}
+	return results, scores, nil
 }
 
 type SearchContext struct {
+	// Scores is the number of distinct expressions of each route that matched
 	Scores map[RouteConditionID]int
+
+	// leaves is the indices of the matched expressions of each route
+	leaves map[RouteConditionID]map[int]bool
+
+	// stringValues is true when the values of the body are all strings, like form fields
+	stringValues bool
+
+	// all is the matchers of the routes to all the events, which are matched only when no other route matched
+	all []*Matcher
+}
+
+func newSearchContext() *SearchContext {
+	return &SearchContext{
+		Scores: map[RouteConditionID]int{},
+		leaves: map[RouteConditionID]map[int]bool{},
+	}
+}
+
+func (ctx *SearchContext) match(m *Matcher) {
+	leaves, ok := ctx.leaves[m.RouteConditionID]
+	if !ok {
+		leaves = map[int]bool{}
+		ctx.leaves[m.RouteConditionID] = leaves
+	}
+	if !leaves[m.Leaf] {
+		leaves[m.Leaf] = true
+		ctx.Scores[m.RouteConditionID] += 1
+	}
+}
+
+func (node *Node) hasMatcher(m *Matcher) bool {
+	for _, existing := range node.Matchers {
+		if existing.Eq(m) {
+			return true
+		}
+	}
+	return false
 }
 
 func (node *Node) search(ctx *SearchContext, v *fastjson.Value) (map[RouteConditionID]int, error) {
-	var strv *string
-	var intv *int
 	if !v.Exists() {
 		return ctx.Scores, nil
 	}
 	for key, child := range node.Children {
-		cv := v.Get(key)
-		_, err := child.search(ctx, cv)
+		var err error
+		switch key {
+		case PathAnyElement:
+			err = eachChildValue(v, func(cv *fastjson.Value) error {
+				_, err := child.search(ctx, cv)
+				return err
+			})
+		case PathDescendants:
+			err = child.searchDescendants(ctx, v)
+		default:
+			_, err = child.search(ctx, childValue(v, key))
+		}
 		if err != nil {
 			return nil, err
 		}
 	}
 	for _, m := range node.Matchers {
-		if m.String != nil {
-			if strv == nil {
-				strbytes := v.GetStringBytes()
-				if strbytes != nil {
-					s := string(strbytes)
-					strv = &s
-				}
-			}
-			if strv != nil && *strv == *m.String {
-				ctx.Scores[m.RouteConditionID] += 1
-			}
+		if m.All {
+			ctx.all = append(ctx.all, m)
+		} else if m.match(v, ctx.stringValues) {
+			ctx.match(m)
 		}
+	}
+	return ctx.Scores, nil
+}
 
-		if m.Int != nil {
-			if intv == nil {
-				intr, err := v.Int()
-				if err == nil {
-					intv = &intr
-				}
-			}
-			if intv != nil && *intv == *m.Int {
-				ctx.Scores[m.RouteConditionID] += 1
-			}
-		}
+// searchDescendants searches the value and all its descendants, so that the expressions on them match when any of them matches
+func (node *Node) searchDescendants(ctx *SearchContext, v *fastjson.Value) error {
+	if _, err := node.search(ctx, v); err != nil {
+		return err
+	}
+	return eachChildValue(v, func(cv *fastjson.Value) error {
+		return node.searchDescendants(ctx, cv)
+	})
+}
+
+// childValue returns the value of the key, or the array element of the index like `[0]`. Negative indices count from the last element
+func childValue(v *fastjson.Value, key string) *fastjson.Value {
+	i, ok := pathIndex(key)
+	if !ok {
+		return v.Get(key)
 	}
-	if len(ctx.Scores) == 0 {
-		for _, m := range node.Matchers {
-			if m.All {
-				ctx.Scores[m.RouteConditionID] += 1
+	if v.Type() != fastjson.TypeArray {
+		return nil
+	}
+	items := v.GetArray()
+	if i < 0 {
+		i += len(items)
+	}
+	if i < 0 || i >= len(items) {
+		return nil
+	}
+	return items[i]
+}
+
+// eachChildValue calls the func with the elements of the array, or the values of the object
+func eachChildValue(v *fastjson.Value, f func(*fastjson.Value) error) error {
+	switch v.Type() {
+	case fastjson.TypeArray:
+		for _, item := range v.GetArray() {
+			if err := f(item); err != nil {
+				return err
 			}
 		}
+	case fastjson.TypeObject:
+		var err error
+		v.GetObject().Visit(func(_ []byte, item *fastjson.Value) {
+			if err == nil {
+				err = f(item)
+			}
+		})
+		return err
 	}
-	return ctx.Scores, nil
+	return nil
 }
@@ -0,0 +1,363 @@
+package diplomat
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestRouteIndexFallback(t *testing.T) {
+	const ch = "http://example.com/webhook"
+	specific := OnURL(ch).Where("action").EqString("opened")
+	param := OnURL(ch).Parameter("payload").Where("type").EqString("block_actions")
+	fallback := OnURL(ch).Fallback()
+
+	srv := NewServer(Server{})
+	for _, c := range []RouteCondition{specific, param, fallback} {
+		if err := srv.StartRouting(RouteConfig{RouteCondition: c, Topic: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	jsonEvent := func(body string) Event {
+		return Event{Channel: ch, Body: []byte(body), Header: map[string][]string{"Content-Type": {"application/json"}}}
+	}
+	formEvent := func(payload string) Event {
+		body := url.Values{"payload": {payload}}.Encode()
+		return Event{Channel: ch, Body: []byte(body), Header: map[string][]string{"Content-Type": {"application/x-www-form-urlencoded"}}}
+	}
+
+	testcases := []struct {
+		name string
+		evt  Event
+		want RouteConditionID
+	}{
+		{name: "specific route", evt: jsonEvent(`{"action":"opened"}`), want: specific.ID()},
+		{name: "no route on the body", evt: jsonEvent(`{"action":"closed"}`), want: fallback.ID()},
+		{name: "route on the form parameter", evt: formEvent(`{"type":"block_actions"}`), want: param.ID()},
+		{name: "no route on the form parameter", evt: formEvent(`{"type":"view_submission"}`), want: fallback.ID()},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			matches, err := srv.SearchRouteMatchesEvent(tc.evt)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if _, ok := matches[tc.want]; !ok || len(matches) != 1 {
+				t.Errorf("unexpected matches: want only %s, got %v", tc.want, matches)
+			}
+
+			scores, err := srv.ScoreRoutesEvent(tc.evt)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if _, ok := scores[tc.want]; !ok {
+				t.Errorf("unexpected scores: want %s, got %v", tc.want, scores)
+			}
+		})
+	}
+
+	if want := RouteConditionID(ch + "?fallback"); fallback.ID() != want {
+		t.Errorf("unexpected id: want %s, got %s", want, fallback.ID())
+	}
+	if fallback.ID() == OnURL(ch).All().ID() {
+		t.Errorf("the fallback route has the same id as the route to all the events: %s", fallback.ID())
+	}
+}
+
+func TestRouteIndexConjunctions(t *testing.T) {
+	const ch = "http://example.com/webhook"
+	repo := OnURL(ch).Where("repository", "full_name").EqString("foo/bar")
+	opened := repo.And("action").EqString("opened")
+	openedByUser := opened.And("sender", "type").EqString("User")
+	// Both expressions are on the same path, so the value has to be within the range
+	inRange := OnURL(ch).Where("number").Gt(1).And("number").Lt(10)
+
+	srv := NewServer(Server{})
+	for _, c := range []RouteCondition{repo, opened, openedByUser, inRange} {
+		if err := srv.StartRouting(RouteConfig{RouteCondition: c, Topic: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testcases := []struct {
+		name string
+		body string
+		want []RouteConditionID
+		// wantScores are the numbers of the matched expressions, including the ones of the partial matches
+		wantScores map[RouteConditionID]int
+	}{
+		{
+			name:       "all the expressions",
+			body:       `{"repository":{"full_name":"foo/bar"},"action":"opened","sender":{"type":"User"}}`,
+			want:       []RouteConditionID{repo.ID(), opened.ID(), openedByUser.ID()},
+			wantScores: map[RouteConditionID]int{repo.ID(): 1, opened.ID(): 2, openedByUser.ID(): 3},
+		},
+		{
+			name:       "all but the last expression",
+			body:       `{"repository":{"full_name":"foo/bar"},"action":"opened","sender":{"type":"Bot"}}`,
+			want:       []RouteConditionID{repo.ID(), opened.ID()},
+			wantScores: map[RouteConditionID]int{repo.ID(): 1, opened.ID(): 2, openedByUser.ID(): 2},
+		},
+		{
+			name:       "all but the first expression",
+			body:       `{"repository":{"full_name":"foo/baz"},"action":"opened","sender":{"type":"User"}}`,
+			wantScores: map[RouteConditionID]int{opened.ID(): 1, openedByUser.ID(): 2},
+		},
+		{
+			name:       "within the range",
+			body:       `{"number":5}`,
+			want:       []RouteConditionID{inRange.ID()},
+			wantScores: map[RouteConditionID]int{inRange.ID(): 2},
+		},
+		{
+			name:       "out of the range",
+			body:       `{"number":10}`,
+			wantScores: map[RouteConditionID]int{inRange.ID(): 1},
+		},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			evt := Event{Channel: ch, Body: []byte(tc.body), Header: map[string][]string{"Content-Type": {"application/json"}}}
+			matches, err := srv.SearchRouteMatchesEvent(evt)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(matches) != len(tc.want) {
+				t.Errorf("unexpected matches: want %v, got %v", tc.want, matches)
+			}
+			for _, id := range tc.want {
+				if _, ok := matches[id]; !ok {
+					t.Errorf("unexpected matches: want %s, got %v", id, matches)
+				}
+			}
+			scores, err := srv.ScoreRoutesEvent(evt)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(scores, tc.wantScores) {
+				t.Errorf("unexpected scores: want %v, got %v", tc.wantScores, scores)
+			}
+		})
+	}
+
+	if want := RouteConditionID(ch + "?action=opened&repository.full_name=foo%2Fbar&sender.type=User"); openedByUser.ID() != want {
+		t.Errorf("unexpected id: want %s, got %s", want, openedByUser.ID())
+	}
+	if reordered := OnURL(ch).Where("action").EqString("opened").And("repository", "full_name").EqString("foo/bar"); reordered.ID() != opened.ID() {
+		t.Errorf("unexpected id of the reordered expressions: want %s, got %s", opened.ID(), reordered.ID())
+	}
+	if all := OnURL(ch).All().And("action").EqString("opened"); len(all.Expressions) != 1 {
+		t.Errorf("unexpected expressions of the route to all the events AND another: want 1, got %v", all.Expressions)
+	}
+}
+
+func TestRouteIndexHeaders(t *testing.T) {
+	const ch = "http://example.com/webhook"
+	push := OnURL(ch).Header("x-github-event").EqString("push")
+	pr := OnURL(ch).Header("X-GitHub-Event").EqString("pull_request")
+	prOpened := pr.And("action").EqString("opened")
+	// bodyNamed is on the body field named like the header, which the header must not match
+	bodyNamed := OnURL(ch).Where("X-Github-Event").EqString("push")
+
+	srv := NewServer(Server{})
+	for _, c := range []RouteCondition{push, pr, prOpened, bodyNamed} {
+		if err := srv.StartRouting(RouteConfig{RouteCondition: c, Topic: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testcases := []struct {
+		name   string
+		header map[string][]string
+		body   string
+		want   []RouteConditionID
+	}{
+		{name: "non-canonical header name", header: map[string][]string{"x-github-event": {"push"}}, body: `{}`, want: []RouteConditionID{push.ID()}},
+		{name: "first of the header values", header: map[string][]string{"X-Github-Event": {"pull_request", "push"}}, body: `{"action":"opened"}`, want: []RouteConditionID{pr.ID(), prOpened.ID()}},
+		{name: "header and body", header: map[string][]string{"X-Github-Event": {"pull_request"}}, body: `{"action":"closed"}`, want: []RouteConditionID{pr.ID()}},
+		{name: "body field named like the header", body: `{"X-Github-Event":"push"}`, want: []RouteConditionID{bodyNamed.ID()}},
+		{name: "header of a form", header: map[string][]string{"X-Github-Event": {"push"}, "Content-Type": {"application/x-www-form-urlencoded"}}, body: `action=opened`, want: []RouteConditionID{push.ID()}},
+		{name: "empty header values", header: map[string][]string{"X-Github-Event": {}}, body: `{}`},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			matches, err := srv.SearchRouteMatchesEvent(Event{Channel: ch, Body: []byte(tc.body), Header: tc.header})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(matches) != len(tc.want) {
+				t.Errorf("unexpected matches: want %v, got %v", tc.want, matches)
+			}
+			for _, id := range tc.want {
+				if _, ok := matches[id]; !ok {
+					t.Errorf("unexpected matches: want %s, got %v", id, matches)
+				}
+			}
+		})
+	}
+
+	parsed, err := ParseCondition(ch + `?header.x-github-event=push`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if parsed.ID() != push.ID() {
+		t.Errorf("unexpected id of the parsed header condition: want %s, got %s", push.ID(), parsed.ID())
+	}
+}
+
+func TestRouteIndexMethodAndQuery(t *testing.T) {
+	const ch = "http://example.com/status"
+	probe := OnURL(ch).Method().EqString(http.MethodGet).And().Query("probe").EqInt(1)
+	get := OnURL(ch).Method().EqString(http.MethodGet)
+	post := OnURL(ch).Method().EqString(http.MethodPost)
+
+	srv := NewServer(Server{})
+	for _, c := range []RouteCondition{probe, get, post} {
+		if err := srv.StartRouting(RouteConfig{RouteCondition: c, Topic: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testcases := []struct {
+		name   string
+		method string
+		query  string
+		want   []RouteConditionID
+	}{
+		{name: "probe", method: http.MethodGet, query: "probe=1", want: []RouteConditionID{probe.ID(), get.ID()}},
+		{name: "probe compared as int", method: http.MethodGet, query: "probe=01", want: []RouteConditionID{probe.ID(), get.ID()}},
+		{name: "first of the query values", method: http.MethodGet, query: "probe=2&probe=1", want: []RouteConditionID{get.ID()}},
+		{name: "query without a value", method: http.MethodGet, query: "probe", want: []RouteConditionID{get.ID()}},
+		{name: "query of another method", method: http.MethodPost, query: "probe=1", want: []RouteConditionID{post.ID()}},
+		{name: "no method", query: "probe=1"},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			matches, err := srv.SearchRouteMatchesEvent(Event{Channel: ch, Method: tc.method, RawQuery: tc.query, Body: []byte(`{}`)})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(matches) != len(tc.want) {
+				t.Errorf("unexpected matches: want %v, got %v", tc.want, matches)
+			}
+			for _, id := range tc.want {
+				if _, ok := matches[id]; !ok {
+					t.Errorf("unexpected matches: want %s, got %v", id, matches)
+				}
+			}
+		})
+	}
+}
+
+func TestRouteIndexBodyFormats(t *testing.T) {
+	const ch = "http://example.com/alerts"
+	plain := OnURL(ch).Where("alert", "severity").EqString("critical")
+	xmlAlert := OnURL(ch).Format(FormatXML).Where("alert", "severity").EqString("critical")
+	param := OnURL(ch).Parameter("payload").Where("alert", "severity").EqString("critical")
+	conds := []RouteCondition{plain, xmlAlert, param}
+
+	ids := map[RouteConditionID]bool{}
+	for _, c := range conds {
+		ids[c.ID()] = true
+		parsed, err := ParseCondition(string(c.ID()))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if parsed.ID() != c.ID() || parsed.BodyFormat != c.BodyFormat || parsed.FormParameterName != c.FormParameterName {
+			t.Errorf("unexpected condition parsed from %s: got %+v", c.ID(), parsed)
+		}
+	}
+	if len(ids) != len(conds) {
+		t.Fatalf("unexpected ids: want %d distinct ids, got %v", len(conds), ids)
+	}
+
+	srv := NewServer(Server{})
+	for _, c := range conds {
+		if err := srv.StartRouting(RouteConfig{RouteCondition: c, Topic: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if routes := srv.List(); len(routes) != len(conds) {
+		t.Fatalf("unexpected routes: want %d, got %d", len(conds), len(routes))
+	}
+
+	jsonAlert := Event{Channel: ch, Body: []byte(`{"alert":{"severity":"critical"}}`), Header: map[string][]string{"Content-Type": {"application/json"}}}
+	// Without Content-Type, the body is decoded as XML only for the route with the format
+	xmlEvent := Event{Channel: ch, Body: []byte(`<alert><severity>critical</severity></alert>`)}
+	search := func(evt Event) map[RouteConditionID]int {
+		t.Helper()
+		matches, err := srv.SearchRouteMatchesEvent(evt)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return matches
+	}
+
+	if matches := search(jsonAlert); len(matches) != 1 || matches[plain.ID()] != 1 {
+		t.Errorf("unexpected matches of the json body: want only %s, got %v", plain.ID(), matches)
+	}
+	if matches := search(xmlEvent); len(matches) != 1 || matches[xmlAlert.ID()] != 1 {
+		t.Errorf("unexpected matches of the xml body: want only %s, got %v", xmlAlert.ID(), matches)
+	}
+
+	if err := srv.StopRouting(RouteConfig{RouteCondition: xmlAlert, Topic: true}); err != nil {
+		t.Fatal(err)
+	}
+	if matches := search(xmlEvent); len(matches) != 0 {
+		t.Errorf("unexpected matches of the xml body after stopping its route: got %v", matches)
+	}
+	if matches := search(jsonAlert); len(matches) != 1 || matches[plain.ID()] != 1 {
+		t.Errorf("unexpected matches of the json body after stopping the xml route: want only %s, got %v", plain.ID(), matches)
+	}
+
+	if err := srv.StopRouting(RouteConfig{RouteCondition: plain, Topic: true}); err != nil {
+		t.Fatal(err)
+	}
+	if matches := search(jsonAlert); len(matches) != 0 {
+		t.Errorf("unexpected matches of the json body after stopping its route: got %v", matches)
+	}
+	if r := srv.GetRoute(param.ID()); r == nil || len(r.Topics) != 1 {
+		t.Errorf("unexpected route on the form parameter after stopping the others: got %+v", r)
+	}
+}
+
+func TestRouteIndexDeleteCreatesNothing(t *testing.T) {
+	const ch = "http://example.com/webhook"
+	indexed := &Route{RouteCondition: OnURL(ch).Where("action").EqString("opened")}
+	otherPath := &Route{RouteCondition: OnURL(ch).Where("pull_request", "number").EqInt(1).And().Header("X-Github-Event").EqString("push")}
+	otherParam := &Route{RouteCondition: OnURL(ch).Parameter("payload").Where("type").EqString("block_actions")}
+	otherFormat := &Route{RouteCondition: OnURL(ch).Format(FormatXML).Where("alert").Exists()}
+
+	idx := &RouteIndex{}
+	idx.Delete(indexed)
+	if cidx, params, formats := idx.channelIndices(ch); cidx != nil || params != nil || formats != nil {
+		t.Fatalf("unexpected indices created by deleting from the empty index: %v, %v, %v", cidx, params, formats)
+	}
+
+	idx.Index(indexed)
+	for _, r := range []*Route{otherPath, otherParam, otherFormat} {
+		idx.Delete(r)
+	}
+	cidx, params, formats := idx.channelIndices(ch)
+	if len(params) != 0 || len(formats) != 0 {
+		t.Errorf("unexpected indices of the parameter and the format: %v, %v", params, formats)
+	}
+	if _, ok := cidx.Root.Children["pull_request"]; ok || len(cidx.Root.Children) != 1 || cidx.Header != nil {
+		t.Errorf("unexpected nodes created by deleting the route on other paths: %v, %v", cidx.Root.Children, cidx.Header)
+	}
+
+	idx.Delete(indexed)
+	if matches, err := idx.SearchRouteMatchesEvent(Event{Channel: ch, Body: []byte(`{"action":"opened"}`)}); err != nil || len(matches) != 0 {
+		t.Errorf("unexpected matches after deleting the route: %v, %v", matches, err)
+	}
+}
@@ -0,0 +1,90 @@
+package diplomat
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// PathAnyElement is the path element that matches every element of an array, or every value of an object
+	PathAnyElement = "[*]"
+	// PathDescendants is the path element that matches the value and all its descendants at any depth, like `..` of JSONPath
+	PathDescendants = "**"
+)
+
+// PathIndex returns the path element that matches the i-th element of an array. Negative indices count from the last element
+func PathIndex(i int) string {
+	return fmt.Sprintf("[%d]", i)
+}
+
+// ParsePath splits the path into its elements, like `commits[*].modified` into `commits`, `[*]` and `modified`
+func ParsePath(s string) ([]string, error) {
+	if s == "" {
+		return nil, fmt.Errorf("empty path")
+	}
+	path := []string{}
+	for _, part := range strings.Split(s, ".") {
+		key := part
+		if i := strings.Index(part, "["); i >= 0 {
+			key = part[:i]
+		}
+		if key != "" {
+			path = append(path, key)
+		}
+		rest := part[len(key):]
+		for rest != "" {
+			end := strings.Index(rest, "]")
+			if !strings.HasPrefix(rest, "[") || end < 0 || !isIndexElement(rest[:end+1]) {
+				return nil, fmt.Errorf("invalid path %q: unexpected %q", s, rest)
+			}
+			path = append(path, rest[:end+1])
+			rest = rest[end+1:]
+		}
+		if part == "" {
+			return nil, fmt.Errorf("invalid path %q: empty element", s)
+		}
+	}
+	return path, nil
+}
+
+// formatPath is the reverse of ParsePath
+func formatPath(path []string) string {
+	var b strings.Builder
+	for i, elem := range path {
+		if i > 0 && !isIndexElement(elem) {
+			b.WriteString(".")
+		}
+		b.WriteString(elem)
+	}
+	return b.String()
+}
+
+// isIndexElement reports whether the path element is `[*]` or an array index like `[0]`
+func isIndexElement(elem string) bool {
+	if elem == PathAnyElement {
+		return true
+	}
+	_, ok := pathIndex(elem)
+	return ok
+}
+
+func pathIndex(elem string) (int, bool) {
+	if len(elem) < 3 || elem[0] != '[' || elem[len(elem)-1] != ']' {
+		return 0, false
+	}
+	i, err := strconv.Atoi(elem[1 : len(elem)-1])
+	return i, err == nil
+}
+
+func validatePath(path []string) error {
+	for _, elem := range path {
+		if elem == "" {
+			return fmt.Errorf("empty path element")
+		}
+		if strings.HasPrefix(elem, "[") && !isIndexElement(elem) {
+			return fmt.Errorf("invalid path element %q: expected an index like [0] or [*]", elem)
+		}
+	}
+	return nil
+}
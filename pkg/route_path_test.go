@@ -0,0 +1,129 @@
+package diplomat
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePath(t *testing.T) {
+	testcases := []struct {
+		input   string
+		want    []string
+		wantErr bool
+	}{
+		{input: "pull_request.base.ref", want: []string{"pull_request", "base", "ref"}},
+		{input: "commits[*].modified", want: []string{"commits", PathAnyElement, "modified"}},
+		{input: "commits[0]", want: []string{"commits", PathIndex(0)}},
+		{input: "commits[-1].id", want: []string{"commits", PathIndex(-1), "id"}},
+		{input: "matrix[0][1]", want: []string{"matrix", PathIndex(0), PathIndex(1)}},
+		{input: "**.login", want: []string{PathDescendants, "login"}},
+		{input: "", wantErr: true},
+		{input: "a..b", wantErr: true},
+		{input: "a[x]", wantErr: true},
+		{input: "a[0", wantErr: true},
+		{input: "a[0]b", wantErr: true},
+		{input: "[0]", want: []string{PathIndex(0)}},
+		{input: "a.**.b", want: []string{"a", PathDescendants, "b"}},
+		{input: "a.", wantErr: true},
+		{input: ".a", wantErr: true},
+		{input: "a[]", wantErr: true},
+		{input: "a[1.5]", wantErr: true},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+		t.Run(tc.input, func(t *testing.T) {
+			path, err := ParsePath(tc.input)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("unexpected success: got %v", path)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(path, tc.want) {
+				t.Fatalf("unexpected path: want %v, got %v", tc.want, path)
+			}
+			if s := formatPath(path); s != tc.input {
+				t.Errorf("unexpected formatted path: want %s, got %s", tc.input, s)
+			}
+		})
+	}
+}
+
+// TestRouteIndexPaths registers the routes together, so that the wildcards, indices and descendants share the nodes of the index
+func TestRouteIndexPaths(t *testing.T) {
+	on := OnURL(testChannel)
+	anyID := on.WherePath("commits[*].id").EqString("b")
+	firstID := on.WherePath("commits[0].id").EqString("a")
+	lastID := on.WherePath("commits[-1].id").EqString("b")
+	modified := on.WherePath("commits[*].modified[*]").EqString("main.go")
+	// Each expression is satisfied by any element, which does not have to be the same one
+	bothIDs := on.WherePath("commits[*].id").EqString("a").And("commits", PathAnyElement, "id").EqString("b")
+	login := on.WherePath("**.login").EqString("octocat")
+	firstLabel := on.WherePath("labels[0]").Exists()
+
+	srv := NewServer(Server{})
+	for _, c := range []RouteCondition{anyID, firstID, lastID, modified, bothIDs, login, firstLabel} {
+		if err := srv.StartRouting(RouteConfig{RouteCondition: c, Topic: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testcases := []struct {
+		name string
+		body string
+		want map[RouteConditionID]int
+	}{
+		{
+			name: "elements",
+			body: `{"commits":[{"id":"a","modified":["README.md"]},{"id":"b","modified":["main.go"]}]}`,
+			want: map[RouteConditionID]int{anyID.ID(): 1, firstID.ID(): 1, lastID.ID(): 1, modified.ID(): 1, bothIDs.ID(): 2},
+		},
+		{
+			name: "only element",
+			body: `{"commits":[{"id":"b"}]}`,
+			want: map[RouteConditionID]int{anyID.ID(): 1, lastID.ID(): 1},
+		},
+		{
+			name: "object instead of an array",
+			body: `{"commits":{"x":{"id":"b","modified":{"y":"main.go"}}}}`,
+			want: map[RouteConditionID]int{anyID.ID(): 1, modified.ID(): 1},
+		},
+		{
+			name: "index of an object",
+			body: `{"labels":{"0":"bug"}}`,
+			want: map[RouteConditionID]int{},
+		},
+		{
+			name: "index of an empty array",
+			body: `{"labels":[],"commits":[]}`,
+			want: map[RouteConditionID]int{},
+		},
+		{
+			name: "descendants at several depths",
+			body: `{"login":"octocat","pull_request":{"user":{"login":"octocat"}},"labels":[{"login":"octocat"}]}`,
+			want: map[RouteConditionID]int{login.ID(): 1, firstLabel.ID(): 1},
+		},
+		{
+			name: "descendants of scalars",
+			body: `{"login":1,"commits":["octocat"]}`,
+			want: map[RouteConditionID]int{},
+		},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			matches, err := srv.SearchRouteMatchesEvent(jsonEvent(tc.body))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(matches, tc.want) {
+				t.Errorf("unexpected matches: want %v, got %v", tc.want, matches)
+			}
+		})
+	}
+}
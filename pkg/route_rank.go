@@ -0,0 +1,51 @@
+package diplomat
+
+import (
+	"fmt"
+	"sort"
+)
+
+// rankedRoute is a route that matched an event, along with the number of distinct expressions that matched
+type rankedRoute struct {
+	*Route
+	Score int
+}
+
+// rankRoutes sorts the routes in the order their procedures are called: higher priorities first, then the most specific ones
+// with more matched expressions, and then the ones with smaller IDs so that ties are always broken in the same way
+func rankRoutes(routes []rankedRoute) {
+	sort.Slice(routes, func(i, j int) bool {
+		return outranks(routes[i], routes[j])
+	})
+}
+
+func outranks(a, b rankedRoute) bool {
+	if a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	if a.Score != b.Score {
+		return a.Score > b.Score
+	}
+	return a.ID() < b.ID()
+}
+
+// rankReason explains why the first of the ranked routes won over the second one
+func rankReason(routes []rankedRoute) string {
+	if len(routes) == 0 {
+		return ""
+	}
+	if len(routes) == 1 {
+		if routes[0].Fallback {
+			return "the fallback route of the channel, as no other route matched"
+		}
+		return "the only matching route with procedures"
+	}
+	winner, runnerUp := routes[0], routes[1]
+	if winner.Priority != runnerUp.Priority {
+		return fmt.Sprintf("priority %d is higher than %d of %s", winner.Priority, runnerUp.Priority, runnerUp.ID())
+	}
+	if winner.Score != runnerUp.Score {
+		return fmt.Sprintf("most specific match: %d matched expressions are more than %d of %s", winner.Score, runnerUp.Score, runnerUp.ID())
+	}
+	return fmt.Sprintf("tied with %s in priority and matched expressions, and its ID sorts first", runnerUp.ID())
+}
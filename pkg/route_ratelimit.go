@@ -0,0 +1,306 @@
+package diplomat
+
+import (
+	"container/list"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fastjson"
+)
+
+// DefaultMaxRateLimitDelay is how long the events over the limit wait with OverflowDelay when RateLimit.MaxDelay is not given
+const DefaultMaxRateLimitDelay = 10 * time.Second
+
+// Overflow is what happens to the events over a rate limit
+type Overflow string
+
+const (
+	// OverflowReject fails the events with ErrRateLimited
+	OverflowReject Overflow = ""
+	// OverflowDelay holds the events until the bucket has a token for them, and rejects the ones that would wait longer than the max delay
+	OverflowDelay Overflow = "delay"
+	// OverflowTopic publishes the events to the overflow topic instead of delivering them, and responds with 202
+	OverflowTopic Overflow = "topic"
+)
+
+func (o Overflow) String() string {
+	if o == OverflowReject {
+		return "reject"
+	}
+	return string(o)
+}
+
+// RateLimit is a token bucket limiting the events of a channel or a route, which is refilled with Rate tokens per second up to Burst tokens.
+// Give Key to have a bucket for each value in the body, like the sender of GitHub events or the team of Slack events:
+//
+//   RateLimit{Rate: 1, Burst: 10, Key: "sender.login"}
+type RateLimit struct {
+	// Rate is the number of the events allowed per second in the long run
+	Rate float64
+	// Burst is the number of the events allowed at once. Defaults to 1
+	Burst int
+	// Key is the path in the body whose values have their own buckets, like `sender.login` or `team_id`.
+	// Forms are looked up by their fields, and into the JSON of a field like `payload.team.id`. Events without the value share a bucket.
+	// Defaults to one bucket for all the events
+	Key string
+	// Overflow is what happens to the events over the limit. Defaults to OverflowReject
+	Overflow Overflow
+	// OverflowTopic is the topic that the events over the limit are published to with OverflowTopic
+	OverflowTopic string
+	// MaxDelay is how long the events over the limit wait at most with OverflowDelay. Defaults to DefaultMaxRateLimitDelay
+	MaxDelay time.Duration
+}
+
+// Validate returns an error when the limit allows no event, or the key or the overflow is invalid
+func (l *RateLimit) Validate() error {
+	if l == nil {
+		return nil
+	}
+	if l.Rate <= 0 {
+		return fmt.Errorf("invalid rate limit: rate %v is not positive", l.Rate)
+	}
+	if l.Burst < 0 || l.MaxDelay < 0 {
+		return fmt.Errorf("invalid rate limit: negative burst or max delay in %+v", *l)
+	}
+	if l.Key != "" {
+		path, err := ParsePath(l.Key)
+		if err != nil {
+			return fmt.Errorf("invalid rate limit key: %v", err)
+		}
+		for _, elem := range path {
+			if elem == PathAnyElement || elem == PathDescendants {
+				return fmt.Errorf("invalid rate limit key %q: %s matches more than one value", l.Key, elem)
+			}
+		}
+	}
+	switch l.Overflow {
+	case OverflowReject, OverflowDelay:
+	case OverflowTopic:
+		if l.OverflowTopic == "" {
+			return fmt.Errorf("invalid rate limit: overflow topic is missing")
+		}
+	default:
+		return fmt.Errorf("invalid rate limit: unknown overflow %q", l.Overflow)
+	}
+	return nil
+}
+
+func (l *RateLimit) burst() float64 {
+	if l.Burst < 1 {
+		return 1
+	}
+	return float64(l.Burst)
+}
+
+// maxDelay returns how long the events over the limit wait at most, which is 0 unless they are delayed
+func (l *RateLimit) maxDelay() time.Duration {
+	if l.Overflow != OverflowDelay {
+		return 0
+	}
+	if l.MaxDelay == 0 {
+		return DefaultMaxRateLimitDelay
+	}
+	return l.MaxDelay
+}
+
+func (l *RateLimit) equal(o *RateLimit) bool {
+	if l == nil || o == nil {
+		return l == o
+	}
+	return reflect.DeepEqual(l, o)
+}
+
+func (l *RateLimit) String() string {
+	if l == nil {
+		return "none"
+	}
+	s := fmt.Sprintf("%v/s, burst %v", l.Rate, l.burst())
+	if l.Key != "" {
+		s += fmt.Sprintf(", by %s", l.Key)
+	}
+	s += fmt.Sprintf(", %s", l.Overflow)
+	if l.Overflow == OverflowTopic {
+		s += fmt.Sprintf(" %s", l.OverflowTopic)
+	}
+	return s
+}
+
+// DefaultMaxRateLimitBuckets is the number of the token buckets kept at most, as keys like senders are unbounded.
+// The least recently used bucket is dropped for a new one beyond it, which lets the next event of its key start with a full bucket
+const DefaultMaxRateLimitBuckets = 10000
+
+// rateLimiter holds the token buckets of the rate limits, keyed by the channel or the route and the value of the key.
+// The buckets are ordered by their last use, so that the least recently used one is dropped first
+type rateLimiter struct {
+	mu         sync.Mutex
+	buckets    map[string]*list.Element
+	lru        *list.List
+	maxBuckets int
+	lastPrune  time.Time
+}
+
+type tokenBucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+	rate   float64
+	burst  float64
+}
+
+func newRateLimiter(maxBuckets int) *rateLimiter {
+	return &rateLimiter{buckets: map[string]*list.Element{}, lru: list.New(), maxBuckets: maxBuckets}
+}
+
+// reserve takes a token from the bucket, and returns how long to wait until the token is available.
+// The token is not taken and false is returned when the wait would be longer than the max.
+// Callers giving up waiting for the token return it with cancel.
+func (l *rateLimiter) reserve(key string, limit *RateLimit, max time.Duration) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.prune(now)
+	b := l.bucket(key, limit, now)
+	b.rate, b.burst = limit.Rate, limit.burst()
+	b.refill(now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+	wait := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+	if wait > max {
+		return wait, false
+	}
+	b.tokens--
+	return wait, true
+}
+
+// cancel returns the token taken by reserve to the bucket, unless the bucket has been dropped since
+func (l *rateLimiter) cancel(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.buckets[key]; ok {
+		b := e.Value.(*tokenBucket)
+		b.tokens++
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+}
+
+// bucket returns the bucket of the key as the most recently used one, creating it with a full bucket when missing
+func (l *rateLimiter) bucket(key string, limit *RateLimit, now time.Time) *tokenBucket {
+	if e, ok := l.buckets[key]; ok {
+		l.lru.MoveToFront(e)
+		return e.Value.(*tokenBucket)
+	}
+	for l.lru.Len() >= l.maxBuckets && l.lru.Len() > 0 {
+		oldest := l.lru.Back()
+		l.lru.Remove(oldest)
+		delete(l.buckets, oldest.Value.(*tokenBucket).key)
+	}
+	b := &tokenBucket{key: key, tokens: limit.burst(), last: now}
+	l.buckets[key] = l.lru.PushFront(b)
+	return b
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// prune drops the buckets that are full again, at most once a minute, so that keys seen only once are not kept until they are the least recently used
+func (l *rateLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < time.Minute {
+		return
+	}
+	l.lastPrune = now
+	for key, e := range l.buckets {
+		b := e.Value.(*tokenBucket)
+		b.refill(now)
+		if b.tokens >= b.burst {
+			l.lru.Remove(e)
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// keyBody is the body of an event looked up for the keys of the rate limits, which is decoded by its content type like the routes do.
+// It is decoded once on the first lookup for all the limits of the event, and released after the last one
+type keyBody struct {
+	idx     *RouteIndex
+	evt     Event
+	parser  *fastjson.Parser
+	arena   *fastjson.Arena
+	value   *fastjson.Value
+	decoded bool
+}
+
+func (idx *RouteIndex) newKeyBody(evt Event) *keyBody {
+	return &keyBody{idx: idx, evt: evt}
+}
+
+// decode returns the decoded body, or nil when the body is invalid
+func (b *keyBody) decode() *fastjson.Value {
+	if b.decoded {
+		return b.value
+	}
+	b.decoded = true
+	b.parser = b.idx.parserPool.Get()
+	b.arena = b.idx.arenaPool.Get()
+	mediaType, mediaParams := bodyMediaType(b.evt.Header)
+	if mediaType == mediaTypeForm || mediaType == mediaTypeMultipart {
+		form, err := parseForm(b.evt.Body, mediaType, mediaParams)
+		if err == nil {
+			b.value = firstValues(b.arena, form, nil)
+		}
+		return b.value
+	}
+	if body, err := decodeBody(mediaTypeFormat(mediaType), b.evt.Body, b.arena, b.parser); err == nil {
+		b.value = body
+	}
+	return b.value
+}
+
+// release returns the parser and the arena of the body to their pools, after which the values looked up are not used anymore
+func (b *keyBody) release() {
+	if b.parser != nil {
+		b.idx.parserPool.Put(b.parser)
+		b.idx.arenaPool.Put(b.arena)
+		b.parser, b.arena, b.value = nil, nil, nil
+	}
+}
+
+// keyValue returns the value at the path in the body.
+// Values that are not strings are returned in JSON, and string values are looked up into as JSON when the path continues.
+func (b *keyBody) keyValue(path []string) (string, bool) {
+	v := b.decode()
+	if v == nil {
+		return "", false
+	}
+
+	var nested fastjson.Parser
+	for _, key := range path {
+		if v.Type() == fastjson.TypeString {
+			// Copied as the string may be in the buffer of the parser being reused
+			parsed, err := nested.ParseBytes(append([]byte{}, v.GetStringBytes()...))
+			if err != nil {
+				return "", false
+			}
+			v = parsed
+		}
+		v = childValue(v, key)
+		if v == nil {
+			return "", false
+		}
+	}
+	if s, ok := stringValue(v); ok {
+		return s, true
+	}
+	return strings.TrimSpace(v.String()), true
+}
@@ -0,0 +1,292 @@
+package diplomat
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gammazero/nexus/router"
+	"github.com/gammazero/nexus/wamp"
+)
+
+func TestRateLimiterReserve(t *testing.T) {
+	testcases := []struct {
+		name  string
+		limit *RateLimit
+		// elapsed is the time passed before each reservation, which refills the bucket
+		elapsed []time.Duration
+		max     time.Duration
+		want    []bool
+		// wantWait is the wait of the last reservation
+		wantWait time.Duration
+	}{
+		{name: "burst", limit: &RateLimit{Rate: 1, Burst: 2}, elapsed: []time.Duration{0, 0, 0}, want: []bool{true, true, false}, wantWait: time.Second},
+		{name: "refilled", limit: &RateLimit{Rate: 1}, elapsed: []time.Duration{0, 0, time.Second}, want: []bool{true, false, true}},
+		{name: "refilled up to burst", limit: &RateLimit{Rate: 1, Burst: 2}, elapsed: []time.Duration{0, time.Hour, 0, 0, 0}, want: []bool{true, true, true, false, false}, wantWait: time.Second},
+		{name: "delayed", limit: &RateLimit{Rate: 10, Overflow: OverflowDelay}, elapsed: []time.Duration{0, 0, 0}, max: time.Second, want: []bool{true, true, true}, wantWait: 200 * time.Millisecond},
+		{name: "delayed too long", limit: &RateLimit{Rate: 10, Overflow: OverflowDelay}, elapsed: []time.Duration{0, 0, 0}, max: 150 * time.Millisecond, want: []bool{true, true, false}, wantWait: 200 * time.Millisecond},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			l := newRateLimiter(DefaultMaxRateLimitBuckets)
+			var wait time.Duration
+			for n, elapsed := range tc.elapsed {
+				if e, ok := l.buckets["key"]; ok {
+					e.Value.(*tokenBucket).last = time.Now().Add(-elapsed)
+				}
+				var ok bool
+				wait, ok = l.reserve("key", tc.limit, tc.max)
+				if ok != tc.want[n] {
+					t.Fatalf("unexpected result of reservation %d: want %v, got %v", n+1, tc.want[n], ok)
+				}
+			}
+			if diff := wait - tc.wantWait; diff < -10*time.Millisecond || diff > 10*time.Millisecond {
+				t.Errorf("unexpected wait: want %s, got %s", tc.wantWait, wait)
+			}
+		})
+	}
+}
+
+func TestRateLimiterCancel(t *testing.T) {
+	l := newRateLimiter(DefaultMaxRateLimitBuckets)
+	limit := &RateLimit{Rate: 10, Overflow: OverflowDelay}
+	l.reserve("key", limit, time.Second)
+	l.reserve("key", limit, time.Second)
+	l.cancel("key")
+	wait, ok := l.reserve("key", limit, time.Second)
+	if !ok || wait < 90*time.Millisecond || wait > 110*time.Millisecond {
+		t.Errorf("unexpected reservation after the refund: want about 100ms, got %s, %v", wait, ok)
+	}
+}
+
+func TestRateLimiterEvictsLeastRecentlyUsed(t *testing.T) {
+	l := newRateLimiter(2)
+	limit := &RateLimit{Rate: 0.001}
+	for _, key := range []string{"a", "b", "a", "c"} {
+		l.reserve(key, limit, 0)
+	}
+	if len(l.buckets) != 2 || l.lru.Len() != 2 {
+		t.Fatalf("unexpected buckets: want 2, got %d in the map and %d in the list", len(l.buckets), l.lru.Len())
+	}
+	if _, ok := l.reserve("a", limit, 0); ok {
+		t.Errorf("unexpected token of the recently used bucket: want it kept empty")
+	}
+	if _, ok := l.reserve("b", limit, 0); !ok {
+		t.Errorf("unexpected rejection of the evicted bucket: want it to start full")
+	}
+}
+
+func TestServerLimitEvent(t *testing.T) {
+	const ch = "http://example.com/webhook"
+	route := func(id string, limit *RateLimit) rankedRoute {
+		return rankedRoute{Route: &Route{RouteCondition: OnURL(ch).Where(id).EqInt(1), RateLimit: limit}}
+	}
+	limited := route("a", &RateLimit{Rate: 0.001})
+	unlimited := route("b", nil)
+	overflowed := route("c", &RateLimit{Rate: 0.001, Overflow: OverflowTopic, OverflowTopic: "overflow"})
+	delayed := route("d", &RateLimit{Rate: 20, Overflow: OverflowDelay})
+	bySender := route("e", &RateLimit{Rate: 0.001, Key: "sender"})
+
+	// result is what limitEvent returns for an event
+	type result struct {
+		// next is the route to call first
+		next RouteConditionID
+		err  error
+		// limitedBy is the route of the error, which is empty for the limit of the channel
+		limitedBy RouteConditionID
+		// out is the status code of the output of the overflow topic
+		out int
+	}
+	testcases := []struct {
+		name    string
+		channel *RateLimit
+		routes  []rankedRoute
+		// bodies are the bodies of the events in order, which default to empty objects
+		bodies []string
+		want   []result
+	}{
+		{
+			name:    "channel limit",
+			channel: &RateLimit{Rate: 0.001},
+			routes:  []rankedRoute{unlimited},
+			want:    []result{{next: unlimited.ID()}, {err: ErrRateLimited}},
+		},
+		{
+			name:    "channel limit to the overflow topic",
+			channel: &RateLimit{Rate: 0.001, Overflow: OverflowTopic, OverflowTopic: "overflow"},
+			routes:  []rankedRoute{unlimited},
+			want:    []result{{next: unlimited.ID()}, {out: http.StatusAccepted}},
+		},
+		{
+			name:    "delayed by the channel limit",
+			channel: &RateLimit{Rate: 20, Overflow: OverflowDelay},
+			routes:  []rankedRoute{unlimited},
+			want:    []result{{next: unlimited.ID()}, {next: unlimited.ID()}},
+		},
+		{
+			// The catch-all route after the limited one must not get the events of the noisy sender
+			name:   "route limit not failing over",
+			routes: []rankedRoute{limited, unlimited},
+			want:   []result{{next: limited.ID()}, {err: ErrRateLimited, limitedBy: limited.ID()}},
+		},
+		{
+			name:   "route limit to the overflow topic",
+			routes: []rankedRoute{overflowed, unlimited},
+			want:   []result{{next: overflowed.ID()}, {out: http.StatusAccepted}},
+		},
+		{
+			name:   "delayed by the route limit",
+			routes: []rankedRoute{delayed, unlimited},
+			want:   []result{{next: delayed.ID()}, {next: delayed.ID()}},
+		},
+		{
+			// The routes failed over to when callees fail take no token
+			name:   "only the first route limited",
+			routes: []rankedRoute{unlimited, limited},
+			want:   []result{{next: unlimited.ID()}, {next: unlimited.ID()}},
+		},
+		{
+			// The third event would be over the limit of the channel if the second one kept its token
+			name:    "channel token returned when over the route limit",
+			channel: &RateLimit{Rate: 0.001, Burst: 2},
+			routes:  []rankedRoute{limited},
+			want: []result{
+				{next: limited.ID()},
+				{err: ErrRateLimited, limitedBy: limited.ID()},
+				{err: ErrRateLimited, limitedBy: limited.ID()},
+			},
+		},
+		{
+			name:   "route limit by key",
+			routes: []rankedRoute{bySender},
+			bodies: []string{`{"sender":"alice"}`, `{"sender":"bob"}`, `{"sender":"alice"}`},
+			want:   []result{{next: bySender.ID()}, {next: bySender.ID()}, {err: ErrRateLimited, limitedBy: bySender.ID()}},
+		},
+		{
+			name:   "no routes",
+			routes: []rankedRoute{},
+			want:   []result{{}, {}},
+		},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			srv := newTestServer(t)
+			defer srv.nxr.Close()
+			if tc.channel != nil {
+				srv.ChannelRateLimits = map[string]RateLimit{ch: *tc.channel}
+			}
+			overflows := make(chan *Event, 1)
+			sub, err := srv.Connect("overflow")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = sub.Subscribe("overflow", func(args wamp.List, kwargs, details wamp.Dict) {
+				evt, _ := kwargsToEvent(kwargs)
+				overflows <- evt
+			}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for n, want := range tc.want {
+				body := `{}`
+				if tc.bodies != nil {
+					body = tc.bodies[n]
+				}
+				evt := Event{Channel: ch, Body: []byte(body), Header: map[string][]string{"Content-Type": {"application/json"}}}
+				next, out, err := srv.limitEvent(context.Background(), evt, tc.routes)
+				if ErrorKind(err) != want.err {
+					t.Fatalf("unexpected error of event %d: want %v, got %v", n+1, want.err, err)
+				}
+				if err != nil {
+					if routeErr := err.(*RouteError); routeErr.Route != want.limitedBy {
+						t.Errorf("unexpected limit of event %d: want the one of %q, got the one of %q", n+1, want.limitedBy, routeErr.Route)
+					}
+				}
+				if (out != nil || want.out != 0) && (out == nil || out.StatusCode != want.out) {
+					t.Fatalf("unexpected output of event %d: want %d, got %+v", n+1, want.out, out)
+				}
+				if want.out != 0 {
+					select {
+					case <-overflows:
+					case <-time.After(time.Second):
+						t.Errorf("unexpected overflow of event %d: want it published to the overflow topic", n+1)
+					}
+				}
+				if want.next == "" {
+					if err == nil && out == nil && len(next) != len(tc.routes) {
+						t.Errorf("unexpected routes of event %d: want %v, got %v", n+1, tc.routes, next)
+					}
+					continue
+				}
+				if len(next) != len(tc.routes) || next[0].ID() != want.next {
+					t.Errorf("unexpected routes of event %d: want all of them with %s first, got %v", n+1, want.next, next)
+				}
+			}
+		})
+	}
+}
+
+// newTestServer returns the server with a router to close, but without the WebSocket and HTTP servers of ListenAndServe
+func newTestServer(t *testing.T) *Server {
+	srv := NewServer(Server{Realm: "test"})
+	nxr, err := router.NewRouter(&router.Config{RealmConfigs: []*router.RealmConfig{{URI: wamp.URI(srv.Realm), AnonymousAuth: true, AllowDisclose: true}}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.nxr = nxr
+	srv.internalClient, err = srv.Connect("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv
+}
+
+func TestKeyBodyKeyValue(t *testing.T) {
+	testcases := []struct {
+		name        string
+		contentType string
+		body        string
+		key         string
+		want        string
+		wantOK      bool
+	}{
+		{name: "string", body: `{"sender":{"login":"alice"}}`, key: "sender.login", want: "alice", wantOK: true},
+		{name: "number in json", body: `{"sender":{"id":1}}`, key: "sender.id", want: "1", wantOK: true},
+		{name: "object in json", body: `{"sender":{"id":1}}`, key: "sender", want: `{"id":1}`, wantOK: true},
+		{name: "missing", body: `{"sender":{}}`, key: "sender.login", wantOK: false},
+		{name: "invalid body", body: `{"sender":`, key: "sender", wantOK: false},
+		{name: "form field", contentType: "application/x-www-form-urlencoded", body: "team_id=T1", key: "team_id", want: "T1", wantOK: true},
+		{name: "json in form field", contentType: "application/x-www-form-urlencoded", body: `payload={"team":{"id":"T1"}}`, key: "payload.team.id", want: "T1", wantOK: true},
+		{name: "invalid json in form field", contentType: "application/x-www-form-urlencoded", body: "payload=team", key: "payload.team", wantOK: false},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			contentType := tc.contentType
+			if contentType == "" {
+				contentType = "application/json"
+			}
+			srv := NewServer(Server{})
+			body := srv.newKeyBody(Event{Body: []byte(tc.body), Header: map[string][]string{"Content-Type": {contentType}}})
+			defer body.release()
+			path, err := ParsePath(tc.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Looked up twice, as the body is decoded only for the first lookup
+			for n := 0; n < 2; n++ {
+				got, ok := body.keyValue(path)
+				if got != tc.want || ok != tc.wantOK {
+					t.Errorf("unexpected value of lookup %d: want %q, %v, got %q, %v", n+1, tc.want, tc.wantOK, got, ok)
+				}
+			}
+		})
+	}
+}
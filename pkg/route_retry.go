@@ -0,0 +1,161 @@
+package diplomat
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+const (
+	// DefaultRetryBackoff is the delay before the first retry when RetryPolicy.Backoff is not given
+	DefaultRetryBackoff = 100 * time.Millisecond
+	// DefaultMaxRetryBackoff caps the delays between retries when RetryPolicy.MaxBackoff is not given
+	DefaultMaxRetryBackoff = 10 * time.Second
+)
+
+// RetryPolicy is how the procedures of a route are called again when they fail, which every callee of the route has to agree on.
+// Every attempt dispatches the event to the route as a whole, so that a failover attempt tries all the callees before backing off.
+//
+//   c.ServeRoute(RouteConfig{RouteCondition: cond, Retry: &RetryPolicy{MaxAttempts: 3, Jitter: 0.2}}, f)
+type RetryPolicy struct {
+	// MaxAttempts is the number of the attempts at most, including the first one. 0 and 1 disable retries
+	MaxAttempts int
+	// Backoff is the delay before the first retry, which doubles on every retry up to MaxBackoff. Defaults to DefaultRetryBackoff
+	Backoff time.Duration
+	// MaxBackoff caps the delays. Defaults to DefaultMaxRetryBackoff
+	MaxBackoff time.Duration
+	// Jitter randomizes each delay by up to the fraction of it, like 0.2 for ±20%, so that the retries of many events are spread out
+	Jitter float64
+	// AttemptTimeout cancels each call to a procedure that takes longer, which then fails with `wamp.error.canceled`. Defaults to no timeout
+	AttemptTimeout time.Duration
+	// RetryableErrors are the WAMP error URIs of the failures to retry, like `wamp.error.canceled`.
+	// Defaults to retrying any failure. Failures that are not WAMP errors, like missing callees, are retried only by default
+	RetryableErrors []wamp.URI
+}
+
+// Validate returns an error when the policy has negative durations or an out of range jitter
+func (p *RetryPolicy) Validate() error {
+	if p == nil {
+		return nil
+	}
+	if p.MaxAttempts < 0 {
+		return fmt.Errorf("invalid retry policy: negative max attempts %d", p.MaxAttempts)
+	}
+	if p.Backoff < 0 || p.MaxBackoff < 0 || p.AttemptTimeout < 0 {
+		return fmt.Errorf("invalid retry policy: negative duration in %+v", *p)
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return fmt.Errorf("invalid retry policy: jitter %v is out of [0, 1]", p.Jitter)
+	}
+	return nil
+}
+
+// maxAttempts returns the number of the attempts to make, which is 1 without the policy
+func (p *RetryPolicy) maxAttempts() int {
+	if p == nil || p.MaxAttempts < 1 {
+		return 1
+	}
+	return p.MaxAttempts
+}
+
+func (p *RetryPolicy) attemptTimeout() time.Duration {
+	if p == nil {
+		return 0
+	}
+	return p.AttemptTimeout
+}
+
+// retryable tells whether the failure of an attempt is worth retrying
+func (p *RetryPolicy) retryable(err error) bool {
+	if p == nil || len(p.RetryableErrors) == 0 {
+		return true
+	}
+	uri := wampErrorURI(err)
+	for _, u := range p.RetryableErrors {
+		if u == uri {
+			return true
+		}
+	}
+	return false
+}
+
+// backoffs returns the delay before the first retry and the cap of the delays, defaulting the ones not given
+func (p *RetryPolicy) backoffs() (time.Duration, time.Duration) {
+	d, max := p.Backoff, p.MaxBackoff
+	if d == 0 {
+		d = DefaultRetryBackoff
+	}
+	if max == 0 {
+		max = DefaultMaxRetryBackoff
+	}
+	return d, max
+}
+
+// backoff returns the delay before the retry, which is 1 for the first retry
+func (p *RetryPolicy) backoff(retry int) time.Duration {
+	d, max := p.backoffs()
+	for i := 1; i < retry && d < max; i++ {
+		// Capped before doubling, so that large caps do not overflow the delay
+		if d > max/2 {
+			d = max
+			break
+		}
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	if p.Jitter > 0 {
+		d += time.Duration(float64(d) * p.Jitter * (2*rand.Float64() - 1))
+	}
+	return d
+}
+
+func (p *RetryPolicy) equal(o *RetryPolicy) bool {
+	if p == nil || o == nil {
+		return p == o
+	}
+	return reflect.DeepEqual(p, o)
+}
+
+func (p *RetryPolicy) String() string {
+	if p == nil {
+		return "none"
+	}
+	d, max := p.backoffs()
+	s := fmt.Sprintf("%d attempts, backoff %s up to %s, jitter %v", p.maxAttempts(), d, max, p.Jitter)
+	if p.AttemptTimeout > 0 {
+		s += fmt.Sprintf(", timeout %s", p.AttemptTimeout)
+	}
+	if len(p.RetryableErrors) > 0 {
+		uris := []string{}
+		for _, u := range p.RetryableErrors {
+			uris = append(uris, string(u))
+		}
+		s += fmt.Sprintf(", on %s", strings.Join(uris, ", "))
+	}
+	return s
+}
+
+// RetryError is the error of a route whose procedures failed on every attempt, which lists the failures of all the attempts
+type RetryError struct {
+	// Errors are the failures of the attempts, the first attempt first
+	Errors []error
+}
+
+func (e *RetryError) Error() string {
+	msgs := []string{}
+	for i, err := range e.Errors {
+		msgs = append(msgs, fmt.Sprintf("attempt %d: %v", i+1, err))
+	}
+	return fmt.Sprintf("%d attempts failed: %s", len(e.Errors), strings.Join(msgs, "; "))
+}
+
+// Unwrap returns the failure of the last attempt
+func (e *RetryError) Unwrap() error {
+	return e.Errors[len(e.Errors)-1]
+}
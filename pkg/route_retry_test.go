@@ -0,0 +1,223 @@
+package diplomat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gammazero/nexus/client"
+	"github.com/gammazero/nexus/wamp"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	testcases := []struct {
+		name   string
+		policy *RetryPolicy
+		retry  int
+		want   time.Duration
+	}{
+		{name: "zeroth retry is not halved", policy: &RetryPolicy{Backoff: time.Second}, retry: 0, want: time.Second},
+		{name: "defaults", policy: &RetryPolicy{}, retry: 2, want: 2 * DefaultRetryBackoff},
+		{name: "backoff over the cap", policy: &RetryPolicy{Backoff: time.Minute, MaxBackoff: time.Second}, retry: 1, want: time.Second},
+		{name: "doubled up to the cap exactly", policy: &RetryPolicy{Backoff: time.Second, MaxBackoff: 4 * time.Second}, retry: 3, want: 4 * time.Second},
+		{name: "doubled over the cap", policy: &RetryPolicy{Backoff: 3 * time.Second, MaxBackoff: 4 * time.Second}, retry: 2, want: 4 * time.Second},
+		// Doubling stops at the cap, so that the delay never overflows however many retries were made
+		{name: "no overflow", policy: &RetryPolicy{Backoff: time.Nanosecond, MaxBackoff: time.Duration(1<<63 - 1)}, retry: 1 << 20, want: time.Duration(1<<63 - 1)},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.policy.backoff(tc.retry); got != tc.want {
+				t.Errorf("unexpected backoff: want %s, got %s", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyBackoffJitter(t *testing.T) {
+	// The full jitter spreads the capped delay over [0, 2x], both below and above it
+	p := &RetryPolicy{Backoff: time.Second, MaxBackoff: time.Second, Jitter: 1}
+	var below, above bool
+	for i := 0; i < 1000; i++ {
+		got := p.backoff(5)
+		if got < 0 || got > 2*time.Second {
+			t.Fatalf("unexpected backoff: want within [0s, 2s], got %s", got)
+		}
+		below = below || got < time.Second
+		above = above || got > time.Second
+	}
+	if !below || !above {
+		t.Errorf("unexpected backoffs: want some below and some above 1s, got below %v and above %v", below, above)
+	}
+}
+
+func TestRetryPolicyRetryable(t *testing.T) {
+	canceled := client.RPCError{Err: &wamp.Error{Error: wamp.ErrCanceled}}
+	onCanceled := &RetryPolicy{RetryableErrors: []wamp.URI{wamp.ErrCanceled, "app.error.busy"}}
+
+	testcases := []struct {
+		name   string
+		policy *RetryPolicy
+		err    error
+		want   bool
+	}{
+		{name: "not a wamp error by default", err: errors.New("no callee"), want: true},
+		{name: "not a wamp error", policy: onCanceled, err: errors.New("no callee")},
+		{name: "second retryable uri", policy: onCanceled, err: client.RPCError{Err: &wamp.Error{Error: "app.error.busy"}}, want: true},
+		{name: "rpc error without the wamp error", policy: onCanceled, err: client.RPCError{}},
+		{name: "wrapped twice", policy: onCanceled, err: wrapError(wrapError(canceled, "callee %d failed", 1), "all %d callees failed", 2), want: true},
+		// The failover of the route reports the failure of the last callee
+		{name: "last failure of the attempts", policy: onCanceled, err: &RetryError{Errors: []error{errors.New("no callee"), canceled}}, want: true},
+		{name: "earlier failure of the attempts", policy: onCanceled, err: &RetryError{Errors: []error{canceled, errors.New("no callee")}}},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.policy.retryable(tc.err); got != tc.want {
+				t.Errorf("unexpected result: want %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyValidate(t *testing.T) {
+	testcases := []struct {
+		name    string
+		policy  *RetryPolicy
+		wantErr bool
+	}{
+		{name: "no policy"},
+		{name: "zero values", policy: &RetryPolicy{}},
+		{name: "jitter bounds", policy: &RetryPolicy{Jitter: 1}},
+		{name: "negative attempts", policy: &RetryPolicy{MaxAttempts: -1}, wantErr: true},
+		{name: "negative max backoff", policy: &RetryPolicy{MaxBackoff: -1}, wantErr: true},
+		{name: "negative jitter", policy: &RetryPolicy{Jitter: -0.1}, wantErr: true},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.policy.Validate(); (err != nil) != tc.wantErr {
+				t.Errorf("unexpected error: want error %v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyEqual(t *testing.T) {
+	p := &RetryPolicy{MaxAttempts: 3, RetryableErrors: []wamp.URI{wamp.ErrCanceled}}
+	if !(*RetryPolicy)(nil).equal(nil) {
+		t.Error("unexpected inequality of no policies")
+	}
+	if (*RetryPolicy)(nil).equal(&RetryPolicy{}) || (&RetryPolicy{}).equal(nil) {
+		t.Error("unexpected equality of no policy and the zero policy")
+	}
+	if !p.equal(&RetryPolicy{MaxAttempts: 3, RetryableErrors: []wamp.URI{wamp.ErrCanceled}}) {
+		t.Error("unexpected inequality of the same policies")
+	}
+	if p.equal(&RetryPolicy{MaxAttempts: 3}) {
+		t.Error("unexpected equality of the policies with different retryable errors")
+	}
+}
+
+func TestRetryPolicyString(t *testing.T) {
+	if got := (*RetryPolicy)(nil).String(); got != "none" {
+		t.Errorf("unexpected string: want none, got %q", got)
+	}
+	// MaxAttempts of 0 makes the single attempt, and the defaults are shown as they apply
+	want := "1 attempts, backoff 100ms up to 10s, jitter 0, timeout 1s, on wamp.error.canceled, app.error.busy"
+	got := (&RetryPolicy{AttemptTimeout: time.Second, RetryableErrors: []wamp.URI{wamp.ErrCanceled, "app.error.busy"}}).String()
+	if got != want {
+		t.Errorf("unexpected string: want %q, got %q", want, got)
+	}
+}
+
+func TestDispatchWithRetry(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.nxr.Close()
+	if err := srv.startRegistrationServer(); err != nil {
+		t.Fatal(err)
+	}
+
+	testcases := []struct {
+		name   string
+		policy *RetryPolicy
+		// failures is the number of the calls that fail before the callee succeeds
+		failures  int
+		timeout   time.Duration
+		wantCalls int
+		// wantErrs is the number of the failures in the RetryError, 1 for the error of the single attempt, or 0 for the success
+		wantErrs int
+	}{
+		{name: "no policy", failures: 1, wantCalls: 1, wantErrs: 1},
+		{name: "succeeded on the last attempt", policy: &RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}, failures: 2, wantCalls: 3},
+		{name: "exhausted", policy: &RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}, failures: 3, wantCalls: 3, wantErrs: 3},
+		{name: "not retryable", policy: &RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond, RetryableErrors: []wamp.URI{wamp.ErrCanceled}}, failures: 3, wantCalls: 1, wantErrs: 1},
+		// The context is done while backing off, which ends the retries with the failures so far
+		{name: "canceled while backing off", policy: &RetryPolicy{MaxAttempts: 3, Backoff: time.Hour}, failures: 3, timeout: 200 * time.Millisecond, wantCalls: 1, wantErrs: 1},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			cond := OnURL(testChannel).Where("case").EqInt(i)
+			c, err := srv.Connect(fmt.Sprintf("callee%d", i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			var calls int32
+			if _, err := c.ServeRoute(RouteConfig{RouteCondition: cond, Retry: tc.policy}, func(evt []byte) ([]byte, error) {
+				if int(atomic.AddInt32(&calls, 1)) <= tc.failures {
+					return nil, errors.New("unavailable")
+				}
+				return evt, nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			ctx := context.Background()
+			if tc.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tc.timeout)
+				defer cancel()
+			}
+			out, n, err := srv.dispatchWithRetry(ctx, srv.GetRoute(cond.ID()), jsonEvent(fmt.Sprintf(`{"case":%d}`, i)))
+			if n != tc.wantCalls || int(atomic.LoadInt32(&calls)) != tc.wantCalls {
+				t.Errorf("unexpected calls: want %d, got %d reported and %d made", tc.wantCalls, n, atomic.LoadInt32(&calls))
+			}
+			switch {
+			case tc.wantErrs == 0:
+				if err != nil || out == nil {
+					t.Errorf("unexpected result: want the output, got %v and error %v", out, err)
+				}
+			case tc.wantErrs == 1 && tc.timeout == 0:
+				// A single failure is returned as is, not as the failures of the attempts
+				if _, ok := err.(*RetryError); ok || err == nil {
+					t.Errorf("unexpected error: want the failure of the single attempt, got %v", err)
+				}
+			default:
+				re, ok := err.(*RetryError)
+				if !ok || len(re.Errors) != tc.wantErrs {
+					t.Errorf("unexpected error: want %d failures of the attempts, got %v", tc.wantErrs, err)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryError(t *testing.T) {
+	first, last := errors.New("no callee"), errors.New("unavailable")
+	err := &RetryError{Errors: []error{first, last}}
+	if want := "2 attempts failed: attempt 1: no callee; attempt 2: unavailable"; err.Error() != want {
+		t.Errorf("unexpected message: want %q, got %q", want, err.Error())
+	}
+	if err.Unwrap() != last {
+		t.Errorf("unexpected unwrapped error: want %v, got %v", last, err.Unwrap())
+	}
+}
@@ -0,0 +1,86 @@
+package diplomat
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// RouteStore persists the routes, so that the server restores them after restarts
+type RouteStore interface {
+	// Load returns all the persisted routes
+	Load() ([]*Route, error)
+	// Save persists the route, replacing the one with the same ID
+	Save(r *Route) error
+	// Delete removes the route. Deleting a missing route is not an error
+	Delete(id RouteConditionID) error
+	Close() error
+}
+
+var routesBucket = []byte("routes")
+
+// BoltRouteStore is the RouteStore backed by a local BoltDB file, whose keys are route condition IDs and values are routes in JSON
+type BoltRouteStore struct {
+	db *bolt.DB
+}
+
+func NewBoltRouteStore(path string) (*BoltRouteStore, error) {
+	// Fails instead of waiting forever when another server has the file open
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 3 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("unable to open route store %s: %v", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{routesBucket, deadLettersBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("unable to initialize route store %s: %v", path, err)
+	}
+	return &BoltRouteStore{db: db}, nil
+}
+
+func (s *BoltRouteStore) Load() ([]*Route, error) {
+	routes := []*Route{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(routesBucket).ForEach(func(k, v []byte) error {
+			r := &Route{}
+			if err := json.Unmarshal(v, r); err != nil {
+				return fmt.Errorf("unable to decode route %s: %v", k, err)
+			}
+			routes = append(routes, r)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return routes, nil
+}
+
+func (s *BoltRouteStore) Save(r *Route) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(routesBucket).Put([]byte(r.ID()), data)
+	})
+}
+
+func (s *BoltRouteStore) Delete(id RouteConditionID) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(routesBucket).Delete([]byte(id))
+	})
+}
+
+func (s *BoltRouteStore) Close() error {
+	return s.db.Close()
+}
@@ -1,13 +1,29 @@
 package diplomat
 
+import (
+	"fmt"
+	"sort"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
 func (s *RouteTable) GetRoute(ref RouteConditionRef) *Route {
-	partition, ok := s.RoutePartitions[ref.HashValue()]
+	return s.getRoute(ref)
+}
+
+func (s *RouteTable) getRoute(ref RouteConditionRef) *Route {
+	partition, ok := s.loadPartitions()[ref.HashValue()]
 	if ok {
 		return partition.Get(ref.ID())
 	}
 	return nil
 }
 
+func (s *RouteTable) loadPartitions() map[uint64]*RoutesPartition {
+	partitions, _ := s.partitions.Load().(map[uint64]*RoutesPartition)
+	return partitions
+}
+
 func (s *RouteTable) Get(ref RouteConditionRef) (topics, procedures []string) {
 	m := s.GetRoute(ref)
 	if m == nil {
@@ -16,73 +32,365 @@ func (s *RouteTable) Get(ref RouteConditionRef) (topics, procedures []string) {
 	return m.Topics, m.Procedures
 }
 
+// Put replaces the route. Routes in the table are never modified in place, so that the routes returned by GetRoute can be read without locks
 func (s *RouteTable) Put(r *Route) {
-	partitionID := r.HashValue()
-	partition, ok := s.RoutePartitions[partitionID]
-	if !ok {
-		routeID := r.ID()
-		partition = &RoutesPartition{
-			Routes: map[RouteConditionID]*Route{routeID: r},
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.put(r)
+}
+
+func (s *RouteTable) put(r *Route) {
+	s.putWithID(r, r.ID())
+}
+
+// putWithID stores the partitions with the route replaced, copying the ones being searched instead of modifying them
+func (s *RouteTable) putWithID(r *Route, id RouteConditionID) {
+	old := s.loadPartitions()
+	partitions := make(map[uint64]*RoutesPartition, len(old)+1)
+	for id, p := range old {
+		partitions[id] = p
+	}
+	partitionID := id.HashValue()
+	partition := &RoutesPartition{Routes: map[RouteConditionID]*Route{}}
+	if p, ok := old[partitionID]; ok {
+		for routeID, route := range p.Routes {
+			partition.Routes[routeID] = route
 		}
-		s.RoutePartitions[partitionID] = partition
 	}
-	partition.Put(r)
+	partition.Routes[id] = r
+	partitions[partitionID] = partition
+	s.partitions.Store(partitions)
 }
 
-func (s *RouteTable) AddConditionalRouteToTopic(c RouteCondition) string {
-	topics, procs := s.Get(c)
-	topic := c.ReceiverName()
-	topics = append(topics, topic)
-	s.Put(&Route{
-		RouteCondition: c,
-		Topics:         topics,
-		Procedures:     procs,
+// update atomically replaces the route with the one modified by the func, which is given a copy of the current route.
+// The route is persisted before it is replaced, so that the table is left unchanged when the store fails.
+func (s *RouteTable) update(c RouteCondition, f func(r *Route) error) error {
+	return s.updateClaims(c, func(r *Route, _ *receiverCounts) error {
+		return f(r)
 	})
-	return topic
 }
 
-func (s *RouteTable) DelConditionalRouteToTopic(c RouteCondition) string {
-	topics, procs := s.Get(c)
-	topic := c.ReceiverName()
-	newTopics := []string{}
-	for _, t := range topics {
-		if t != topic {
-			newTopics = append(topics, t)
+// updateClaims is update that also gives the func a copy of the unclaimed receivers of the route,
+// which replaces them only once the route is persisted
+func (s *RouteTable) updateClaims(c RouteCondition, f func(r *Route, u *receiverCounts) error) error {
+	// Rendered before locking, as it is the most expensive part of an update
+	id := c.ID()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := &Route{
+		RouteCondition:    c,
+		Topics:            []string{},
+		Procedures:        []string{},
+		TopicSessions:     []wamp.ID{},
+		ProcedureSessions: []wamp.ID{},
+	}
+	if old := s.getRoute(id); old != nil {
+		r.Topics = append(r.Topics, old.Topics...)
+		r.Procedures = append(r.Procedures, old.Procedures...)
+		r.TopicSessions = append(r.TopicSessions, old.TopicSessions...)
+		r.ProcedureSessions = append(r.ProcedureSessions, old.ProcedureSessions...)
+		r.Dispatch = old.Dispatch
+		r.Priority = old.Priority
+		r.Retry = old.Retry
+		r.Async = old.Async
+		r.RateLimit = old.RateLimit
+	}
+	u := &receiverCounts{}
+	if old := s.unclaimed[id]; old != nil {
+		*u = *old
+	}
+	if err := f(r, u); err != nil {
+		return err
+	}
+	if len(r.Procedures) == 0 {
+		r.Dispatch = DispatchSingle
+		r.Priority = 0
+		r.Retry = nil
+		r.Async = false
+		r.RateLimit = nil
+	}
+	if s.Store != nil {
+		var err error
+		if len(r.Topics) == 0 && len(r.Procedures) == 0 {
+			err = s.Store.Delete(id)
+		} else {
+			err = s.Store.Save(r)
 		}
+		if err != nil {
+			return fmt.Errorf("unable to persist route %s: %v", id, err)
+		}
+	}
+	s.putWithID(r, id)
+	if u.topics == 0 && u.procs == 0 {
+		delete(s.unclaimed, id)
+	} else {
+		s.unclaimed[id] = u
 	}
-	s.Put(&Route{
-		RouteCondition: c,
-		Topics:         newTopics,
-		Procedures:     procs,
+	return nil
+}
+
+func (s *RouteTable) AddConditionalRouteToTopic(c RouteCondition) (string, error) {
+	return s.AddTopic(c, 0)
+}
+
+func (s *RouteTable) DelConditionalRouteToTopic(c RouteCondition) (string, error) {
+	return s.DelTopic(c, 0)
+}
+
+func (s *RouteTable) AddConditionalRouteToProcedure(c RouteCondition) (string, error) {
+	return s.AddProcedure(RouteConfig{RouteCondition: c, Proc: true}, 0)
+}
+
+func (s *RouteTable) DelConditionalRouteToProcedure(c RouteCondition) (string, error) {
+	return s.DelProcedure(c, 0)
+}
+
+// AddTopic adds the subscriber of the route owned by the WAMP session, or by nobody when the session is 0.
+// Subscribers that registered before the restart claim their restored topics instead of adding another.
+func (s *RouteTable) AddTopic(c RouteCondition, session wamp.ID) (string, error) {
+	topic := c.ReceiverName()
+	return topic, s.updateClaims(c, func(r *Route, u *receiverCounts) error {
+		if u.topics > 0 {
+			u.topics--
+		} else {
+			r.Topics = append(r.Topics, topic)
+		}
+		if session != 0 {
+			r.TopicSessions = append(r.TopicSessions, session)
+		}
+		return nil
+	})
+}
+
+// DelTopic removes the subscriber owned by the session, or any subscriber owned by nobody when the session owns none
+func (s *RouteTable) DelTopic(c RouteCondition, session wamp.ID) (string, error) {
+	topic := c.ReceiverName()
+	return topic, s.update(c, func(r *Route) error {
+		r.Topics, r.TopicSessions = removeReceiver(r.Topics, r.TopicSessions, topic, session)
+		return nil
 	})
-	return topic
 }
 
-func (s *RouteTable) AddConditionalRouteToProcedure(c RouteCondition) string {
-	topics, procs := s.Get(c)
+// AddProcedure adds the callee of the route owned by the WAMP session, or by nobody when the session is 0.
+// Callees that registered before the restart claim their restored procedures instead of adding another.
+// It fails when the route already has callees with another dispatch, as the router refuses to share their registration, or with another priority, retry policy, async acknowledgement or rate limit.
+func (s *RouteTable) AddProcedure(reg RouteConfig, session wamp.ID) (string, error) {
+	c := reg.RouteCondition
 	proc := c.ReceiverName()
-	procs = append(procs, proc)
-	s.Put(&Route{
-		RouteCondition: c,
-		Topics:         topics,
-		Procedures:     procs,
+	return proc, s.updateClaims(c, func(r *Route, u *receiverCounts) error {
+		if len(r.Procedures) > 0 && r.Dispatch != reg.Dispatch {
+			return fmt.Errorf("route %s dispatches to its callees with %s, but %s was requested", c.ID(), r.Dispatch, reg.Dispatch)
+		}
+		if len(r.Procedures) > 0 && r.Priority != reg.Priority {
+			return fmt.Errorf("route %s has priority %d, but %d was requested", c.ID(), r.Priority, reg.Priority)
+		}
+		if len(r.Procedures) > 0 && !r.Retry.equal(reg.Retry) {
+			return fmt.Errorf("route %s retries with %s, but %s was requested", c.ID(), r.Retry, reg.Retry)
+		}
+		if len(r.Procedures) > 0 && r.Async != reg.Async {
+			return fmt.Errorf("route %s has async %t, but %t was requested", c.ID(), r.Async, reg.Async)
+		}
+		if len(r.Procedures) > 0 && !r.RateLimit.equal(reg.RateLimit) {
+			return fmt.Errorf("route %s has rate limit %s, but %s was requested", c.ID(), r.RateLimit, reg.RateLimit)
+		}
+		r.Dispatch = reg.Dispatch
+		r.Priority = reg.Priority
+		r.Retry = reg.Retry
+		r.Async = reg.Async
+		r.RateLimit = reg.RateLimit
+		if u.procs > 0 {
+			u.procs--
+		} else {
+			r.Procedures = append(r.Procedures, proc)
+		}
+		if session != 0 {
+			r.ProcedureSessions = append(r.ProcedureSessions, session)
+		}
+		return nil
 	})
-	return proc
 }
 
-func (s *RouteTable) DelConditionalRouteToProcedure(c RouteCondition) string {
-	topics, procs := s.Get(c)
+// DelProcedure removes the callee owned by the session, or any callee owned by nobody when the session owns none
+func (s *RouteTable) DelProcedure(c RouteCondition, session wamp.ID) (string, error) {
 	proc := c.ReceiverName()
-	newProcs := []string{}
-	for _, p := range procs {
-		if p != proc {
-			newProcs = append(procs, proc)
+	return proc, s.update(c, func(r *Route) error {
+		r.Procedures, r.ProcedureSessions = removeReceiver(r.Procedures, r.ProcedureSessions, proc, session)
+		return nil
+	})
+}
+
+// removeReceiver removes the receiver owned by the session. Receivers owned by other sessions are never removed
+func removeReceiver(receivers []string, sessions []wamp.ID, receiver string, session wamp.ID) ([]string, []wamp.ID) {
+	for i, id := range sessions {
+		if id == session {
+			return removeOne(receivers, receiver), append(sessions[:i:i], sessions[i+1:]...)
 		}
 	}
-	s.Put(&Route{
-		RouteCondition: c,
-		Topics:         topics,
-		Procedures:     newProcs,
+	if len(receivers) > len(sessions) {
+		return removeOne(receivers, receiver), sessions
+	}
+	return receivers, sessions
+}
+
+// RemoveSession removes all the receivers owned by the WAMP session, and returns the conditions of the updated routes
+func (s *RouteTable) RemoveSession(session wamp.ID) ([]RouteCondition, error) {
+	conds := []RouteCondition{}
+	for _, r := range s.List() {
+		if !containsSession(r.TopicSessions, session) && !containsSession(r.ProcedureSessions, session) {
+			continue
+		}
+		err := s.update(r.RouteCondition, func(r *Route) error {
+			for containsSession(r.TopicSessions, session) {
+				r.Topics, r.TopicSessions = removeReceiver(r.Topics, r.TopicSessions, r.ReceiverName(), session)
+			}
+			for containsSession(r.ProcedureSessions, session) {
+				r.Procedures, r.ProcedureSessions = removeReceiver(r.Procedures, r.ProcedureSessions, r.ReceiverName(), session)
+			}
+			return nil
+		})
+		if err != nil {
+			return conds, err
+		}
+		conds = append(conds, r.RouteCondition)
+	}
+	return conds, nil
+}
+
+// RemoveUnowned removes the topics or procedures of the route that are owned by no session, like the ones restored from the store.
+// It is called when the router deleted the subscription or registration of the receivers, which means that none of them is alive.
+func (s *RouteTable) RemoveUnowned(c RouteCondition, topics bool) error {
+	return s.updateClaims(c, func(r *Route, u *receiverCounts) error {
+		if topics {
+			u.topics = 0
+			r.Topics = removeUnowned(r.Topics, r.TopicSessions, r.ReceiverName())
+		} else {
+			u.procs = 0
+			r.Procedures = removeUnowned(r.Procedures, r.ProcedureSessions, r.ReceiverName())
+		}
+		return nil
+	})
+}
+
+// removeUnowned removes the receivers that removeReceiver would remove for a session owning none of them, until every receiver left has its owner
+func removeUnowned(receivers []string, sessions []wamp.ID, receiver string) []string {
+	for len(receivers) > len(sessions) {
+		removed := removeOne(receivers, receiver)
+		if len(removed) == len(receivers) {
+			break
+		}
+		receivers = removed
+	}
+	return receivers
+}
+
+func containsSession(sessions []wamp.ID, session wamp.ID) bool {
+	for _, id := range sessions {
+		if id == session {
+			return true
+		}
+	}
+	return false
+}
+
+// Restore loads the routes from the store. Their receivers stay unclaimed until they register again or Reconcile drops them
+func (s *RouteTable) Restore() ([]*Route, error) {
+	if s.Store == nil {
+		return []*Route{}, nil
+	}
+	routes, err := s.Store.Load()
+	if err != nil {
+		return nil, fmt.Errorf("unable to restore routes: %v", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.unclaimed == nil {
+		s.unclaimed = map[RouteConditionID]*receiverCounts{}
+	}
+	for _, r := range routes {
+		s.put(r)
+		s.unclaimed[r.ID()] = &receiverCounts{topics: len(r.Topics), procs: len(r.Procedures)}
+	}
+	return routes, nil
+}
+
+// Unclaimed returns the conditions of the restored routes whose receivers have not all registered again
+func (s *RouteTable) Unclaimed() []RouteCondition {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conds := []RouteCondition{}
+	for id, u := range s.unclaimed {
+		if u.topics == 0 && u.procs == 0 {
+			continue
+		}
+		if r := s.getRoute(id); r != nil {
+			conds = append(conds, r.RouteCondition)
+		}
+	}
+	return conds
+}
+
+// Reconcile drops the unclaimed receivers of the route that have no live counterparts in the router,
+// keeping at most as many topics and procedures as the subscribers and callees that are actually connected
+func (s *RouteTable) Reconcile(c RouteCondition, subscribers, callees int) error {
+	return s.updateClaims(c, func(r *Route, u *receiverCounts) error {
+		r.Topics = dropUnclaimed(r.Topics, len(r.TopicSessions), u.topics, subscribers)
+		r.Procedures = dropUnclaimed(r.Procedures, len(r.ProcedureSessions), u.procs, callees)
+		*u = receiverCounts{}
+		return nil
+	})
+}
+
+// dropUnclaimed drops the unclaimed receivers exceeding the live ones. Receivers owned by sessions are never dropped
+func dropUnclaimed(receivers []string, owned, unclaimed, live int) []string {
+	drop := len(receivers) - live
+	if drop > unclaimed {
+		drop = unclaimed
+	}
+	if drop > len(receivers)-owned {
+		drop = len(receivers) - owned
+	}
+	if drop <= 0 {
+		return receivers
+	}
+	return receivers[:len(receivers)-drop]
+}
+
+// removeOne removes the first occurrence of the item, so that a receiver registered twice keeps receiving until it is deregistered twice
+func removeOne(items []string, item string) []string {
+	res := []string{}
+	removed := false
+	for _, i := range items {
+		if i == item && !removed {
+			removed = true
+			continue
+		}
+		res = append(res, i)
+	}
+	return res
+}
+
+// List returns all the routes that have any topic or procedure, sorted by their IDs
+func (s *RouteTable) List() []*Route {
+	routes := s.routes()
+	ids := make(map[*Route]RouteConditionID, len(routes))
+	for _, r := range routes {
+		ids[r] = r.ID()
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		return ids[routes[i]] < ids[routes[j]]
 	})
-	return proc
+	return routes
+}
+
+func (s *RouteTable) routes() []*Route {
+	routes := []*Route{}
+	for _, p := range s.loadPartitions() {
+		for _, r := range p.Routes {
+			if len(r.Topics) == 0 && len(r.Procedures) == 0 {
+				continue
+			}
+			routes = append(routes, r)
+		}
+	}
+	return routes
 }
@@ -0,0 +1,209 @@
+package diplomat
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+const stressChannelURL = "http://example.com/stress"
+
+// TestRoutingConcurrentStress registers, deregisters and matches routes concurrently. Run it with the race detector:
+//
+//   go test -race -run TestRoutingConcurrentStress ./pkg
+func TestRoutingConcurrentStress(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping the stress test in short mode")
+	}
+
+	const (
+		duration = 2 * time.Second
+		routes   = 50
+		// minWritesPerWriter and maxWriteLatency fail the test when readers starve writers.
+		// The latency is of the 99th percentile, as any single registration may wait for the readers to be descheduled on busy CPUs
+		minWritesPerWriter = 60
+		maxWriteLatency    = 500 * time.Millisecond
+	)
+
+	// Routes are logged on every registration
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	// Readers outnumber the CPUs, so that writers compete with busy readers for them
+	writers, readers := 2, 16*runtime.GOMAXPROCS(0)
+	srv := NewServer(Server{})
+	conds := stressConditions(routes)
+	// Keeps the channel known to the index, so that searches never fail while no other route is registered
+	if err := srv.StartRouting(RouteConfig{RouteCondition: OnURL(stressChannelURL).Where("n").EqInt(-1), Topic: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	errs := make(chan error, writers+readers)
+	var wg sync.WaitGroup
+	writes := make([]int, writers)
+	latencies := make([][]time.Duration, writers)
+	searches := make([]int, readers)
+
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(int64(w)))
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				reg := RouteConfig{RouteCondition: conds[rnd.Intn(len(conds))], Topic: true}
+				start := time.Now()
+				if err := srv.StartRouting(reg); err != nil {
+					errs <- fmt.Errorf("start routing: %v", err)
+					return
+				}
+				if err := srv.StopRouting(reg); err != nil {
+					errs <- fmt.Errorf("stop routing: %v", err)
+					return
+				}
+				latencies[w] = append(latencies[w], time.Since(start))
+				writes[w]++
+			}
+		}(w)
+	}
+
+	for r := 0; r < readers; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(int64(1000 + r)))
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				i := rnd.Intn(len(conds))
+				matches, err := srv.SearchRouteMatchesEvent(stressEvent(i))
+				if err != nil {
+					errs <- fmt.Errorf("search: %v", err)
+					return
+				}
+				for id := range matches {
+					// The i-th event matches only the i-th route, regardless of the registrations in progress
+					if id != conds[i].ID() {
+						errs <- fmt.Errorf("event %d matched %s", i, id)
+						return
+					}
+					srv.GetRoute(id)
+				}
+				if rnd.Intn(100) == 0 {
+					srv.List()
+				}
+				searches[r]++
+			}
+		}(r)
+	}
+
+	time.Sleep(duration)
+	close(stop)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	for w := 0; w < writers; w++ {
+		if writes[w] < minWritesPerWriter {
+			t.Errorf("writer %d starved: want at least %d registrations in %s, got %d", w, minWritesPerWriter, duration, writes[w])
+		}
+		if p99 := percentile(latencies[w], 99); p99 > maxWriteLatency {
+			t.Errorf("writer %d starved: 99th percentile registration latency is %s", w, p99)
+		}
+	}
+	totalWrites, totalSearches := 0, 0
+	for _, n := range writes {
+		totalWrites += n
+	}
+	for _, n := range searches {
+		totalSearches += n
+	}
+	if totalSearches == 0 {
+		t.Error("no search completed")
+	}
+	t.Logf("%d registrations and %d searches in %s", totalWrites, totalSearches, duration)
+
+	// Every writer deregistered what it registered, so no route must match anymore
+	if err := verifyStressIndex(srv, conds, map[int]bool{}); err != nil {
+		t.Fatal(err)
+	}
+	registered := map[int]bool{}
+	for i := 0; i < len(conds); i += 2 {
+		if err := srv.StartRouting(RouteConfig{RouteCondition: conds[i], Proc: true}); err != nil {
+			t.Fatal(err)
+		}
+		registered[i] = true
+	}
+	if err := verifyStressIndex(srv, conds, registered); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// stressConditions returns the conditions where the i-th one matches only the i-th event
+func stressConditions(n int) []RouteCondition {
+	b := OnURL(stressChannelURL)
+	conds := []RouteCondition{}
+	for i := 0; i < n; i++ {
+		switch i % 3 {
+		case 0:
+			conds = append(conds, b.Where("n").EqInt(i))
+		case 1:
+			conds = append(conds, b.WherePath("items[*].n").EqInt(i).And("kind").EqString("stress"))
+		default:
+			conds = append(conds, Any(b.Where("n").EqInt(i), b.Header("X-N").EqInt(i)))
+		}
+	}
+	return conds
+}
+
+func stressEvent(i int) Event {
+	return Event{
+		Channel: stressChannelURL,
+		Body:    []byte(fmt.Sprintf(`{"n":%d,"kind":"stress","items":[{"n":-1},{"n":%d}]}`, i, i)),
+		Header:  map[string][]string{"Content-Type": {"application/json"}},
+	}
+}
+
+func verifyStressIndex(srv *Server, conds []RouteCondition, registered map[int]bool) error {
+	for i, c := range conds {
+		matches, err := srv.SearchRouteMatchesEvent(stressEvent(i))
+		if err != nil {
+			return fmt.Errorf("searching %s: %v", c.ID(), err)
+		}
+		_, matched := matches[c.ID()]
+		if matched != registered[i] {
+			return fmt.Errorf("inconsistent index: %s matched=%v, registered=%v", c.ID(), matched, registered[i])
+		}
+		if len(matches) > 1 {
+			return fmt.Errorf("inconsistent index: event %d matched %d routes: %v", i, len(matches), matches)
+		}
+	}
+	return nil
+}
+
+// percentile returns the p-th percentile of the durations
+func percentile(ds []time.Duration, p int) time.Duration {
+	if len(ds) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration{}, ds...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[(len(sorted)-1)*p/100]
+}
@@ -0,0 +1,81 @@
+package diplomat
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+type testRouteStore struct {
+	routes []*Route
+	err    error
+}
+
+func (s *testRouteStore) Load() ([]*Route, error)          { return s.routes, nil }
+func (s *testRouteStore) Save(r *Route) error              { return s.err }
+func (s *testRouteStore) Delete(id RouteConditionID) error { return s.err }
+func (s *testRouteStore) Close() error                     { return nil }
+
+func TestRouteTableClaimsAfterSave(t *testing.T) {
+	c := OnURL("http://example.com/webhook").All()
+	store := &testRouteStore{routes: []*Route{{RouteCondition: c, Topics: []string{c.ReceiverName()}}}}
+	table := &RouteTable{Store: store}
+	if _, err := table.Restore(); err != nil {
+		t.Fatal(err)
+	}
+
+	store.err = errors.New("disk full")
+	if _, err := table.AddTopic(c, 1); err == nil {
+		t.Fatal("unexpected success: want an error on the failed save")
+	}
+	if got := table.Unclaimed(); len(got) != 1 {
+		t.Errorf("unexpected unclaimed routes after the failed save: want 1, got %v", got)
+	}
+
+	store.err = nil
+	if _, err := table.AddTopic(c, 1); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := table.Unclaimed(); len(got) != 0 {
+		t.Errorf("unexpected unclaimed routes: want none, got %v", got)
+	}
+	if r := table.GetRoute(c.ID()); len(r.Topics) != 1 || len(r.TopicSessions) != 1 {
+		t.Errorf("unexpected route: want the restored topic claimed by the session, got %+v", r)
+	}
+}
+
+func TestRouteTableRemoveUnowned(t *testing.T) {
+	c := OnURL("http://example.com/webhook").All()
+	topic := c.ReceiverName()
+
+	testcases := []struct {
+		name     string
+		topics   []string
+		sessions []wamp.ID
+		want     int
+	}{
+		{name: "unowned only", topics: []string{topic, topic}, want: 0},
+		{name: "owned and unowned", topics: []string{topic, topic, topic}, sessions: []wamp.ID{1}, want: 1},
+		{name: "owned only", topics: []string{topic, topic}, sessions: []wamp.ID{1, 2}, want: 2},
+		{name: "more sessions than topics", topics: []string{topic}, sessions: []wamp.ID{1, 2}, want: 1},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			table := &RouteTable{}
+			table.put(&Route{RouteCondition: c, Topics: tc.topics, TopicSessions: tc.sessions, Procedures: []string{}})
+			if err := table.RemoveUnowned(c, true); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			r := table.GetRoute(c.ID())
+			if got := len(r.Topics); got != tc.want {
+				t.Errorf("unexpected topics: want %d, got %v", tc.want, r.Topics)
+			}
+			if len(r.TopicSessions) != len(tc.sessions) {
+				t.Errorf("unexpected sessions: want %v, got %v", tc.sessions, r.TopicSessions)
+			}
+		})
+	}
+}
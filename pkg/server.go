@@ -1,6 +1,8 @@
 package diplomat
 
 import (
+	"context"
+	"expvar"
 	"fmt"
 	"github.com/gammazero/nexus/client"
 	"github.com/gammazero/nexus/router"
@@ -10,21 +12,48 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"sort"
+	"strings"
 	"time"
 )
 
 type Closer struct {
-	wsCloser io.Closer
-	nxr      router.Router
+	wsCloser   io.Closer
+	nxr        router.Router
+	store      RouteStore
+	reconcile  *time.Timer
+	deliveries *deliveryQueue
 }
 
+// Close delivers the events already acknowledged to the async routes before closing the router, as the deliveries need it.
+// The deliveries left after AsyncShutdownTimeout of the server are canceled
 func (c *Closer) Close() error {
-	err1 := c.wsCloser.Close()
-	c.nxr.Close()
+	if c.reconcile != nil {
+		c.reconcile.Stop()
+	}
+	if c.deliveries != nil {
+		c.deliveries.close()
+	}
+	var err1 error
+	if c.wsCloser != nil {
+		err1 = c.wsCloser.Close()
+	}
+	if c.nxr != nil {
+		c.nxr.Close()
+	}
+	if c.store != nil {
+		if err := c.store.Close(); err != nil && err1 == nil {
+			err1 = err
+		}
+	}
 	return err1
 }
 
+// DefaultReconcileTimeout is how long restored routes wait for their subscribers and callees to register again after restarts
+const DefaultReconcileTimeout = 30 * time.Second
+
 type Server struct {
 	*RouteTable
 	*RouteIndex
@@ -33,26 +62,99 @@ type Server struct {
 	NetAddr  string
 	WsPort   int
 	HttpPort int
+	// MetricsAddr is the address of the admin HTTP server serving the metrics at /debug/vars, like `127.0.0.1:9002`.
+	// The metrics are not served when it is empty, as the HTTP gateway is usually exposed to webhook senders
+	MetricsAddr string
+
+	// Store persists the routes, so that they are restored after restarts. Defaults to the BoltDB file at StorePath
+	Store RouteStore
+	// StorePath is the BoltDB file used when Store is nil.
+	// Routes are kept only in memory and lost on restarts when both are empty
+	StorePath string
+	// ReconcileTimeout is how long restored routes wait for their receivers to reconnect before the ones missing in the router are dropped.
+	// Defaults to DefaultReconcileTimeout
+	ReconcileTimeout time.Duration
+	// DeadLetterTopic receives the events that failed to be delivered to the procedures of the matched routes. Defaults to DefaultDeadLetterTopic
+	DeadLetterTopic string
+	// CallTimeout bounds every Call, including the ones made by the HTTP gateway and remote clients. Defaults to no timeout
+	CallTimeout time.Duration
+	// AsyncWorkers is the number of the events delivered at once to the async routes in the background. Defaults to DefaultAsyncWorkers
+	AsyncWorkers int
+	// AsyncQueueSize is the number of the events waiting for the async workers at most.
+	// Events acknowledged while the queue is full are responded with 503. Defaults to DefaultAsyncQueueSize
+	AsyncQueueSize int
+	// DeliveryRetention is how long the finished deliveries of the async routes are kept for polling. Defaults to DefaultDeliveryRetention
+	DeliveryRetention time.Duration
+	// MaxDeliveries is the number of the deliveries kept for polling at most, including the ones still queued.
+	// Events acknowledged while as many deliveries are kept are responded with 503. Defaults to DefaultMaxDeliveries
+	MaxDeliveries int
+	// AsyncShutdownTimeout is how long closing the server waits for the async workers to deliver the events already acknowledged.
+	// The deliveries left are canceled and sent to the dead-letter topic then. Defaults to DefaultAsyncShutdownTimeout
+	AsyncShutdownTimeout time.Duration
+	// MaxConcurrentCalls bounds the events that the HTTP gateway delivers at once. Defaults to no limit
+	MaxConcurrentCalls int
+	// ChannelConcurrency bounds the events that the HTTP gateway delivers at once by channel URL, like {"http://example.com/webhook": 2}.
+	// Channels missing in it are limited only by MaxConcurrentCalls
+	ChannelConcurrency map[string]int
+	// MaxQueuedCalls is the number of the events waiting for the concurrency limits at most.
+	// Events arriving while the queue is full are responded with 429 when their channel is at its limit, and with 503 otherwise.
+	// 0 disables the queue, so that events exceeding the limits are responded right away. Negative values use DefaultMaxQueuedCalls
+	MaxQueuedCalls int
+	// ChannelRateLimits limits the rate of the events by channel URL, before they are published or delivered to any route.
+	// Routes have their own limits given by RouteConfig.RateLimit
+	ChannelRateLimits map[string]RateLimit
+	// DeadLetterStore persists the events published to DeadLetterTopic.
+	// Defaults to the BoltDB file of the routes when they are persisted to a BoltRouteStore, and to none otherwise
+	DeadLetterStore DeadLetterStore
 
 	nxr router.Router
 
 	internalClient *Client
+
+	deliveries *deliveryQueue
+	limiter    *callLimiter
+
+	rateLimiter *rateLimiter
+
+	// callees are the callee procedures of the failover and fan-out routes, which the session watcher keeps up to date
+	callees *calleeRegistrations
 }
 
 func NewServer(opts Server) *Server {
 	return &Server{
-		RouteTable: &RouteTable{
-			RoutePartitions: map[uint64]*RoutesPartition{},
-		},
-		RouteIndex: &RouteIndex{
-		},
+		RouteTable: &RouteTable{},
+		RouteIndex: &RouteIndex{},
 		Realm:   opts.Realm,
 		NetAddr: opts.NetAddr,
 		WsPort:  opts.WsPort,
+
+		MetricsAddr: opts.MetricsAddr,
+
+		Store:            opts.Store,
+		StorePath:        opts.StorePath,
+		ReconcileTimeout: opts.ReconcileTimeout,
+		DeadLetterTopic:  opts.DeadLetterTopic,
+		CallTimeout:      opts.CallTimeout,
+		DeadLetterStore:  opts.DeadLetterStore,
+
+		AsyncWorkers:      opts.AsyncWorkers,
+		AsyncQueueSize:    opts.AsyncQueueSize,
+		DeliveryRetention: opts.DeliveryRetention,
+		MaxDeliveries:     opts.MaxDeliveries,
+
+		AsyncShutdownTimeout: opts.AsyncShutdownTimeout,
+
+		MaxConcurrentCalls: opts.MaxConcurrentCalls,
+		ChannelConcurrency: opts.ChannelConcurrency,
+		MaxQueuedCalls:     opts.MaxQueuedCalls,
+		ChannelRateLimits:  opts.ChannelRateLimits,
+
+		callees:     newCalleeRegistrations(),
+		rateLimiter: newRateLimiter(DefaultMaxRateLimitBuckets),
 	}
 }
 
-func (s *Server) ListenAndServe() (io.Closer, error) {
+func (s *Server) ListenAndServe() (_ io.Closer, err error) {
 	var (
 		netAddr  = s.NetAddr
 		wsPort   = s.WsPort
@@ -79,7 +181,38 @@ func (s *Server) ListenAndServe() (io.Closer, error) {
 		},
 	}
 
+	for ch, limit := range s.ChannelRateLimits {
+		if err := limit.Validate(); err != nil {
+			return nil, fmt.Errorf("rate limit of %s: %v", ch, err)
+		}
+	}
+
 	closer := &Closer{}
+	// Releases the BoltDB file and the ports taken so far, so that the server can be started again
+	defer func() {
+		if err != nil {
+			closer.Close()
+		}
+	}()
+
+	store := s.Store
+	if store == nil && s.StorePath != "" {
+		bolt, err := NewBoltRouteStore(s.StorePath)
+		if err != nil {
+			return nil, err
+		}
+		store = bolt
+		closer.store = bolt
+	}
+	s.RouteTable.Store = store
+	if s.DeadLetterStore == nil {
+		if b, ok := store.(*BoltRouteStore); ok {
+			s.DeadLetterStore = b.DeadLetters()
+		}
+	}
+	if err := s.restoreRoutes(); err != nil {
+		return nil, err
+	}
 
 	nxr, err := router.NewRouter(routerConfig, nil)
 	if err != nil {
@@ -106,15 +239,41 @@ func (s *Server) ListenAndServe() (io.Closer, error) {
 	wsAddr := fmt.Sprintf("%s:%d", netAddr, wsPort)
 	wsCloser, err := wss.ListenAndServe(wsAddr)
 	if err != nil {
-		return closer, err
+		return nil, err
 	}
 	closer.wsCloser = wsCloser
 
 	log.Printf("Websocket server listening on ws://%s/", wsAddr)
 
+	asyncWorkers, asyncQueueSize, deliveryRetention := s.AsyncWorkers, s.AsyncQueueSize, s.DeliveryRetention
+	if asyncWorkers == 0 {
+		asyncWorkers = DefaultAsyncWorkers
+	}
+	if asyncQueueSize == 0 {
+		asyncQueueSize = DefaultAsyncQueueSize
+	}
+	if deliveryRetention == 0 {
+		deliveryRetention = DefaultDeliveryRetention
+	}
+	maxDeliveries, asyncShutdownTimeout := s.MaxDeliveries, s.AsyncShutdownTimeout
+	if maxDeliveries == 0 {
+		maxDeliveries = DefaultMaxDeliveries
+	}
+	if asyncShutdownTimeout == 0 {
+		asyncShutdownTimeout = DefaultAsyncShutdownTimeout
+	}
+	s.deliveries = newDeliveryQueue(asyncQueueSize, maxDeliveries, deliveryRetention, asyncShutdownTimeout)
+
+	maxQueuedCalls := s.MaxQueuedCalls
+	if maxQueuedCalls < 0 {
+		maxQueuedCalls = DefaultMaxQueuedCalls
+	}
+	s.limiter = newCallLimiter(s.MaxConcurrentCalls, s.ChannelConcurrency, maxQueuedCalls)
+
 	httpHandler := s.CreateHttpHandler()
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", httpHandler)
+	mux.HandleFunc(DeliveriesPath, s.serveDelivery)
 	go func() {
 		httpAddr := fmt.Sprintf("%s:%d", netAddr, httpPort)
 		log.Printf("Http server listening on %s", httpAddr)
@@ -124,18 +283,54 @@ func (s *Server) ListenAndServe() (io.Closer, error) {
 		}
 	}()
 
+	if s.MetricsAddr != "" {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/debug/vars", expvar.Handler())
+		go func() {
+			log.Printf("Metrics server listening on %s", s.MetricsAddr)
+			err := http.ListenAndServe(s.MetricsAddr, metricsMux)
+			if err != nil {
+				log.Fatalf("error: %v", err)
+			}
+		}()
+	}
+
 	localCallerConn, err := s.Connect("LOCAL_CLIENT")
 	if err != nil {
 		return nil, err
 	}
 
 	s.internalClient = localCallerConn
+	s.startDeliveryWorkers(asyncWorkers)
+	closer.deliveries = s.deliveries
 
 	if err := s.startRegistrationServer(); err != nil {
 		return nil, err
 	}
 
-	return wsCloser, nil
+	if err := s.startEventServer(); err != nil {
+		return nil, err
+	}
+
+	if err := s.startIntrospectionServer(); err != nil {
+		return nil, err
+	}
+
+	if err := s.startDeadLetterServer(); err != nil {
+		return nil, err
+	}
+
+	if err := s.startSessionWatcher(); err != nil {
+		return nil, err
+	}
+
+	reconcileTimeout := s.ReconcileTimeout
+	if reconcileTimeout == 0 {
+		reconcileTimeout = DefaultReconcileTimeout
+	}
+	closer.reconcile = time.AfterFunc(reconcileTimeout, s.reconcileRoutes)
+
+	return closer, nil
 }
 
 type ServerRef interface {
@@ -145,12 +340,25 @@ type ServerRef interface {
 type RemoteServerRef struct {
 	Realm string
 	URL   string
+
+	// Logger is used by the WAMP client. Defaults to a logger writing to stdout
+	Logger *log.Logger
 }
 
 type RouteConfig struct {
 	RouteCondition `mapstructure:",squash"`
 	Proc  bool
 	Topic bool
+	// Dispatch is how events are delivered to the procedures when more than one callee registers to the route
+	Dispatch Dispatch
+	// Priority makes the procedures preferred over the ones of the other routes matching the same event. Defaults to 0
+	Priority int
+	// Retry is how the procedures are called again when they fail. Defaults to no retries
+	Retry *RetryPolicy
+	// Async makes the HTTP gateway acknowledge the events with 202 and a delivery ID before delivering them in the background
+	Async bool
+	// RateLimit limits the rate of the events delivered to the procedures. Defaults to no limit
+	RateLimit *RateLimit
 }
 
 func (s *Server) startRegistrationServer() error {
@@ -163,12 +371,11 @@ func (s *Server) startRegistrationServer() error {
 	// Registration Server
 
 	ResponseOK := "OK"
-	if err := localRegistrationServerConn.serve(On(api.ChannelStartRouting).All(), func(in interface{}) (interface{}, error) {
+	if err := localRegistrationServerConn.serveWithCaller(On(api.ChannelStartRouting).All(), func(in interface{}, caller wamp.ID) (interface{}, error) {
 		var reg RouteConfig
 		var ok bool
 		reg, ok = in.(RouteConfig)
 		if !ok {
-			fmt.Printf("decoding %v\n", in)
 			config := &mapstructure.DecoderConfig{
 				ErrorUnused: true,
 				Metadata: nil,
@@ -182,19 +389,20 @@ func (s *Server) startRegistrationServer() error {
 				return nil, fmt.Errorf("registration server: unexpected type of input %T: %v: %v", in, in, err)
 			}
 		}
-		fmt.Printf("server: registering %v\n", reg)
-		s.StartRouting(reg)
+		log.Printf("registering route %s for session %v", reg.ID(), caller)
+		if err := s.startRouting(reg, caller); err != nil {
+			return nil, err
+		}
 		return ResponseOK, err
 	}); err != nil {
 		return err
 	}
 
-	if err := localRegistrationServerConn.serve(On(api.ChannelStopRouting).All(), func(in interface{}) (interface{}, error) {
+	if err := localRegistrationServerConn.serveWithCaller(On(api.ChannelStopRouting).All(), func(in interface{}, caller wamp.ID) (interface{}, error) {
 		var reg RouteConfig
 		var ok bool
 		reg, ok = in.(RouteConfig)
 		if !ok {
-			fmt.Printf("decoding %v\n", in)
 			config := &mapstructure.DecoderConfig{
 				ErrorUnused: true,
 				Metadata: nil,
@@ -208,8 +416,10 @@ func (s *Server) startRegistrationServer() error {
 				return nil, fmt.Errorf("registration server: unexpected type of input %T: %v: %v", in, in, err)
 			}
 		}
-		fmt.Printf("server: stopping route %v\n", reg)
-		s.StopRouting(reg)
+		log.Printf("stopping route %s for session %v", reg.ID(), caller)
+		if err := s.stopRouting(reg, caller); err != nil {
+			return nil, err
+		}
 		return ResponseOK, err
 	}); err != nil {
 		return err
@@ -218,6 +428,44 @@ func (s *Server) startRegistrationServer() error {
 	return nil
 }
 
+// startEventServer serves the procedures to send events to channels, so that remote clients can send events like the http gateway does.
+func (s *Server) startEventServer() error {
+	conn, err := s.Connect("diplomatEventServer")
+	if err != nil {
+		return err
+	}
+
+	if err := conn.Register(api.ChannelCall.SendChannelURL(), func(ctx context.Context, args wamp.List, kwargs wamp.Dict, details wamp.Dict) *client.InvokeResult {
+		evt, err := kwargsToEvent(kwargs)
+		if err != nil {
+			return errorToInvokeResult(err)
+		}
+		// The context is canceled when the remote caller cancels the call
+		out, err := s.CallContext(ctx, *evt)
+		if err != nil {
+			return errorToInvokeResult(err)
+		}
+		return &client.InvokeResult{Kwargs: outputToKwargs(out)}
+	}, make(wamp.Dict)); err != nil {
+		return fmt.Errorf("Failed to register %q: %s", api.ChannelCall, err)
+	}
+
+	if err := conn.Register(api.ChannelPublish.SendChannelURL(), func(ctx context.Context, args wamp.List, kwargs wamp.Dict, details wamp.Dict) *client.InvokeResult {
+		evt, err := kwargsToEvent(kwargs)
+		if err != nil {
+			return errorToInvokeResult(err)
+		}
+		if err := s.PublishContext(ctx, *evt); err != nil {
+			return errorToInvokeResult(err)
+		}
+		return &client.InvokeResult{}
+	}, make(wamp.Dict)); err != nil {
+		return fmt.Errorf("Failed to register %q: %s", api.ChannelPublish, err)
+	}
+
+	return nil
+}
+
 func (s *Server) Connect(name string) (*Client, error) {
 	logger := log.New(os.Stdout, fmt.Sprintf("local %s> ", name), log.LstdFlags)
 	cfg := client.Config{
@@ -232,28 +480,121 @@ func (s *Server) Connect(name string) (*Client, error) {
 	return &Client{c}, nil
 }
 
-func (srv *Server) StartRouting(reg RouteConfig) {
+// StartRouting adds the receivers of the route owned by nobody, which are never removed automatically
+func (srv *Server) StartRouting(reg RouteConfig) error {
+	return srv.startRouting(reg, 0)
+}
+
+// startRouting adds the receivers of the route owned by the WAMP session, which are removed when the session leaves
+func (srv *Server) startRouting(reg RouteConfig, session wamp.ID) error {
+	if err := reg.RouteCondition.Validate(); err != nil {
+		return err
+	}
+	if err := reg.Dispatch.Validate(); err != nil {
+		return err
+	}
+	if err := reg.Retry.Validate(); err != nil {
+		return err
+	}
+	if err := reg.RateLimit.Validate(); err != nil {
+		return err
+	}
 	if reg.Proc {
-		srv.AddConditionalRouteToProcedure(reg.RouteCondition)
+		if _, err := srv.AddProcedure(reg, session); err != nil {
+			return err
+		}
 	}
 	if reg.Topic {
-		srv.AddConditionalRouteToTopic(reg.RouteCondition)
+		if _, err := srv.AddTopic(reg.RouteCondition, session); err != nil {
+			srv.Sync(srv.RouteTable, reg.RouteCondition)
+			return err
+		}
 	}
 	log.Printf("Route added: %v", reg.RouteCondition)
-	route := srv.GetRoute(reg.RouteCondition)
-	srv.Index(route)
+	srv.Sync(srv.RouteTable, reg.RouteCondition)
+	return nil
 }
 
-func (srv *Server) StopRouting(reg RouteConfig) {
+func (srv *Server) StopRouting(reg RouteConfig) error {
+	return srv.stopRouting(reg, 0)
+}
+
+func (srv *Server) stopRouting(reg RouteConfig, session wamp.ID) error {
+	var err error
 	if reg.Proc {
-		srv.DelConditionalRouteToProcedure(reg.RouteCondition)
+		_, err = srv.DelProcedure(reg.RouteCondition, session)
 	}
-	if reg.Topic {
-		srv.DelConditionalRouteToTopic(reg.RouteCondition)
+	if reg.Topic && err == nil {
+		_, err = srv.DelTopic(reg.RouteCondition, session)
 	}
 	log.Printf("Route deleted: %v", reg.RouteCondition)
-	route := srv.GetRoute(reg.RouteCondition)
-	srv.Delete(route)
+	srv.Sync(srv.RouteTable, reg.RouteCondition)
+	return err
+}
+
+// restoreRoutes loads the routes persisted before the restart into the table and the index,
+// so that events are routed to the receivers as soon as they reconnect
+func (srv *Server) restoreRoutes() error {
+	routes, err := srv.Restore()
+	if err != nil {
+		return err
+	}
+	for _, r := range routes {
+		srv.Sync(srv.RouteTable, r.RouteCondition)
+	}
+	log.Printf("Restored %d routes", len(routes))
+	return nil
+}
+
+// reconcileRoutes drops the restored receivers that did not reconnect, according to the callees and subscribers registered in the router
+func (srv *Server) reconcileRoutes() {
+	for _, c := range srv.Unclaimed() {
+		uri := c.ReceiverName()
+		subscribers, err := srv.countReceivers(wamp.MetaProcSubLookup, wamp.MetaProcSubCountSubscribers, uri)
+		if err != nil {
+			log.Printf("unable to reconcile route %s: %v", c.ID(), err)
+			continue
+		}
+		callees, err := srv.countReceivers(wamp.MetaProcRegLookup, wamp.MetaProcRegCountCallees, uri)
+		if err != nil {
+			log.Printf("unable to reconcile route %s: %v", c.ID(), err)
+			continue
+		}
+		if err := srv.Reconcile(c, subscribers, callees); err != nil {
+			log.Printf("unable to reconcile route %s: %v", c.ID(), err)
+		}
+		srv.Sync(srv.RouteTable, c)
+		log.Printf("Route reconciled: %s with %d subscribers and %d callees", c.ID(), subscribers, callees)
+	}
+}
+
+// countReceivers returns the number of the sessions subscribed or registered to the URI, using the router's meta procedures
+func (srv *Server) countReceivers(lookup, count wamp.URI, uri string) (int, error) {
+	ctx := context.Background()
+	res, err := srv.internalClient.Client.Call(ctx, string(lookup), nil, wamp.List{uri}, nil, "")
+	if err != nil {
+		return 0, fmt.Errorf("%s failed: %v", lookup, err)
+	}
+	var id wamp.ID
+	if len(res.Arguments) > 0 {
+		id, _ = wamp.AsID(res.Arguments[0])
+	}
+	// The router returns no ID for URIs without any receiver
+	if id == 0 {
+		return 0, nil
+	}
+	res, err = srv.internalClient.Client.Call(ctx, string(count), nil, wamp.List{id}, nil, "")
+	if err != nil {
+		return 0, fmt.Errorf("%s failed: %v", count, err)
+	}
+	if len(res.Arguments) == 0 {
+		return 0, fmt.Errorf("%s returned no count", count)
+	}
+	n, ok := wamp.AsInt64(res.Arguments[0])
+	if !ok {
+		return 0, fmt.Errorf("%s returned unexpected count: %v", count, res.Arguments[0])
+	}
+	return int(n), nil
 }
 
 func NewWsServerRef(realm, host string, port int) *RemoteServerRef {
@@ -264,7 +605,10 @@ func NewWsServerRef(realm, host string, port int) *RemoteServerRef {
 }
 
 func (s *RemoteServerRef) Connect(name string) (*Client, error) {
-	logger := log.New(os.Stdout, fmt.Sprintf("ws %s> ", name), log.LstdFlags)
+	logger := s.Logger
+	if logger == nil {
+		logger = log.New(os.Stdout, fmt.Sprintf("ws %s> ", name), log.LstdFlags)
+	}
 	cfg := client.Config{
 		Realm:  s.Realm,
 		Logger: logger,
@@ -279,10 +623,20 @@ func (s *RemoteServerRef) Connect(name string) (*Client, error) {
 
 type Event struct {
 	Channel string
+	// Method is the HTTP method of the request, which is empty for events that are not HTTP requests
+	Method string
+	// RawQuery is the query string of the request without the leading `?`
+	RawQuery string
 	Body []byte
 	Header map[string][]string
 }
 
+// Query returns the query parameters of the event. Malformed pairs are ignored as in `url.URL.Query`
+func (evt Event) Query() url.Values {
+	q, _ := url.ParseQuery(evt.RawQuery)
+	return q
+}
+
 type Output struct {
 	Body []byte
 	Header map[string][]string
@@ -290,70 +644,141 @@ type Output struct {
 }
 
 // Publish emits the event, but do not wait for the result hence returns immediately.
-// Returns non-nil error if event was unable to be published
+// Returns non-nil error if event was unable to be published. Events that matched no route are still published to the channel.
 func (srv *Server) Publish(evt Event) error {
-	_, err := srv.Call(evt)
+	return srv.PublishContext(context.Background(), evt)
+}
+
+// PublishContext is like Publish, but gives up delivering the event to the procedures when the context is done
+func (srv *Server) PublishContext(ctx context.Context, evt Event) error {
+	_, err := srv.CallContext(ctx, evt)
+	if kind := ErrorKind(err); kind == ErrNoRoute || kind == ErrPartialMatch {
+		return nil
+	}
 	return err
 }
 
 // Call emits the event and returns the output if the event was handled by any registered callee.
+// When more than one route with procedures matched, their procedures are called in the order of rankRoutes until any of them succeeds.
+// The error is a *RouteError when the event was unable to be routed or delivered. See ErrorKind for its kinds.
+// The output has the status code 202 when the event matched only routes without procedures.
+// Events that failed to be delivered to the procedures of the matched routes, or timed out, are published to the dead-letter topic along with the error.
+// So are the events that matched no route, including the fallback route of the channel.
 func (srv *Server) Call(evt Event) (*Output, error) {
+	return srv.CallContext(context.Background(), evt)
+}
+
+// CallContext is like Call, but cancels the calls to the procedures when the context is done or CallTimeout of the server elapsed.
+// Callees see the cancellation as the router interrupting their invocations, and the error is ErrCanceled.
+func (srv *Server) CallContext(ctx context.Context, evt Event) (*Output, error) {
+	if srv.CallTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, srv.CallTimeout)
+		defer cancel()
+	}
+	out, err := srv.call(ctx, evt)
+	switch {
+	case err == nil:
+	case deliveryFailed(ctx, err):
+		srv.deadLetter(evt, err)
+	case unmatched(err):
+		srv.publishDeadLetter(newDeadLetter(evt, err))
+	}
+	return out, err
+}
+
+func (srv *Server) call(ctx context.Context, evt Event) (*Output, error) {
 	sendproc := evt.Channel
 	body := evt.Body
-	header := evt.Header
 	log.Printf("Processing event: %s", body)
 
-	kwargs := wamp.Dict{"body": body, "header": header}
-	if err := srv.internalClient.Publish(sendproc, nil, wamp.List{}, kwargs); err != nil {
-		log.Fatalf("publish failed: %v", err)
+	idsAndScores, searchErr := srv.SearchRouteMatchesEvent(evt)
+	routes := []*Route{}
+	procRoutes := []rankedRoute{}
+	for routeCondId, score := range idsAndScores {
+		route := srv.GetRoute(routeCondId)
+		if route == nil {
+			// Deleted after the search
+			continue
+		}
+		routes = append(routes, route)
+		if len(route.Procedures) > 0 {
+			procRoutes = append(procRoutes, rankedRoute{Route: route, Score: score})
+		}
+	}
+	// Checked before anything is published, so that no topic receives the event that is rejected
+	for _, route := range routes {
+		if len(route.Procedures) > 1 && route.Dispatch == DispatchSingle {
+			return nil, &RouteError{Kind: ErrAmbiguousRoute, Channel: evt.Channel, Route: route.ID(), Err: fmt.Errorf("%d procedures attached", len(route.Procedures))}
+		}
 	}
+	rankRoutes(procRoutes)
 
-	idsAndScores, err := srv.SearchRouteMatchesChannelAndJSON(sendproc, body)
-	if err != nil {
-		return nil, fmt.Errorf("handle event failed: %v", err)
+	// Limited before anything is published or called, so that events over the limits reach no topic or procedure
+	procRoutes, out, err := srv.limitEvent(ctx, evt, procRoutes)
+	if out != nil || err != nil {
+		return out, err
 	}
 
-	fmt.Printf("score %+v\n", idsAndScores)
+	kwargs := eventToKwargs(evt)
+	if err := srv.internalClient.Publish(sendproc, nil, wamp.List{}, kwargs); err != nil {
+		return nil, &RouteError{Kind: ErrPublishFailed, Channel: evt.Channel, Err: err}
+	}
 
-	procHandled := false
-	var out *Output
+	if searchErr == errUnknownChannel {
+		return nil, &RouteError{Kind: ErrNoRoute, Channel: evt.Channel, Err: searchErr}
+	}
+	if searchErr != nil {
+		return nil, &RouteError{Kind: ErrInvalidEvent, Channel: evt.Channel, Err: searchErr}
+	}
+	if len(idsAndScores) == 0 {
+		return nil, srv.noRouteError(evt)
+	}
 
-	for routeCondId, score := range idsAndScores {
-		route := srv.GetRoute(routeCondId)
-		thres := len(route.RouteCondition.Expressions)
-		if score < thres {
-			log.Fatalf("skipping route %s due to low score: needs %d, got %d", route.ID(), thres, score)
-		}
-		topics := route.Topics
-		procs := route.Procedures
-		fmt.Printf("publishing to %s\n", topics)
-		for _, t := range topics {
+	for _, route := range routes {
+		for _, t := range route.Topics {
 			if err := srv.internalClient.Publish(t, nil, wamp.List{}, kwargs); err != nil {
-				log.Fatal(err)
+				return nil, &RouteError{Kind: ErrPublishFailed, Channel: evt.Channel, Route: route.ID(), Err: err}
 			}
 		}
+	}
 
-		if len(procs) > 1 {
-			log.Fatalf("too many procs: %d", len(procs))
-		}
+	if len(procRoutes) == 0 {
+		return &Output{Body: []byte(`{"message":"no proc handler found"}`), StatusCode: http.StatusAccepted}, nil
+	}
 
-		if procHandled {
-			continue
+	log.Printf("Route selected: %s: %s", procRoutes[0].ID(), rankReason(procRoutes))
+
+	var callErr *RouteError
+	attempts := 0
+	for _, route := range procRoutes {
+		out, n, err := srv.dispatchWithRetry(ctx, route.Route, evt)
+		attempts += n
+		if err == nil {
+			return out, nil
 		}
-		for _, p := range procs {
-			out, err = ProgressiveCall(srv.internalClient.Client, p, evt, 64)
-			if err != nil {
-				log.Printf("progressive call failed. continuing in case there is available callee to respond: %v", err)
-			} else {
-				procHandled = true
-				break
-			}
+		if ctx.Err() != nil {
+			return nil, &RouteError{Kind: ErrCanceled, Channel: evt.Channel, Route: route.ID(), Err: ctx.Err(), Attempts: attempts}
 		}
+		log.Printf("progressive call failed. continuing in case there is available callee to respond: %v", err)
+		callErr = &RouteError{Kind: ErrCalleeFailed, Channel: evt.Channel, Route: route.ID(), Err: err}
+	}
+	callErr.Attempts = attempts
+	return nil, callErr
+}
+
+// noRouteError tells whether any route matched the event partially, so that senders can tell a typo in the event from a missing route
+func (srv *Server) noRouteError(evt Event) error {
+	scores, err := srv.ScoreRoutesEvent(evt)
+	if err != nil || len(scores) == 0 {
+		return &RouteError{Kind: ErrNoRoute, Channel: evt.Channel}
 	}
-	if procHandled {
-		return out, nil
+	ids := []string{}
+	for id := range scores {
+		ids = append(ids, string(id))
 	}
-	return &Output{Body: []byte(`{"message":"no proc handler found"}`)}, nil
+	sort.Strings(ids)
+	return &RouteError{Kind: ErrPartialMatch, Channel: evt.Channel, Err: fmt.Errorf("closest routes: %s", strings.Join(ids, ", "))}
 }
 
 //func (srv *Server) TestProgressiveCall(procName string, evt []byte) ([]byte, error) {
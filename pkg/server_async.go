@@ -0,0 +1,322 @@
+package diplomat
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultAsyncWorkers is the number of the events delivered at once in the background when Server.AsyncWorkers is not given
+	DefaultAsyncWorkers = 4
+	// DefaultAsyncQueueSize is the number of the events waiting for the workers at most when Server.AsyncQueueSize is not given
+	DefaultAsyncQueueSize = 100
+	// DefaultDeliveryRetention is how long finished deliveries are kept for polling when Server.DeliveryRetention is not given
+	DefaultDeliveryRetention = time.Hour
+	// DefaultMaxDeliveries is the number of the deliveries kept for polling at most when Server.MaxDeliveries is not given
+	DefaultMaxDeliveries = 10000
+	// DefaultAsyncShutdownTimeout is how long closing the server waits for the queued events when Server.AsyncShutdownTimeout is not given
+	DefaultAsyncShutdownTimeout = 30 * time.Second
+)
+
+// DeliveriesPath is the path of the HTTP server to poll deliveries at, like `/diplomat/deliveries/<id>`
+const DeliveriesPath = "/diplomat/deliveries/"
+
+type DeliveryStatus string
+
+const (
+	DeliveryQueued    DeliveryStatus = "queued"
+	DeliveryRunning   DeliveryStatus = "running"
+	DeliverySucceeded DeliveryStatus = "succeeded"
+	DeliveryFailed    DeliveryStatus = "failed"
+)
+
+// Delivery is an event that the HTTP gateway acknowledged before delivering it to an async route, whose output is polled by its ID
+type Delivery struct {
+	// ID is the random 128-bit hex string that the delivery is polled by, which is unable to be guessed from other deliveries
+	ID      string
+	Channel string
+	// Route is the async route that the event was acknowledged for. Call may still deliver it to another route
+	Route  RouteConditionID
+	Status DeliveryStatus
+	// Output is the output of the procedure once the delivery succeeded
+	Output *Output
+	// Error is the error once the delivery failed, whose event is sent to the dead-letter topic as well
+	Error string
+	// StatusCode is what the gateway would have responded with if the event were delivered synchronously
+	StatusCode  int
+	ReceivedAt  time.Time
+	CompletedAt time.Time
+}
+
+// deliveryQueue is the bounded queue of the events acknowledged by the HTTP gateway, along with the deliveries kept for polling
+type deliveryQueue struct {
+	work            chan queuedEvent
+	maxDeliveries   int
+	retention       time.Duration
+	shutdownTimeout time.Duration
+	workers         sync.WaitGroup
+	// ctx is canceled when the queue failed to be drained in shutdownTimeout, which cancels the deliveries left
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu         sync.Mutex
+	deliveries map[string]*Delivery
+	lastPrune  time.Time
+	// closed is set once the queue stops accepting events, so that nothing is sent to the closed work channel
+	closed bool
+}
+
+type queuedEvent struct {
+	id    string
+	evt   Event
+	route RouteConditionID
+	// release returns the concurrency limits taken for the event, once it is delivered
+	release func()
+}
+
+func newDeliveryQueue(size, maxDeliveries int, retention, shutdownTimeout time.Duration) *deliveryQueue {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &deliveryQueue{
+		work:            make(chan queuedEvent, size),
+		maxDeliveries:   maxDeliveries,
+		retention:       retention,
+		shutdownTimeout: shutdownTimeout,
+		ctx:             ctx,
+		cancel:          cancel,
+		deliveries:      map[string]*Delivery{},
+	}
+}
+
+// asyncRoute returns the route that Call would dispatch the event to first when the route acknowledges events asynchronously, and nil otherwise.
+// Events that are unable to be routed are left to Call, so that the gateway responds with the routing errors as usual.
+func (srv *Server) asyncRoute(evt Event) *Route {
+	idsAndScores, err := srv.SearchRouteMatchesEvent(evt)
+	if err != nil {
+		return nil
+	}
+	procRoutes := []rankedRoute{}
+	for id, score := range idsAndScores {
+		route := srv.GetRoute(id)
+		if route == nil || len(route.Procedures) == 0 {
+			continue
+		}
+		procRoutes = append(procRoutes, rankedRoute{Route: route, Score: score})
+	}
+	if len(procRoutes) == 0 {
+		return nil
+	}
+	rankRoutes(procRoutes)
+	if !procRoutes[0].Async {
+		return nil
+	}
+	return procRoutes[0].Route
+}
+
+// enqueueDelivery queues the event to be delivered in the background, and returns the delivery to poll.
+// It fails with ErrQueueFull rather than waiting for the workers, so that the gateway never blocks,
+// and when as many deliveries as maxDeliveries are kept, so that bursts of events do not take up the memory until their retention.
+// The release func, if any, is called once the event is delivered, and is left to the caller when the event is not queued.
+func (srv *Server) enqueueDelivery(evt Event, route *Route, release func()) (*Delivery, error) {
+	q := srv.deliveries
+	id, err := newDeliveryID()
+	if err != nil {
+		return nil, err
+	}
+	d := &Delivery{
+		ID:         id,
+		Channel:    evt.Channel,
+		Route:      route.ID(),
+		Status:     DeliveryQueued,
+		ReceivedAt: time.Now(),
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return nil, &RouteError{Kind: ErrQueueFull, Channel: evt.Channel, Route: route.ID(), Err: fmt.Errorf("server is shutting down")}
+	}
+	full := len(q.deliveries) >= q.maxDeliveries
+	q.prune(full)
+	if len(q.deliveries) >= q.maxDeliveries {
+		return nil, &RouteError{Kind: ErrQueueFull, Channel: evt.Channel, Route: route.ID(), Err: fmt.Errorf("%d deliveries kept for polling", len(q.deliveries))}
+	}
+	select {
+	case q.work <- queuedEvent{id: d.ID, evt: evt, route: d.Route, release: release}:
+	default:
+		return nil, &RouteError{Kind: ErrQueueFull, Channel: evt.Channel, Route: route.ID()}
+	}
+	q.deliveries[d.ID] = d
+	copied := *d
+	return &copied, nil
+}
+
+// newDeliveryID returns a random ID, as anyone who knows the ID of a delivery is able to poll its output
+func newDeliveryID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("unable to generate delivery id: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// close stops accepting events, and waits for the workers to deliver the ones already queued.
+// The deliveries left after shutdownTimeout are canceled, so that callees that never respond do not block the shutdown
+func (q *deliveryQueue) close() {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.work)
+	}
+	q.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		q.workers.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(q.shutdownTimeout):
+		log.Printf("Canceling the deliveries left after %s", q.shutdownTimeout)
+		q.cancel()
+		<-drained
+	}
+	q.cancel()
+}
+
+// prune drops the deliveries finished before the retention, at most once a minute unless forced
+func (q *deliveryQueue) prune(force bool) {
+	now := time.Now()
+	if !force && now.Sub(q.lastPrune) < time.Minute {
+		return
+	}
+	q.lastPrune = now
+	for id, d := range q.deliveries {
+		if q.expired(d, now) {
+			delete(q.deliveries, id)
+		}
+	}
+}
+
+// expired tells whether the delivery finished before the retention, which is dropped by the next prune
+func (q *deliveryQueue) expired(d *Delivery, now time.Time) bool {
+	return !d.CompletedAt.IsZero() && now.Sub(d.CompletedAt) > q.retention
+}
+
+// Delivery returns the delivery of the event acknowledged asynchronously, or false when it is unknown or expired
+func (srv *Server) Delivery(id string) (*Delivery, bool) {
+	q := srv.deliveries
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	d, ok := q.deliveries[id]
+	if !ok || q.expired(d, time.Now()) {
+		return nil, false
+	}
+	copied := *d
+	return &copied, true
+}
+
+func (q *deliveryQueue) update(id string, f func(d *Delivery)) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if d, ok := q.deliveries[id]; ok {
+		f(d)
+	}
+}
+
+// startDeliveryWorkers delivers the queued events in the background with Call, which takes CallTimeout of the server into account.
+// The workers exit once the queue is closed and drained.
+// Events canceled by the shutdown are sent to the dead-letter topic, as their senders were told that they would be delivered
+func (srv *Server) startDeliveryWorkers(workers int) {
+	q := srv.deliveries
+	q.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer q.workers.Done()
+			for e := range q.work {
+				q.update(e.id, func(d *Delivery) { d.Status = DeliveryRunning })
+				var out *Output
+				var err error
+				if q.ctx.Err() != nil {
+					err = &RouteError{Kind: ErrCanceled, Channel: e.evt.Channel, Route: e.route, Err: q.ctx.Err()}
+				} else {
+					out, err = srv.CallContext(q.ctx, e.evt)
+				}
+				if e.release != nil {
+					e.release()
+				}
+				if ErrorKind(err) == ErrCanceled && q.ctx.Err() != nil {
+					srv.deadLetter(e.evt, err)
+				}
+				q.update(e.id, func(d *Delivery) {
+					d.CompletedAt = time.Now()
+					if err != nil {
+						log.Printf("Delivery %s failed: %v", e.id, err)
+						d.Status = DeliveryFailed
+						d.Error = err.Error()
+						d.StatusCode = StatusCode(err)
+						return
+					}
+					d.Status = DeliverySucceeded
+					d.Output = out
+					d.StatusCode = out.StatusCode
+					if d.StatusCode == 0 {
+						d.StatusCode = http.StatusOK
+					}
+				})
+			}
+		}()
+	}
+}
+
+// serveDelivery responds with the delivery at DeliveriesPath, including the output once it succeeded
+func (srv *Server) serveDelivery(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, DeliveriesPath)
+	d, ok := srv.Delivery(id)
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"message": "delivery not found: " + id})
+		return
+	}
+	writeJSON(w, http.StatusOK, deliveryValue(d))
+}
+
+// writeAccepted acknowledges the event with the delivery to poll at its location
+func writeAccepted(w http.ResponseWriter, d *Delivery) {
+	location := DeliveriesPath + d.ID
+	w.Header().Set("Location", location)
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{"id": d.ID, "status": d.Status, "location": location})
+}
+
+// deliveryValue is the delivery in JSON, with the body of the output included as is when it is JSON and as a string otherwise
+func deliveryValue(d *Delivery) map[string]interface{} {
+	v := map[string]interface{}{
+		"id":         d.ID,
+		"channel":    d.Channel,
+		"route":      d.Route,
+		"status":     d.Status,
+		"receivedAt": d.ReceivedAt,
+	}
+	if !d.CompletedAt.IsZero() {
+		v["completedAt"] = d.CompletedAt
+		v["statusCode"] = d.StatusCode
+	}
+	if d.Error != "" {
+		v["error"] = d.Error
+	}
+	if d.Output != nil {
+		var body interface{} = string(d.Output.Body)
+		if json.Valid(d.Output.Body) {
+			body = json.RawMessage(d.Output.Body)
+		}
+		v["header"] = d.Output.Header
+		v["body"] = body
+	}
+	return v
+}
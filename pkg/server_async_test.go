@@ -0,0 +1,268 @@
+package diplomat
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// startAsyncTestServer returns the test server delivering the events acknowledged for the routes in the background
+func startAsyncTestServer(t *testing.T, workers int, q *deliveryQueue) *Server {
+	srv := newTestServer(t)
+	if err := srv.startRegistrationServer(); err != nil {
+		t.Fatal(err)
+	}
+	srv.deliveries = q
+	srv.startDeliveryWorkers(workers)
+	return srv
+}
+
+// serveAsync serves the async route with the func, and returns the route
+func serveAsync(t *testing.T, srv *Server, cond RouteCondition, f func(evt []byte) ([]byte, error)) *Route {
+	c, err := srv.Connect(string(cond.ID()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.ServeRoute(RouteConfig{RouteCondition: cond, Async: true}, f); err != nil {
+		t.Fatal(err)
+	}
+	return srv.GetRoute(cond.ID())
+}
+
+// waitDelivery waits for the delivery to finish, and returns it
+func waitDelivery(t *testing.T, srv *Server, id string) *Delivery {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		d, ok := srv.Delivery(id)
+		if !ok {
+			t.Fatalf("unexpected missing delivery %s", id)
+		}
+		if !d.CompletedAt.IsZero() {
+			return d
+		}
+	}
+	t.Fatalf("unexpected delivery: want %s finished, got none", id)
+	return nil
+}
+
+func TestDeliveryStatus(t *testing.T) {
+	on := OnURL(testChannel)
+	srv := startAsyncTestServer(t, 2, newDeliveryQueue(10, 10, time.Hour, time.Second))
+	defer srv.nxr.Close()
+	routes := map[string]*Route{
+		"opened": serveAsync(t, srv, on.Where("action").EqString("opened"), func(evt []byte) ([]byte, error) { return evt, nil }),
+		"closed": serveAsync(t, srv, on.Where("action").EqString("closed"), func(evt []byte) ([]byte, error) { return nil, errors.New("unavailable") }),
+	}
+
+	testcases := []struct {
+		action     string
+		wantStatus DeliveryStatus
+		wantCode   int
+		wantBody   string
+	}{
+		{action: "opened", wantStatus: DeliverySucceeded, wantCode: http.StatusOK, wantBody: `{"action":"opened"}`},
+		{action: "closed", wantStatus: DeliveryFailed, wantCode: http.StatusBadGateway},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+		t.Run(tc.action, func(t *testing.T) {
+			body := `{"action":"` + tc.action + `"}`
+			queued, err := srv.enqueueDelivery(jsonEvent(body), routes[tc.action], nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if queued.Status != DeliveryQueued || len(queued.ID) != 32 {
+				t.Errorf("unexpected delivery: want a queued one with a 128-bit hex ID, got %+v", queued)
+			}
+			d := waitDelivery(t, srv, queued.ID)
+			if d.Status != tc.wantStatus || d.StatusCode != tc.wantCode || d.Route != routes[tc.action].ID() {
+				t.Errorf("unexpected delivery: want %s with %d by %s, got %+v", tc.wantStatus, tc.wantCode, routes[tc.action].ID(), d)
+			}
+			if (d.Error == "") != (tc.wantStatus == DeliverySucceeded) {
+				t.Errorf("unexpected error of the delivery: %q", d.Error)
+			}
+			if tc.wantBody != "" && (d.Output == nil || string(d.Output.Body) != tc.wantBody) {
+				t.Errorf("unexpected output: want %s, got %+v", tc.wantBody, d.Output)
+			}
+
+			rec := httptest.NewRecorder()
+			srv.serveDelivery(rec, httptest.NewRequest("GET", DeliveriesPath+queued.ID, nil))
+			got := map[string]interface{}{}
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil || rec.Code != http.StatusOK {
+				t.Fatalf("unexpected response: %d %s", rec.Code, rec.Body)
+			}
+			if got["status"] != string(tc.wantStatus) || got["statusCode"] != float64(tc.wantCode) {
+				t.Errorf("unexpected response: want %s with %d, got %v", tc.wantStatus, tc.wantCode, got)
+			}
+		})
+	}
+
+	t.Run("unknown", func(t *testing.T) {
+		if d, ok := srv.Delivery("unknown"); ok {
+			t.Errorf("unexpected delivery: %+v", d)
+		}
+		rec := httptest.NewRecorder()
+		srv.serveDelivery(rec, httptest.NewRequest("GET", DeliveriesPath+"unknown", nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("unexpected status: want %d, got %d", http.StatusNotFound, rec.Code)
+		}
+	})
+}
+
+func TestEnqueueDeliveryLimits(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.nxr.Close()
+	cond := OnURL(testChannel).Where("action").EqString("opened")
+	if err := srv.StartRouting(RouteConfig{RouteCondition: cond, Proc: true, Async: true}); err != nil {
+		t.Fatal(err)
+	}
+	route := srv.GetRoute(cond.ID())
+	// finish completes the delivery as if a worker delivered it the time ago
+	finish := func(q *deliveryQueue, id string, ago time.Duration) {
+		<-q.work
+		q.update(id, func(d *Delivery) {
+			d.Status = DeliverySucceeded
+			d.CompletedAt = time.Now().Add(-ago)
+		})
+	}
+
+	testcases := []struct {
+		name string
+		// The queue is not worked, so that the events stay queued unless finished by the test
+		queue *deliveryQueue
+		// prepare is run with the delivery enqueued first
+		prepare func(q *deliveryQueue, first *Delivery)
+		wantErr bool
+	}{
+		{name: "accepted", queue: newDeliveryQueue(2, 2, time.Hour, time.Second)},
+		{name: "queue full", queue: newDeliveryQueue(1, 10, time.Hour, time.Second), wantErr: true},
+		// Finished deliveries are kept for polling for their retention, taking up the room of new events
+		{
+			name:    "deliveries full",
+			queue:   newDeliveryQueue(10, 1, time.Hour, time.Second),
+			prepare: func(q *deliveryQueue, first *Delivery) { finish(q, first.ID, time.Minute) },
+			wantErr: true,
+		},
+		// Expired deliveries are pruned to make room, even within a minute from the last prune
+		{
+			name:    "expired delivery pruned",
+			queue:   newDeliveryQueue(10, 1, time.Hour, time.Second),
+			prepare: func(q *deliveryQueue, first *Delivery) { finish(q, first.ID, 2*time.Hour) },
+		},
+		{
+			name:    "closed",
+			queue:   newDeliveryQueue(10, 10, time.Hour, time.Second),
+			prepare: func(q *deliveryQueue, first *Delivery) { q.close() },
+			wantErr: true,
+		},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			srv.deliveries = tc.queue
+			first, err := srv.enqueueDelivery(jsonEvent(`{"action":"opened"}`), route, nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tc.prepare != nil {
+				tc.prepare(tc.queue, first)
+			}
+			_, err = srv.enqueueDelivery(jsonEvent(`{"action":"opened"}`), route, nil)
+			if tc.wantErr {
+				if ErrorKind(err) != ErrQueueFull || StatusCode(err) != http.StatusServiceUnavailable {
+					t.Errorf("unexpected error: want %v, got %v", ErrQueueFull, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestDeliveryQueueClose(t *testing.T) {
+	on := OnURL(testChannel)
+
+	t.Run("drained", func(t *testing.T) {
+		q := newDeliveryQueue(10, 10, time.Hour, 5*time.Second)
+		srv := startAsyncTestServer(t, 1, q)
+		defer srv.nxr.Close()
+		route := serveAsync(t, srv, on.Where("action").EqString("opened"), func(evt []byte) ([]byte, error) {
+			time.Sleep(20 * time.Millisecond)
+			return evt, nil
+		})
+		ids := []string{}
+		for i := 0; i < 3; i++ {
+			d, err := srv.enqueueDelivery(jsonEvent(`{"action":"opened"}`), route, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, d.ID)
+		}
+
+		q.close()
+		for _, id := range ids {
+			if d, _ := srv.Delivery(id); d == nil || d.Status != DeliverySucceeded {
+				t.Errorf("unexpected delivery after the close: want %s, got %+v", DeliverySucceeded, d)
+			}
+		}
+	})
+
+	t.Run("canceled after the timeout", func(t *testing.T) {
+		q := newDeliveryQueue(10, 10, time.Hour, 100*time.Millisecond)
+		srv := startAsyncTestServer(t, 1, q)
+		defer srv.nxr.Close()
+		store, remove := newTestDeadLetterStore(t)
+		defer remove()
+		srv.DeadLetterStore = store
+		// The callee never responds until the test ends
+		hung := make(chan struct{})
+		defer close(hung)
+		route := serveAsync(t, srv, on.Where("action").EqString("opened"), func(evt []byte) ([]byte, error) {
+			<-hung
+			return evt, nil
+		})
+		// The first event is delivered by the only worker, and the second one waits for it
+		ids := []string{}
+		for i := 0; i < 2; i++ {
+			d, err := srv.enqueueDelivery(jsonEvent(`{"action":"opened"}`), route, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, d.ID)
+		}
+
+		closed := make(chan struct{})
+		go func() {
+			q.close()
+			close(closed)
+		}()
+		select {
+		case <-closed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("unexpected close: want it returned after the timeout, got it blocked")
+		}
+		for _, id := range ids {
+			if d, _ := srv.Delivery(id); d == nil || d.Status != DeliveryFailed || d.StatusCode != http.StatusGatewayTimeout {
+				t.Errorf("unexpected delivery after the close: want %s with %d, got %+v", DeliveryFailed, http.StatusGatewayTimeout, d)
+			}
+		}
+		dls, err := store.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(dls) != len(ids) {
+			t.Fatalf("unexpected dead letters: want %d, got %+v", len(ids), dls)
+		}
+		for _, dl := range dls {
+			if dl.Reason != "diplomat.error.canceled" || dl.Route != route.ID() {
+				t.Errorf("unexpected dead letter: want the one canceled on %s, got %+v", route.ID(), dl)
+			}
+		}
+	})
+}
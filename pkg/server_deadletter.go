@@ -0,0 +1,268 @@
+package diplomat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gammazero/nexus/client"
+	"github.com/gammazero/nexus/wamp"
+	"github.com/mumoshu/diplomat/pkg/api"
+	"github.com/rs/xid"
+)
+
+// DefaultDeadLetterTopic is the topic that the server publishes dead letters to when DeadLetterTopic is not given
+var DefaultDeadLetterTopic = api.ChannelDeadLetter.SendChannelURL()
+
+// DeadLetter is an event that was unable to be delivered to the procedures of its route, published to the dead-letter topic of the server.
+// Sending the event again replays it.
+type DeadLetter struct {
+	// ID is unique to the dead letter, and sorted in the order the dead letters were generated
+	ID string
+	Event
+	// Reason is the WAMP error URI of the kind of the error, like `diplomat.error.callee_failed`
+	Reason wamp.URI
+	// Route is the route that failed to handle the event
+	Route RouteConditionID
+	Error string
+	// Attempts is the number of the procedure calls made for the event so far, including the ones made by replays
+	Attempts int
+	// FailedAt is when the event failed for the last time
+	FailedAt time.Time
+}
+
+func newDeadLetter(evt Event, err error) *DeadLetter {
+	dl := &DeadLetter{ID: xid.New().String(), Event: evt}
+	dl.failed(err)
+	return dl
+}
+
+// failed records the error of the latest attempts to deliver the event
+func (dl *DeadLetter) failed(err error) {
+	dl.Reason = errorURI(err)
+	dl.Error = err.Error()
+	dl.FailedAt = time.Now()
+	if e, ok := err.(*RouteError); ok {
+		dl.Route = e.Route
+		dl.Attempts += e.Attempts
+	}
+}
+
+// deliveryFailed reports whether the event was unable to be delivered to the procedures of the routes it matched, which is what dead letters are for.
+// Calls canceled by the caller are not, as only the ones that timed out were given up by the server
+func deliveryFailed(ctx context.Context, err error) bool {
+	switch ErrorKind(err) {
+	case ErrCalleeFailed:
+		return true
+	case ErrCanceled:
+		return ctx.Err() == context.DeadlineExceeded
+	}
+	return false
+}
+
+// unmatched reports whether the event matched no route on its channel, including the fallback route.
+// Unmatched events are published to the dead-letter topic with the reason `diplomat.error.no_route` or `diplomat.error.partial_match`,
+// but not persisted, as replaying them would fail again until a route is registered for them
+func unmatched(err error) bool {
+	kind := ErrorKind(err)
+	return kind == ErrNoRoute || kind == ErrPartialMatch
+}
+
+// deadLetter persists the event that failed to be delivered with the error to the dead-letter store, and publishes it to the dead-letter topic,
+// so that it can be inspected and replayed later
+func (srv *Server) deadLetter(evt Event, err error) {
+	dl := newDeadLetter(evt, err)
+	if srv.DeadLetterStore != nil {
+		if err := srv.DeadLetterStore.Save(dl); err != nil {
+			log.Printf("unable to persist dead letter of %s: %v", evt.Channel, err)
+		}
+	}
+	srv.publishDeadLetter(dl)
+}
+
+// publishDeadLetter publishes the dead letter to DeadLetterTopic of the server, or DefaultDeadLetterTopic
+func (srv *Server) publishDeadLetter(dl *DeadLetter) {
+	topic := srv.DeadLetterTopic
+	if topic == "" {
+		topic = DefaultDeadLetterTopic
+	}
+	if err := srv.internalClient.Publish(topic, nil, wamp.List{}, deadLetterToKwargs(dl)); err != nil {
+		log.Printf("unable to publish dead letter of %s to %s: %v", dl.Channel, topic, err)
+		return
+	}
+	log.Printf("Dead letter %s published to %s: %s", dl.ID, topic, dl.Error)
+}
+
+func (srv *Server) deadLetterStore() (DeadLetterStore, error) {
+	if srv.DeadLetterStore == nil {
+		return nil, fmt.Errorf("no dead-letter store configured")
+	}
+	return srv.DeadLetterStore, nil
+}
+
+func (srv *Server) ListDeadLetters() ([]*DeadLetter, error) {
+	store, err := srv.deadLetterStore()
+	if err != nil {
+		return nil, err
+	}
+	return store.List()
+}
+
+func (srv *Server) DescribeDeadLetter(id string) (*DeadLetter, error) {
+	store, err := srv.deadLetterStore()
+	if err != nil {
+		return nil, err
+	}
+	return store.Get(id)
+}
+
+func (srv *Server) DeleteDeadLetter(id string) error {
+	store, err := srv.deadLetterStore()
+	if err != nil {
+		return err
+	}
+	return store.Delete(id)
+}
+
+// ReplayDeadLetter sends the event of the dead letter again as Call does, and returns the output.
+// The dead letter is deleted when the event is delivered, and updated with the error and the attempts otherwise.
+func (srv *Server) ReplayDeadLetter(id string) (*Output, error) {
+	return srv.ReplayDeadLetterContext(context.Background(), id)
+}
+
+// ReplayDeadLetterContext is like ReplayDeadLetter, but cancels the calls to the procedures when the context is done or CallTimeout of the server elapsed
+func (srv *Server) ReplayDeadLetterContext(ctx context.Context, id string) (*Output, error) {
+	if srv.CallTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, srv.CallTimeout)
+		defer cancel()
+	}
+	store, err := srv.deadLetterStore()
+	if err != nil {
+		return nil, err
+	}
+	dl, err := store.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Replaying dead letter %s to %s", id, dl.Channel)
+	out, err := srv.call(ctx, dl.Event)
+	if err != nil {
+		dl.failed(err)
+		if saveErr := store.Save(dl); saveErr != nil {
+			log.Printf("unable to update dead letter %s: %v", id, saveErr)
+		}
+		return nil, err
+	}
+	if err := store.Delete(id); err != nil {
+		log.Printf("unable to delete replayed dead letter %s: %v", id, err)
+	}
+	return out, nil
+}
+
+// startDeadLetterServer serves the procedures to inspect and replay the persisted dead letters.
+// Dead letters are sent as JSON bodies like the results of the introspection procedures.
+func (s *Server) startDeadLetterServer() error {
+	conn, err := s.Connect("diplomatDeadLetterServer")
+	if err != nil {
+		return err
+	}
+
+	procs := map[api.ChannelRef]func(kwargs wamp.Dict) (interface{}, error){
+		api.ChannelListDeadLetters: func(kwargs wamp.Dict) (interface{}, error) {
+			return s.ListDeadLetters()
+		},
+		api.ChannelDescribeDeadLetter: func(kwargs wamp.Dict) (interface{}, error) {
+			id, err := deadLetterID(kwargs)
+			if err != nil {
+				return nil, err
+			}
+			return s.DescribeDeadLetter(id)
+		},
+		api.ChannelDeleteDeadLetter: func(kwargs wamp.Dict) (interface{}, error) {
+			id, err := deadLetterID(kwargs)
+			if err != nil {
+				return nil, err
+			}
+			return id, s.DeleteDeadLetter(id)
+		},
+	}
+
+	for ch, f := range procs {
+		f := f
+		if err := conn.Register(ch.SendChannelURL(), func(ctx context.Context, args wamp.List, kwargs wamp.Dict, details wamp.Dict) *client.InvokeResult {
+			res, err := f(kwargs)
+			if err != nil {
+				return &client.InvokeResult{Err: wamp.ErrInvalidArgument, Kwargs: wamp.Dict{"message": err.Error()}}
+			}
+			body, err := json.Marshal(res)
+			if err != nil {
+				return &client.InvokeResult{Err: wamp.ErrInvalidArgument, Kwargs: wamp.Dict{"message": fmt.Sprintf("unable to encode result: %v", err)}}
+			}
+			return &client.InvokeResult{Kwargs: wamp.Dict{"body": body}}
+		}, make(wamp.Dict)); err != nil {
+			return fmt.Errorf("Failed to register %q: %s", ch, err)
+		}
+	}
+
+	// Replays respond like the call procedure, so that clients get the output and the routing errors in the same way
+	if err := conn.Register(api.ChannelReplayDeadLetter.SendChannelURL(), func(ctx context.Context, args wamp.List, kwargs wamp.Dict, details wamp.Dict) *client.InvokeResult {
+		id, err := deadLetterID(kwargs)
+		if err != nil {
+			return &client.InvokeResult{Err: wamp.ErrInvalidArgument, Kwargs: wamp.Dict{"message": err.Error()}}
+		}
+		out, err := s.ReplayDeadLetterContext(ctx, id)
+		if err != nil {
+			return errorToInvokeResult(err)
+		}
+		return &client.InvokeResult{Kwargs: outputToKwargs(out)}
+	}, make(wamp.Dict)); err != nil {
+		return fmt.Errorf("Failed to register %q: %s", api.ChannelReplayDeadLetter, err)
+	}
+
+	return nil
+}
+
+func deadLetterID(kwargs wamp.Dict) (string, error) {
+	id, ok := kwargs["id"].(string)
+	if !ok || id == "" {
+		return "", fmt.Errorf("missing dead letter id in %v", kwargs)
+	}
+	return id, nil
+}
+
+func deadLetterToKwargs(dl *DeadLetter) wamp.Dict {
+	kwargs := eventToKwargs(dl.Event)
+	kwargs["id"] = dl.ID
+	kwargs["reason"] = string(dl.Reason)
+	kwargs["route"] = string(dl.Route)
+	kwargs["error"] = dl.Error
+	kwargs["attempts"] = dl.Attempts
+	kwargs["failedAt"] = dl.FailedAt.Format(time.RFC3339Nano)
+	return kwargs
+}
+
+func kwargsToDeadLetter(kwargs wamp.Dict) (*DeadLetter, error) {
+	evt, err := kwargsToEvent(kwargs)
+	if err != nil {
+		return nil, fmt.Errorf("kwargsToDeadLetter failed: %v", err)
+	}
+	id, _ := wamp.AsString(kwargs["id"])
+	reason, _ := wamp.AsURI(kwargs["reason"])
+	route, _ := wamp.AsString(kwargs["route"])
+	msg, _ := wamp.AsString(kwargs["error"])
+	attempts, _ := wamp.AsInt64(kwargs["attempts"])
+	failedAt, _ := wamp.AsString(kwargs["failedAt"])
+	t, _ := time.Parse(time.RFC3339Nano, failedAt)
+	return &DeadLetter{
+		ID:       id,
+		Event:    *evt,
+		Reason:   reason,
+		Route:    RouteConditionID(route),
+		Error:    msg,
+		Attempts: int(attempts),
+		FailedAt: t,
+	}, nil
+}
@@ -0,0 +1,301 @@
+package diplomat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+// newTestDeadLetterStore returns the dead-letter store in a temporary BoltDB file, and the func to remove it
+func newTestDeadLetterStore(t *testing.T) (*BoltDeadLetterStore, func()) {
+	dir, err := ioutil.TempDir("", "diplomat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes, err := NewBoltRouteStore(filepath.Join(dir, "diplomat.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return routes.DeadLetters(), func() {
+		routes.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestDeliveryFailed(t *testing.T) {
+	timedOut, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-timedOut.Done()
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	testcases := []struct {
+		name string
+		ctx  context.Context
+		err  error
+		want bool
+	}{
+		{name: "callee failed", ctx: context.Background(), err: &RouteError{Kind: ErrCalleeFailed}, want: true},
+		{name: "timed out", ctx: timedOut, err: &RouteError{Kind: ErrCanceled}, want: true},
+		{name: "canceled by the caller", ctx: canceled, err: &RouteError{Kind: ErrCanceled}},
+		{name: "no route", ctx: context.Background(), err: &RouteError{Kind: ErrNoRoute}},
+		{name: "partial match", ctx: context.Background(), err: &RouteError{Kind: ErrPartialMatch}},
+		{name: "rate limited", ctx: context.Background(), err: &RouteError{Kind: ErrRateLimited}},
+		{name: "publish failed", ctx: context.Background(), err: &RouteError{Kind: ErrPublishFailed}},
+		{name: "not a routing error", ctx: context.Background(), err: errors.New("foo")},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			if got := deliveryFailed(tc.ctx, tc.err); got != tc.want {
+				t.Errorf("unexpected result: want %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestUnmatchedEventsAreDeadLettered(t *testing.T) {
+	const fallbackChannel = "http://example.com/fallback"
+	on := OnURL(testChannel)
+	openedByUser := AllOf(on.Where("action").EqString("opened"), on.Where("sender", "type").EqString("User"))
+
+	srv := newTestServer(t)
+	defer srv.nxr.Close()
+	store, remove := newTestDeadLetterStore(t)
+	defer remove()
+	srv.DeadLetterStore = store
+	for _, conf := range []RouteConfig{
+		{RouteCondition: openedByUser, Topic: true},
+		{RouteCondition: OnURL(fallbackChannel).Fallback(), Topic: true},
+	} {
+		if err := srv.StartRouting(conf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, err := srv.Connect("subscriber")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	dls := make(chan *DeadLetter, 1)
+	if err := c.SubscribeDeadLetters("", func(dl *DeadLetter) { dls <- dl }); err != nil {
+		t.Fatal(err)
+	}
+
+	testcases := []struct {
+		name    string
+		channel string
+		body    string
+		// wantReason is the reason of the dead letter, or empty when the event is not dead-lettered
+		wantReason wamp.URI
+	}{
+		{name: "no route", channel: testChannel, body: `{"action":"closed"}`, wantReason: "diplomat.error.no_route"},
+		{name: "unknown channel", channel: "http://example.com/unknown", body: `{"action":"opened"}`, wantReason: "diplomat.error.no_route"},
+		{name: "partial match", channel: testChannel, body: `{"action":"opened","sender":{"type":"Bot"}}`, wantReason: "diplomat.error.partial_match"},
+		{name: "matched", channel: testChannel, body: `{"action":"opened","sender":{"type":"User"}}`},
+		{name: "matched the fallback", channel: fallbackChannel, body: `{"action":"closed"}`},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			evt := jsonEvent(tc.body)
+			evt.Channel = tc.channel
+			if err := srv.Publish(evt); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			select {
+			case dl := <-dls:
+				if tc.wantReason == "" {
+					t.Fatalf("unexpected dead letter: %+v", dl)
+				}
+				if dl.Reason != tc.wantReason || dl.Channel != tc.channel || string(dl.Body) != tc.body {
+					t.Errorf("unexpected dead letter: want %s of %s on %s, got %+v", tc.wantReason, tc.body, tc.channel, dl)
+				}
+			case <-time.After(200 * time.Millisecond):
+				if tc.wantReason != "" {
+					t.Fatalf("unexpected result: want a dead letter of %s, got none", tc.wantReason)
+				}
+			}
+		})
+	}
+
+	// Replaying unmatched events fails again until a route is registered for them
+	stored, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 0 {
+		t.Errorf("unexpected stored dead letters: want none, got %+v", stored)
+	}
+}
+
+func TestReplayDeadLetter(t *testing.T) {
+	cond := OnURL(testChannel).Where("action").EqString("opened")
+
+	srv := newTestServer(t)
+	defer srv.nxr.Close()
+	if err := srv.startRegistrationServer(); err != nil {
+		t.Fatal(err)
+	}
+	store, remove := newTestDeadLetterStore(t)
+	defer remove()
+	srv.DeadLetterStore = store
+
+	c, err := srv.Connect("callee")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	var failing int32
+	if _, err := c.ServeRoute(RouteConfig{RouteCondition: cond}, func(evt []byte) ([]byte, error) {
+		if atomic.LoadInt32(&failing) == 1 {
+			return nil, errors.New("unavailable")
+		}
+		return evt, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	testcases := []struct {
+		name    string
+		failing bool
+		// wantAttempts is the attempts of the stored dead letter after the replay, or 0 when it is deleted
+		wantAttempts int
+	}{
+		{name: "delivered", wantAttempts: 0},
+		{name: "failed again", failing: true, wantAttempts: 3},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.failing {
+				atomic.StoreInt32(&failing, 1)
+				defer atomic.StoreInt32(&failing, 0)
+			}
+			dl := newDeadLetter(jsonEvent(`{"action":"opened"}`), &RouteError{Kind: ErrCanceled, Route: cond.ID(), Attempts: 2})
+			dl.FailedAt = dl.FailedAt.Add(-time.Hour)
+			if err := store.Save(dl); err != nil {
+				t.Fatal(err)
+			}
+
+			out, err := srv.ReplayDeadLetterContext(context.Background(), dl.ID)
+			got, getErr := store.Get(dl.ID)
+			if tc.wantAttempts == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if string(out.Body) != `{"action":"opened"}` {
+					t.Errorf("unexpected output: want the event echoed, got %s", out.Body)
+				}
+				if getErr == nil {
+					t.Errorf("unexpected dead letter after the delivery: %+v", got)
+				}
+				return
+			}
+			if ErrorKind(err) != ErrCalleeFailed {
+				t.Fatalf("unexpected error: want %v, got %v", ErrCalleeFailed, err)
+			}
+			if getErr != nil {
+				t.Fatalf("unexpected error: %v", getErr)
+			}
+			if got.Attempts != tc.wantAttempts || got.Reason != "diplomat.error.callee_failed" || !got.FailedAt.After(dl.FailedAt) {
+				t.Errorf("unexpected dead letter: want %d attempts failed with %s after %s, got %+v", tc.wantAttempts, "diplomat.error.callee_failed", dl.FailedAt, got)
+			}
+		})
+	}
+
+	t.Run("missing", func(t *testing.T) {
+		if out, err := srv.ReplayDeadLetterContext(context.Background(), "missing"); err == nil {
+			t.Errorf("unexpected success: got %+v", out)
+		}
+	})
+
+	t.Run("no store", func(t *testing.T) {
+		srv.DeadLetterStore = nil
+		defer func() { srv.DeadLetterStore = store }()
+		if out, err := srv.ReplayDeadLetterContext(context.Background(), "missing"); err == nil {
+			t.Errorf("unexpected success: got %+v", out)
+		}
+	})
+}
+
+func TestDeadLetterKwargs(t *testing.T) {
+	failedAt := time.Date(2019, 4, 1, 12, 30, 0, 123456789, time.UTC)
+	full := &DeadLetter{
+		ID: "bir2e1q9f0l5dcmf5pv0",
+		Event: Event{
+			Channel:  testChannel,
+			Method:   "POST",
+			RawQuery: "a=1",
+			Body:     []byte(`{"action":"opened"}`),
+			Header:   map[string][]string{"Content-Type": {"application/json"}},
+		},
+		Reason:   "diplomat.error.callee_failed",
+		Route:    "foo",
+		Error:    "no callee",
+		Attempts: 3,
+		FailedAt: failedAt,
+	}
+	// Sent over WebSocket with the JSON serializer, the body is a Base64 string and the numbers are floats
+	overJSON := func(kwargs wamp.Dict) wamp.Dict {
+		data, err := json.Marshal(kwargs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded := wamp.Dict{}
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		return decoded
+	}
+
+	testcases := []struct {
+		name    string
+		kwargs  wamp.Dict
+		want    *DeadLetter
+		wantErr bool
+	}{
+		{name: "local", kwargs: deadLetterToKwargs(full), want: full},
+		{name: "over json", kwargs: overJSON(deadLetterToKwargs(full)), want: full},
+		{
+			name:   "event only",
+			kwargs: eventToKwargs(Event{Channel: testChannel, Body: []byte(`{}`)}),
+			want:   &DeadLetter{Event: Event{Channel: testChannel, Body: []byte(`{}`)}},
+		},
+		{name: "missing channel", kwargs: wamp.Dict{"id": "foo", "body": []byte(`{}`)}, wantErr: true},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := kwargsToDeadLetter(tc.kwargs)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error: want error %v, got %v", tc.wantErr, err)
+			}
+			if tc.wantErr {
+				return
+			}
+			if !got.FailedAt.Equal(tc.want.FailedAt) {
+				t.Errorf("unexpected failure time: want %s, got %s", tc.want.FailedAt, got.FailedAt)
+			}
+			got.FailedAt = tc.want.FailedAt
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("unexpected dead letter: want %+v, got %+v", tc.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,212 @@
+package diplomat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+// dispatch calls the procedure of the route with the route's dispatch, and returns the number of the calls made along with the result.
+// The router chooses the callee of single, round-robin and random dispatches, as they share one registration with the invocation policy.
+// Failover and fan-out call the procedures that their callees register each for themselves, which the server knows from the meta events of the router.
+func (srv *Server) dispatch(ctx context.Context, route *Route, evt Event) (*Output, int, error) {
+	proc := route.ReceiverName()
+	if !route.Dispatch.callsEachCallee() {
+		out, err := srv.callProcedure(ctx, route, evt, proc)
+		return out, 1, err
+	}
+
+	callees := srv.callees.procedures(proc)
+	if len(callees) == 0 {
+		return nil, 0, fmt.Errorf("no callee registered to %s", proc)
+	}
+
+	if route.Dispatch == DispatchFailover {
+		return srv.failover(ctx, route, evt, callees)
+	}
+	out, err := srv.fanOut(ctx, route, evt, callees)
+	return out, len(callees), err
+}
+
+// callProcedure calls the procedure once on behalf of the route, canceling the call when the context is done or after the attempt timeout of the route's retry policy
+func (srv *Server) callProcedure(ctx context.Context, route *Route, evt Event, proc string) (*Output, error) {
+	metrics.Add("procedure_calls", 1)
+	if timeout := route.Retry.attemptTimeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return ProgressiveCallContext(ctx, srv.internalClient.Client, proc, evt, 64)
+}
+
+// failover calls the callees one by one in the order they registered, and returns the output of the first one that succeeded
+func (srv *Server) failover(ctx context.Context, route *Route, evt Event, callees []string) (*Output, int, error) {
+	proc := route.ReceiverName()
+	var err error
+	for i, callee := range callees {
+		var out *Output
+		out, err = srv.callProcedure(ctx, route, evt, callee)
+		if err == nil {
+			return out, i + 1, nil
+		}
+		if ctx.Err() != nil {
+			return nil, i + 1, err
+		}
+		log.Printf("callee %d/%d of %s failed. failing over to the next callee: %v", i+1, len(callees), proc, err)
+	}
+	return nil, len(callees), wrapError(err, "all %d callees failed", len(callees))
+}
+
+// fanOut calls all the callees at once, and returns the JSON array of the bodies of their responses.
+// Bodies that are not JSON are included as strings. Callees that failed are left out unless all of them failed.
+func (srv *Server) fanOut(ctx context.Context, route *Route, evt Event, callees []string) (*Output, error) {
+	proc := route.ReceiverName()
+	outs := make([]*Output, len(callees))
+	errs := make([]error, len(callees))
+	var wg sync.WaitGroup
+	for i, callee := range callees {
+		wg.Add(1)
+		go func(i int, callee string) {
+			defer wg.Done()
+			outs[i], errs[i] = srv.callProcedure(ctx, route, evt, callee)
+		}(i, callee)
+	}
+	wg.Wait()
+
+	bodies := []json.RawMessage{}
+	var err error
+	for i, out := range outs {
+		if errs[i] != nil {
+			err = errs[i]
+			log.Printf("callee %d/%d of %s failed. leaving it out of the response: %v", i+1, len(callees), proc, err)
+			continue
+		}
+		if json.Valid(out.Body) {
+			bodies = append(bodies, json.RawMessage(out.Body))
+			continue
+		}
+		quoted, jsonErr := json.Marshal(string(out.Body))
+		if jsonErr != nil {
+			return nil, jsonErr
+		}
+		bodies = append(bodies, json.RawMessage(quoted))
+	}
+	if len(bodies) == 0 {
+		return nil, wrapError(err, "all %d callees failed", len(callees))
+	}
+	body, err := json.Marshal(bodies)
+	if err != nil {
+		return nil, err
+	}
+	return &Output{Body: body, Header: map[string][]string{"Content-Type": {"application/json"}}}, nil
+}
+
+// calleeProcedureInfix separates the procedure of the route and the session ID of the callee in the procedures
+// that the callees of failover and fan-out routes register each for themselves
+const calleeProcedureInfix = ".callee-"
+
+// calleeProcedure returns the procedure that the callee of the session registers for itself along with the procedure of the route
+func calleeProcedure(proc string, session wamp.ID) string {
+	return fmt.Sprintf("%s%s%d", proc, calleeProcedureInfix, session)
+}
+
+// routeProcedure returns the procedure of the route that the callee procedure was registered for,
+// and false when the URI is not a callee procedure
+func routeProcedure(uri string) (string, bool) {
+	i := strings.LastIndex(uri, calleeProcedureInfix)
+	if i < 0 {
+		return "", false
+	}
+	if _, err := strconv.ParseUint(uri[i+len(calleeProcedureInfix):], 10, 64); err != nil {
+		return "", false
+	}
+	return uri[:i], true
+}
+
+// calleeRegistrations remembers the callee procedures registered to the failover and fan-out routes from the meta events of the router,
+// so that the server calls every callee explicitly without asking the router for them on every event
+type calleeRegistrations struct {
+	mu sync.Mutex
+	// uris maps the registration IDs of the callee procedures to their URIs
+	uris map[wamp.ID]string
+	// routes maps the procedures of the routes to the registration IDs of their callees, in the order they registered
+	routes map[string][]wamp.ID
+}
+
+func newCalleeRegistrations() *calleeRegistrations {
+	return &calleeRegistrations{uris: map[wamp.ID]string{}, routes: map[string][]wamp.ID{}}
+}
+
+// onCreate handles `wamp.registration.on_create`, whose args are the session ID and the details of the registration
+func (c *calleeRegistrations) onCreate(args wamp.List, kwargs, details wamp.Dict) {
+	if len(args) < 2 {
+		return
+	}
+	d, ok := wamp.AsDict(args[1])
+	if !ok {
+		return
+	}
+	id, ok := wamp.AsID(d["id"])
+	if !ok {
+		return
+	}
+	uri, ok := wamp.AsURI(d["uri"])
+	if !ok {
+		return
+	}
+	proc, ok := routeProcedure(string(uri))
+	if !ok {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.uris[id] = string(uri)
+	c.routes[proc] = append(c.routes[proc], id)
+}
+
+// onDelete handles `wamp.registration.on_delete`, whose args are the session ID and the registration ID
+func (c *calleeRegistrations) onDelete(args wamp.List, kwargs, details wamp.Dict) {
+	if len(args) < 2 {
+		return
+	}
+	id, ok := wamp.AsID(args[1])
+	if !ok {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	uri, ok := c.uris[id]
+	if !ok {
+		return
+	}
+	delete(c.uris, id)
+	proc, _ := routeProcedure(uri)
+	ids := []wamp.ID{}
+	for _, other := range c.routes[proc] {
+		if other != id {
+			ids = append(ids, other)
+		}
+	}
+	if len(ids) == 0 {
+		delete(c.routes, proc)
+	} else {
+		c.routes[proc] = ids
+	}
+}
+
+// procedures returns the callee procedures of the route's procedure, in the order they registered
+func (c *calleeRegistrations) procedures(proc string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	uris := []string{}
+	for _, id := range c.routes[proc] {
+		uris = append(uris, c.uris[id])
+	}
+	return uris
+}
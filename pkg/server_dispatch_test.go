@@ -0,0 +1,58 @@
+package diplomat
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+func TestCalleeRegistrations(t *testing.T) {
+	const proc = "http://example.com/webhook"
+	create := func(id wamp.ID, uri string) wamp.List {
+		return wamp.List{wamp.ID(1), wamp.Dict{"id": id, "uri": wamp.URI(uri)}}
+	}
+	del := func(id wamp.ID) wamp.List {
+		return wamp.List{wamp.ID(1), id}
+	}
+
+	testcases := []struct {
+		name    string
+		creates []wamp.List
+		deletes []wamp.List
+		want    []string
+	}{
+		{
+			name:    "in the order they registered",
+			creates: []wamp.List{create(2, calleeProcedure(proc, 20)), create(1, calleeProcedure(proc, 10))},
+			want:    []string{calleeProcedure(proc, 20), calleeProcedure(proc, 10)},
+		},
+		{
+			name:    "deleted",
+			creates: []wamp.List{create(1, calleeProcedure(proc, 10)), create(2, calleeProcedure(proc, 20))},
+			deletes: []wamp.List{del(1)},
+			want:    []string{calleeProcedure(proc, 20)},
+		},
+		{
+			name:    "procedures of the routes and other routes",
+			creates: []wamp.List{create(1, proc), create(2, proc+".callee-foo"), create(3, calleeProcedure(proc+"/other", 10))},
+			want:    []string{},
+		},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			c := newCalleeRegistrations()
+			for _, args := range tc.creates {
+				c.onCreate(args, nil, nil)
+			}
+			for _, args := range tc.deletes {
+				c.onDelete(args, nil, nil)
+			}
+			if got := c.procedures(proc); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("unexpected procedures: want %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
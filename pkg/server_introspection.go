@@ -0,0 +1,185 @@
+package diplomat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/gammazero/nexus/client"
+	"github.com/gammazero/nexus/wamp"
+	"github.com/mumoshu/diplomat/pkg/api"
+)
+
+// RouteInfo is the read-only view of a route returned by the introspection procedures
+type RouteInfo struct {
+	ID                RouteConditionID
+	Channel           string
+	FormParameterName string     `json:",omitempty"`
+	BodyFormat        BodyFormat `json:",omitempty"`
+	// Condition is the whole condition including the boolean operators, like `(action == "opened" || action == "synchronize") && !(sender.type == "Bot")`
+	Condition   string
+	Expressions []string
+	Topics      []string
+	Procedures  []string
+	Dispatch    Dispatch     `json:",omitempty"`
+	Priority    int          `json:",omitempty"`
+	Retry       *RetryPolicy `json:",omitempty"`
+	Async       bool         `json:",omitempty"`
+	RateLimit   *RateLimit   `json:",omitempty"`
+	// TopicSessions and ProcedureSessions are the IDs of the WAMP sessions that own the topics and procedures.
+	// Topics and procedures without sessions are owned by the server itself, or restored from the store and waiting for their receivers to reconnect.
+	TopicSessions     []wamp.ID `json:",omitempty"`
+	ProcedureSessions []wamp.ID `json:",omitempty"`
+}
+
+// RouteMatch is a route that matched an event, along with the number of distinct expressions that matched.
+// Matched is false when some expressions matched but the condition as a whole is not satisfied.
+// Selected is true for the route whose procedures Call would call first, and Reason tells why it won over the others.
+type RouteMatch struct {
+	ID       RouteConditionID
+	Score    int
+	Required int
+	Priority int
+	Matched  bool
+	Selected bool
+	Reason   string `json:",omitempty"`
+}
+
+func newRouteInfo(r *Route) RouteInfo {
+	b := r.boolExpr()
+	exprs := []string{}
+	for _, e := range b.leaves() {
+		exprs = append(exprs, e.Format())
+	}
+	return RouteInfo{
+		ID:                r.ID(),
+		Channel:           r.Channel.SendChannelURL(),
+		FormParameterName: r.FormParameterName,
+		BodyFormat:        r.BodyFormat,
+		Condition:         b.Format(),
+		Expressions:       exprs,
+		Topics:            append([]string{}, r.Topics...),
+		Procedures:        append([]string{}, r.Procedures...),
+		Dispatch:          r.Dispatch,
+		Priority:          r.Priority,
+		Retry:             r.Retry,
+		Async:             r.Async,
+		RateLimit:         r.RateLimit,
+		TopicSessions:     append([]wamp.ID{}, r.TopicSessions...),
+		ProcedureSessions: append([]wamp.ID{}, r.ProcedureSessions...),
+	}
+}
+
+func (srv *Server) ListRoutes() []RouteInfo {
+	infos := []RouteInfo{}
+	for _, r := range srv.List() {
+		infos = append(infos, newRouteInfo(r))
+	}
+	return infos
+}
+
+func (srv *Server) DescribeRoute(id RouteConditionID) (*RouteInfo, error) {
+	r := srv.GetRoute(id)
+	if r == nil || (len(r.Topics) == 0 && len(r.Procedures) == 0) {
+		return nil, fmt.Errorf("route not found: %s", id)
+	}
+	info := newRouteInfo(r)
+	return &info, nil
+}
+
+// ExplainRoute returns the routes that the event would be matched against, including partial matches, sorted by their scores.
+// Unlike Call, the event is not sent to any topic or procedure.
+func (srv *Server) ExplainRoute(evt Event) ([]RouteMatch, error) {
+	idsAndScores, err := srv.ScoreRoutesEvent(evt)
+	if err != nil {
+		return nil, fmt.Errorf("explain failed: %v", err)
+	}
+	matched, err := srv.SearchRouteMatchesEvent(evt)
+	if err != nil {
+		return nil, fmt.Errorf("explain failed: %v", err)
+	}
+	matches := []RouteMatch{}
+	procRoutes := []rankedRoute{}
+	for id, score := range idsAndScores {
+		m := RouteMatch{ID: id, Score: score}
+		_, m.Matched = matched[id]
+		if r := srv.GetRoute(id); r != nil {
+			m.Required = len(r.boolExpr().leaves())
+			m.Priority = r.Priority
+			if m.Matched && len(r.Procedures) > 0 {
+				procRoutes = append(procRoutes, rankedRoute{Route: r, Score: score})
+			}
+		}
+		matches = append(matches, m)
+	}
+	rankRoutes(procRoutes)
+	for i := range matches {
+		if len(procRoutes) > 0 && matches[i].ID == procRoutes[0].ID() {
+			matches[i].Selected = true
+			matches[i].Reason = rankReason(procRoutes)
+		}
+	}
+	// Listed in the order Call tries them, followed by the routes that it would not call
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Matched != matches[j].Matched {
+			return matches[i].Matched
+		}
+		if matches[i].Priority != matches[j].Priority {
+			return matches[i].Priority > matches[j].Priority
+		}
+		if matches[i].Score != matches[j].Score {
+			return matches[i].Score > matches[j].Score
+		}
+		return matches[i].ID < matches[j].ID
+	})
+	return matches, nil
+}
+
+// startIntrospectionServer serves the read-only procedures to inspect the routing state.
+// Results are sent as JSON bodies, so that local and remote clients decode them in the same way.
+func (s *Server) startIntrospectionServer() error {
+	conn, err := s.Connect("diplomatIntrospectionServer")
+	if err != nil {
+		return err
+	}
+
+	procs := map[api.ChannelRef]func(kwargs wamp.Dict) (interface{}, error){
+		api.ChannelListRoutes: func(kwargs wamp.Dict) (interface{}, error) {
+			return s.ListRoutes(), nil
+		},
+		api.ChannelDescribeRoute: func(kwargs wamp.Dict) (interface{}, error) {
+			id, ok := kwargs["id"].(string)
+			if !ok || id == "" {
+				return nil, fmt.Errorf("missing route id in %v", kwargs)
+			}
+			return s.DescribeRoute(RouteConditionID(id))
+		},
+		api.ChannelExplainRoute: func(kwargs wamp.Dict) (interface{}, error) {
+			evt, err := kwargsToEvent(kwargs)
+			if err != nil {
+				return nil, err
+			}
+			return s.ExplainRoute(*evt)
+		},
+	}
+
+	for ch, f := range procs {
+		f := f
+		if err := conn.Register(ch.SendChannelURL(), func(ctx context.Context, args wamp.List, kwargs wamp.Dict, details wamp.Dict) *client.InvokeResult {
+			res, err := f(kwargs)
+			if err != nil {
+				return &client.InvokeResult{Err: wamp.ErrInvalidArgument, Kwargs: wamp.Dict{"message": err.Error()}}
+			}
+			body, err := json.Marshal(res)
+			if err != nil {
+				return &client.InvokeResult{Err: wamp.ErrInvalidArgument, Kwargs: wamp.Dict{"message": fmt.Sprintf("unable to encode result: %v", err)}}
+			}
+			return &client.InvokeResult{Kwargs: wamp.Dict{"body": body}}
+		}, make(wamp.Dict)); err != nil {
+			return fmt.Errorf("Failed to register %q: %s", ch, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,115 @@
+package diplomat
+
+import (
+	"testing"
+)
+
+func TestIntrospection(t *testing.T) {
+	on := OnURL(testChannel)
+	opened := on.Where("action").EqString("opened")
+	openedByUser := AllOf(opened, on.Where("sender", "type").EqString("User"))
+	closed := on.Where("action").EqString("closed")
+
+	srv := newTestServer(t)
+	defer srv.nxr.Close()
+	for _, conf := range []RouteConfig{
+		{RouteCondition: opened, Proc: true},
+		{RouteCondition: openedByUser, Proc: true, Priority: 1},
+		{RouteCondition: closed, Topic: true},
+	} {
+		if err := srv.StartRouting(conf); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := srv.startIntrospectionServer(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	c, err := srv.Connect("introspection")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	t.Run("list", func(t *testing.T) {
+		routes, err := c.ListRoutes()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		ids := map[RouteConditionID]RouteInfo{}
+		for _, r := range routes {
+			ids[r.ID] = r
+		}
+		if len(ids) != 3 {
+			t.Fatalf("unexpected routes: want 3, got %v", routes)
+		}
+		if r := ids[closed.ID()]; len(r.Topics) != 1 || len(r.Procedures) != 0 {
+			t.Errorf("unexpected receivers of %s: want 1 topic, got topics %v and procedures %v", closed.ID(), r.Topics, r.Procedures)
+		}
+		if r := ids[openedByUser.ID()]; r.Priority != 1 || len(r.Procedures) != 1 {
+			t.Errorf("unexpected route %s: want priority 1 and 1 procedure, got %+v", openedByUser.ID(), r)
+		}
+	})
+
+	t.Run("describe", func(t *testing.T) {
+		r, err := c.DescribeRoute(openedByUser.ID())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(r.Expressions) != 2 || r.Channel != testChannel {
+			t.Errorf("unexpected route: want 2 expressions on %s, got %+v", testChannel, r)
+		}
+	})
+
+	t.Run("describe missing", func(t *testing.T) {
+		if r, err := c.DescribeRoute(on.Where("action").EqString("reopened").ID()); err == nil {
+			t.Errorf("unexpected success: got %+v", r)
+		}
+	})
+
+	testcases := []struct {
+		name         string
+		body         string
+		wantSelected RouteConditionID
+		// wantPartial is the route that matched some of its expressions but not all of them
+		wantPartial RouteConditionID
+	}{
+		{name: "explain the higher priority", body: `{"action":"opened","sender":{"type":"User"}}`, wantSelected: openedByUser.ID()},
+		{name: "explain the partial match", body: `{"action":"opened","sender":{"type":"Bot"}}`, wantSelected: opened.ID(), wantPartial: openedByUser.ID()},
+		{name: "explain the topic only match", body: `{"action":"closed"}`},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			matches, err := c.ExplainRoute(jsonEvent(tc.body))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var selected RouteConditionID
+			partial := tc.wantPartial == ""
+			for _, m := range matches {
+				if m.Selected {
+					if selected != "" {
+						t.Fatalf("unexpected selections: want 1, got %+v", matches)
+					}
+					selected = m.ID
+					if m.Reason == "" {
+						t.Errorf("unexpected empty reason of %s", m.ID)
+					}
+				}
+				if m.ID == tc.wantPartial {
+					partial = true
+					if m.Matched || m.Score != 1 || m.Required != 2 {
+						t.Errorf("unexpected partial match: want 1 of 2 expressions matched, got %+v", m)
+					}
+				}
+			}
+			if !partial {
+				t.Errorf("unexpected matches: want the partial match of %s, got %+v", tc.wantPartial, matches)
+			}
+			if selected != tc.wantSelected {
+				t.Errorf("unexpected selected route: want %q, got %q in %+v", tc.wantSelected, selected, matches)
+			}
+		})
+	}
+}
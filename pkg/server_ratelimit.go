@@ -0,0 +1,111 @@
+package diplomat
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+// limitEvent applies the rate limits to the event once before it is published or delivered, and returns the routes to call it in order.
+// The limit of the channel is applied first, and then the one of the route that is called first, so that each event takes a token from each at most.
+// The output or the error is returned instead when the event is over either limit, in which case the overflow of that limit applies.
+// The event never fails over to the other routes from the route over its limit, as they are often broader ones that the limit is meant to protect too,
+// and the token of the channel is returned to it as the event is not delivered
+func (srv *Server) limitEvent(ctx context.Context, evt Event, procRoutes []rankedRoute) ([]rankedRoute, *Output, error) {
+	body := srv.newKeyBody(evt)
+	defer body.release()
+
+	limit, limited := srv.ChannelRateLimits[evt.Channel]
+	if limited {
+		allowed, err := srv.takeToken(ctx, body, "", &limit)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !allowed {
+			out, err := srv.overflow(body, "", &limit)
+			return nil, out, err
+		}
+	}
+	if len(procRoutes) == 0 || procRoutes[0].RateLimit == nil {
+		return procRoutes, nil, nil
+	}
+	route := procRoutes[0]
+	allowed, err := srv.takeToken(ctx, body, route.ID(), route.RateLimit)
+	if allowed {
+		return procRoutes, nil, nil
+	}
+	if limited {
+		bucket, _ := srv.rateLimitBucket(body, "", &limit)
+		srv.rateLimiter.cancel(bucket)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	out, err := srv.overflow(body, route.ID(), route.RateLimit)
+	return nil, out, err
+}
+
+// rateLimitBucket returns the key of the bucket of the channel or the route, which is empty for channel limits,
+// along with the description of the bucket for logs and errors
+func (srv *Server) rateLimitBucket(body *keyBody, route RouteConditionID, limit *RateLimit) (string, string) {
+	bucket, scope := "channel "+body.evt.Channel, body.evt.Channel
+	if route != "" {
+		bucket, scope = "route "+string(route), string(route)
+	}
+	if limit.Key != "" {
+		// The key has been validated along with the limit
+		path, _ := ParsePath(limit.Key)
+		value, _ := body.keyValue(path)
+		bucket += fmt.Sprintf(" %s=%s", limit.Key, value)
+		scope += fmt.Sprintf(" for %s=%s", limit.Key, value)
+	}
+	return bucket, scope
+}
+
+// takeToken takes a token for the event from the bucket of the channel or the route, waiting for it with OverflowDelay.
+// It returns false when the bucket has no token for the event, and ErrCanceled when the context was done while waiting
+func (srv *Server) takeToken(ctx context.Context, body *keyBody, route RouteConditionID, limit *RateLimit) (bool, error) {
+	evt := body.evt
+	bucket, scope := srv.rateLimitBucket(body, route, limit)
+	wait, ok := srv.rateLimiter.reserve(bucket, limit, limit.maxDelay())
+	if !ok {
+		return false, nil
+	}
+	if wait == 0 {
+		return true, nil
+	}
+	log.Printf("Rate limit of %s exceeded. delaying the event for %s", scope, wait)
+	metrics.Add("rate_limit_delayed", 1)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true, nil
+	case <-ctx.Done():
+		// The event is not delivered, so its token is left for the next events
+		srv.rateLimiter.cancel(bucket)
+		return false, &RouteError{Kind: ErrCanceled, Channel: evt.Channel, Route: route, Err: ctx.Err()}
+	}
+}
+
+// overflow returns the output to respond with when the event over the limit was sent to the overflow topic, or ErrRateLimited
+func (srv *Server) overflow(body *keyBody, route RouteConditionID, limit *RateLimit) (*Output, error) {
+	evt := body.evt
+	_, scope := srv.rateLimitBucket(body, route, limit)
+	if limit.Overflow == OverflowTopic {
+		log.Printf("Rate limit of %s exceeded. publishing the event to %s", scope, limit.OverflowTopic)
+		metrics.Add("rate_limit_overflowed", 1)
+		if err := srv.internalClient.Publish(limit.OverflowTopic, nil, wamp.List{}, eventToKwargs(evt)); err != nil {
+			return nil, &RouteError{Kind: ErrPublishFailed, Channel: evt.Channel, Route: route, Err: err}
+		}
+		return &Output{Body: []byte(`{"message":"rate limited. the event was sent to the overflow topic"}`), StatusCode: http.StatusAccepted}, nil
+	}
+
+	log.Printf("Rate limit of %s exceeded. rejecting the event", scope)
+	metrics.Add("rate_limit_rejected", 1)
+	return nil, &RouteError{Kind: ErrRateLimited, Channel: evt.Channel, Route: route, Err: fmt.Errorf("over %v events per second of %s", limit.Rate, scope)}
+}
@@ -0,0 +1,55 @@
+package diplomat
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// dispatchWithRetry dispatches the event to the route, and dispatches it again with backoff as the route's retry policy allows.
+// Retries stop when the context is done. It returns the number of the procedure calls made over all the attempts, and the RetryError listing the failures when all the attempts failed.
+func (srv *Server) dispatchWithRetry(ctx context.Context, route *Route, evt Event) (*Output, int, error) {
+	policy := route.Retry
+	max := policy.maxAttempts()
+	calls := 0
+	errs := []error{}
+	for attempt := 1; ; attempt++ {
+		out, n, err := srv.dispatch(ctx, route, evt)
+		calls += n
+		if err == nil {
+			if attempt > 1 {
+				log.Printf("Route %s succeeded on attempt %d/%d", route.ID(), attempt, max)
+			}
+			return out, calls, nil
+		}
+		errs = append(errs, err)
+		if attempt >= max {
+			if max > 1 {
+				metrics.Add("procedure_retries_exhausted", 1)
+				routeRetriesExhausted.Add(string(route.ID()), 1)
+			}
+			break
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		if !policy.retryable(err) {
+			log.Printf("Route %s failed on attempt %d/%d with an error not to retry: %v", route.ID(), attempt, max, err)
+			break
+		}
+		delay := policy.backoff(attempt)
+		log.Printf("Route %s failed on attempt %d/%d. retrying in %s: %v", route.ID(), attempt, max, delay, err)
+		metrics.Add("procedure_retries", 1)
+		routeRetries.Add(string(route.ID()), 1)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			log.Printf("Route %s gave up retrying: %v", route.ID(), ctx.Err())
+			return nil, calls, &RetryError{Errors: errs}
+		}
+	}
+	if len(errs) == 1 {
+		return nil, calls, errs[0]
+	}
+	return nil, calls, &RetryError{Errors: errs}
+}
@@ -0,0 +1,127 @@
+package diplomat
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/gammazero/nexus/client"
+	"github.com/gammazero/nexus/wamp"
+)
+
+// receiverURIs remembers the URIs of the registrations or subscriptions, as the router tells only their IDs when they are deleted
+type receiverURIs struct {
+	mu   sync.Mutex
+	uris map[wamp.ID]string
+}
+
+// onCreate handles `wamp.registration.on_create` and `wamp.subscription.on_create`, whose args are the session ID and the details
+func (u *receiverURIs) onCreate(args wamp.List, kwargs, details wamp.Dict) {
+	if len(args) < 2 {
+		return
+	}
+	d, ok := wamp.AsDict(args[1])
+	if !ok {
+		return
+	}
+	id, ok := wamp.AsID(d["id"])
+	if !ok {
+		return
+	}
+	uri, ok := wamp.AsURI(d["uri"])
+	if !ok {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.uris[id] = string(uri)
+}
+
+// onDelete returns the URI of the registration or subscription deleted by `wamp.registration.on_delete` or `wamp.subscription.on_delete`,
+// whose args are the session ID and the registration or subscription ID
+func (u *receiverURIs) onDelete(args wamp.List) (string, bool) {
+	if len(args) < 2 {
+		return "", false
+	}
+	id, ok := wamp.AsID(args[1])
+	if !ok {
+		return "", false
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	uri, ok := u.uris[id]
+	delete(u.uris, id)
+	return uri, ok
+}
+
+// startSessionWatcher watches the meta events of the router, so that receivers are removed from the routes when the router drops them.
+// Receivers owned by a session are removed when the session leaves, including when its client crashed without deregistering.
+// Receivers owned by nobody are removed when their last registration or subscription is deleted.
+// It also keeps track of the callee procedures of the failover and fan-out routes.
+func (s *Server) startSessionWatcher() error {
+	conn, err := s.Connect("diplomatSessionWatcher")
+	if err != nil {
+		return err
+	}
+
+	regs := &receiverURIs{uris: map[wamp.ID]string{}}
+	subs := &receiverURIs{uris: map[wamp.ID]string{}}
+
+	handlers := map[wamp.URI]client.EventHandler{
+		wamp.MetaEventSessionOnLeave: func(args wamp.List, kwargs, details wamp.Dict) {
+			if len(args) == 0 {
+				return
+			}
+			if session, ok := wamp.AsID(args[0]); ok {
+				s.removeSession(session)
+			}
+		},
+		wamp.MetaEventRegOnCreate: func(args wamp.List, kwargs, details wamp.Dict) {
+			regs.onCreate(args, kwargs, details)
+			s.callees.onCreate(args, kwargs, details)
+		},
+		wamp.MetaEventSubOnCreate: subs.onCreate,
+		wamp.MetaEventRegOnDelete: func(args wamp.List, kwargs, details wamp.Dict) {
+			s.callees.onDelete(args, kwargs, details)
+			if uri, ok := regs.onDelete(args); ok {
+				s.removeUnowned(uri, false)
+			}
+		},
+		wamp.MetaEventSubOnDelete: func(args wamp.List, kwargs, details wamp.Dict) {
+			if uri, ok := subs.onDelete(args); ok {
+				s.removeUnowned(uri, true)
+			}
+		},
+	}
+	for topic, handler := range handlers {
+		if err := conn.Subscribe(string(topic), handler, nil); err != nil {
+			return fmt.Errorf("Failed to subscribe %q: %s", topic, err)
+		}
+	}
+	return nil
+}
+
+func (s *Server) removeSession(session wamp.ID) {
+	conds, err := s.RemoveSession(session)
+	if err != nil {
+		log.Printf("unable to remove the routes of session %v: %v", session, err)
+	}
+	for _, c := range conds {
+		s.Sync(s.RouteTable, c)
+		log.Printf("Route cleaned up: %s of session %v", c.ID(), session)
+	}
+}
+
+// removeUnowned removes the receivers owned by nobody from the route whose receiver name is the URI
+func (s *Server) removeUnowned(uri string, topics bool) {
+	// The URIs of the server's own procedures are not routes
+	r := s.GetRoute(RouteConditionID(uri))
+	if r == nil {
+		return
+	}
+	if err := s.RemoveUnowned(r.RouteCondition, topics); err != nil {
+		log.Printf("unable to clean up route %s: %v", r.ID(), err)
+	}
+	s.Sync(s.RouteTable, r.RouteCondition)
+	log.Printf("Route cleaned up: %s", r.ID())
+}
@@ -0,0 +1,101 @@
+package diplomat
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+func TestSessionLeaveRemovesRoutes(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.nxr.Close()
+	for _, start := range []func() error{srv.startRegistrationServer, srv.startSessionWatcher, srv.startIntrospectionServer} {
+		if err := start(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cond := OnURL(testChannel).Where("action").EqString("opened")
+	// unowned is routed by the server itself, so no session leaving removes it
+	unowned := OnURL(testChannel).Where("action").EqString("closed")
+	if err := srv.StartRouting(RouteConfig{RouteCondition: unowned, Topic: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	callee, err := srv.Connect("callee")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer callee.Close()
+	if err := callee.ServeAny(cond, func(in interface{}) (interface{}, error) { return in, nil }); err != nil {
+		t.Fatal(err)
+	}
+	subscriber, err := srv.Connect("subscriber")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscriber.Close()
+	if err := subscriber.SubscribeAny(cond, func(evt interface{}) {}); err != nil {
+		t.Fatal(err)
+	}
+
+	introspector, err := srv.Connect("introspector")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer introspector.Close()
+	// describe waits for the route to have the sessions, as the sessions leave asynchronously
+	describe := func(procs, topics []wamp.ID) {
+		t.Helper()
+		var r *RouteInfo
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			r, err = introspector.DescribeRoute(cond.ID())
+			if err == nil && sessionsEq(r.ProcedureSessions, procs) && sessionsEq(r.TopicSessions, topics) && len(r.Procedures) == len(procs) && len(r.Topics) == len(topics) {
+				return
+			}
+		}
+		t.Fatalf("unexpected route: want procedure sessions %v and topic sessions %v, got %+v, %v", procs, topics, r, err)
+	}
+
+	describe([]wamp.ID{callee.ID()}, []wamp.ID{subscriber.ID()})
+
+	callee.Close()
+	describe(nil, []wamp.ID{subscriber.ID()})
+	if matches, err := srv.SearchRouteMatchesEvent(jsonEvent(`{"action":"opened"}`)); err != nil || len(matches) != 1 {
+		t.Errorf("unexpected matches of the route with the remaining topic: %v, %v", matches, err)
+	}
+
+	subscriber.Close()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := introspector.DescribeRoute(cond.ID()); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected route %s after all its sessions left", cond.ID())
+		}
+	}
+	if matches, err := srv.SearchRouteMatchesEvent(jsonEvent(`{"action":"opened"}`)); err != nil || len(matches) != 0 {
+		t.Errorf("unexpected matches of the removed route: %v, %v", matches, err)
+	}
+
+	r, err := introspector.DescribeRoute(unowned.ID())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(r.Topics) != 1 || len(r.TopicSessions) != 0 {
+		t.Errorf("unexpected unowned route: want 1 topic without sessions, got %+v", r)
+	}
+}
+
+func sessionsEq(a, b []wamp.ID) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
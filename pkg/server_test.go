@@ -0,0 +1,51 @@
+package diplomat
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+func TestCallRejectsAmbiguousRoutesBeforePublishing(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.nxr.Close()
+
+	ambiguous := OnURL(testChannel).Where("action").EqString("opened")
+	topic := OnURL(testChannel).Where("number").EqInt(1)
+	// Two sessions serving the route with the single dispatch, which the server is unable to choose from
+	for _, session := range []wamp.ID{1, 2} {
+		if err := srv.startRouting(RouteConfig{RouteCondition: ambiguous, Proc: true}, session); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := srv.StartRouting(RouteConfig{RouteCondition: topic, Topic: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	sub, err := srv.Connect("subscriber")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	published := make(chan string, 2)
+	for _, uri := range []string{testChannel, topic.ReceiverName()} {
+		uri := uri
+		if err := sub.Subscribe(uri, func(args wamp.List, kwargs, details wamp.Dict) { published <- uri }, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = srv.Call(jsonEvent(`{"action":"opened","number":1}`))
+	if ErrorKind(err) != ErrAmbiguousRoute {
+		t.Fatalf("unexpected error: want %v, got %v", ErrAmbiguousRoute, err)
+	}
+	if re, ok := err.(*RouteError); !ok || re.Route != ambiguous.ID() {
+		t.Errorf("unexpected route of the error: want %s, got %v", ambiguous.ID(), err)
+	}
+	select {
+	case uri := <-published:
+		t.Errorf("unexpected event published to %s", uri)
+	case <-time.After(200 * time.Millisecond):
+	}
+}